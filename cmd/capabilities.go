@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"go.dfds.cloud/ccc-exporter/internal/capability"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+// capabilities reports which rule resolved the capability of each topic, either for the topics given as arguments
+// or for every topic with usage on -date
+func capabilities(common *commonFlags, args []string) error {
+	flagSet := flag.NewFlagSet("capabilities", flag.ExitOnError)
+	common.register(flagSet)
+	date := flagSet.String("date", "", "Day to report the topics with usage for, YYYY-MM-DD, defaults to yesterday")
+	unmatched := flagSet.Bool("unmatched", false, "Only report topics that ended up in the default bucket")
+	_ = flagSet.Parse(args)
+
+	deps, err := setup(common, oneShotStateStore)
+	if err != nil {
+		return err
+	}
+
+	var matches []capability.Match
+	if topics := flagSet.Args(); len(topics) > 0 {
+		for _, topic := range topics {
+			matches = append(matches, deps.exporter.ResolveCapability(topic))
+		}
+	} else {
+		dayTime := util.ToYearMonthDayDate(time.Now().UTC().Add(-24 * time.Hour))
+		if *date != "" {
+			if dayTime, err = util.ParseYearMonthDayDate(*date); err != nil {
+				return err
+			}
+		}
+		if matches, err = deps.exporter.CapabilityReport(dayTime); err != nil {
+			return err
+		}
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "TOPIC\tCAPABILITY\tSOURCE\tRULE")
+	for _, match := range matches {
+		if *unmatched && match.Matched() {
+			continue
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", match.Topic, match.Capability, match.Source, match.Rule)
+	}
+	return writer.Flush()
+}
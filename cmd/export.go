@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"go.dfds.cloud/ccc-exporter/internal/application"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+func export(common *commonFlags, args []string) error {
+	flagSet := flag.NewFlagSet("export", flag.ExitOnError)
+	common.register(flagSet)
+	date := flagSet.String("date", "", "Day to export, YYYY-MM-DD")
+	force := flagSet.Bool("force", false, "Export again even if the day has been exported locally")
+	outputDir := flagSet.String("output", "", "Directory for the csv of a dry run instead of stdout")
+	_ = flagSet.Parse(args)
+
+	if *date == "" {
+		return errors.New("-date is required")
+	}
+	dayTime, err := util.ParseYearMonthDayDate(*date)
+	if err != nil {
+		return err
+	}
+
+	deps, err := setup(common, oneShotStateStore)
+	if err != nil {
+		return err
+	}
+
+	return deps.exporter.ExportDay(dayTime, deps.config.S3, application.ExportOptions{
+		Force:     *force,
+		OutputDir: *outputDir,
+		Stdout:    os.Stdout,
+	})
+}
+
+func backfill(common *commonFlags, args []string) error {
+	flagSet := flag.NewFlagSet("backfill", flag.ExitOnError)
+	common.register(flagSet)
+	from := flagSet.String("from", "", "First day to export, YYYY-MM-DD")
+	to := flagSet.String("to", "", "Last day to export, YYYY-MM-DD")
+	force := flagSet.Bool("force", false, "Export again even if a day has been exported locally")
+	outputDir := flagSet.String("output", "", "Directory for the csv files of a dry run instead of stdout")
+	_ = flagSet.Parse(args)
+
+	if *from == "" || *to == "" {
+		return errors.New("-from and -to are required")
+	}
+	fromDay, err := util.ParseYearMonthDayDate(*from)
+	if err != nil {
+		return err
+	}
+	toDay, err := util.ParseYearMonthDayDate(*to)
+	if err != nil {
+		return err
+	}
+	if fromDay.ToTimeUTC().After(toDay.ToTimeUTC()) {
+		return fmt.Errorf("-from %s is after -to %s", fromDay, toDay)
+	}
+
+	deps, err := setup(common, oneShotStateStore)
+	if err != nil {
+		return err
+	}
+
+	var failed []util.YearMonthDayDate
+	for day := fromDay.ToTimeUTC(); !day.After(toDay.ToTimeUTC()); day = day.AddDate(0, 0, 1) {
+		dayTime := util.ToYearMonthDayDate(day)
+		err = deps.exporter.ExportDay(dayTime, deps.config.S3, application.ExportOptions{
+			Force:     *force,
+			OutputDir: *outputDir,
+			Stdout:    os.Stdout,
+		})
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to export %s", dayTime)
+			failed = append(failed, dayTime)
+			continue
+		}
+		log.Info().Msgf("exported %s", dayTime)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d days failed to export: %v", len(failed), failed)
+	}
+	return nil
+}
@@ -3,55 +3,169 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"os"
+
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
-	"github.com/gofiber/adaptor/v2"
-	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/pprof"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
 	"go.dfds.cloud/ccc-exporter/config"
 	"go.dfds.cloud/ccc-exporter/internal/application"
 	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/service"
+	"go.dfds.cloud/ccc-exporter/internal/store"
 )
 
 const defaultConfigFile = "config.json"
 
-var configFile = flag.String("config", "config.json", "Path to configuration file")
+const usage = `Usage: ccc-exporter [-config file] [-dry-run] <command> [flags]
+
+Commands:
+  serve         run the worker exporting the last days and serve /metrics (default)
+  export        export a single day, -date YYYY-MM-DD
+  backfill      export a range of days, -from YYYY-MM-DD -to YYYY-MM-DD
+  validate      check the configuration and the credentials for Confluent Cloud, Prometheus and S3
+  capabilities  report which rule resolved the capability of each topic, [-date YYYY-MM-DD] [-unmatched] [topic...]
+
+-dry-run computes the csv without putting it in S3, export and backfill print it or write it to -output
+`
+
+type commonFlags struct {
+	configFile string
+	dryRun     bool
+}
+
+// register adds the flags accepted both before and after the command
+func (c *commonFlags) register(flagSet *flag.FlagSet) {
+	flagSet.StringVar(&c.configFile, "config", c.configFile, "Path to configuration file")
+	flagSet.BoolVar(&c.dryRun, "dry-run", c.dryRun, "Compute exports without putting them in S3")
+}
+
+// dependencies holds everything built from the configuration that the commands share
+type dependencies struct {
+	config          config.Config
+	promSources     *service.PrometheusSources
+	confluentClient *client.ConfluentCloudClient
+	s3Client        *client.S3Client
+	clusterRegistry *service.ClusterRegistry
+	principals      *service.PrincipalDirectory
+	exporter        application.ExporterApplication
+	// discoveryErr is why the Confluent clusters could not be discovered, the registry then only knows the static clusters
+	discoveryErr error
+}
 
 func main() {
-	flag.Parse()
+	common := &commonFlags{configFile: defaultConfigFile}
+	globalFlags := flag.NewFlagSet("ccc-exporter", flag.ExitOnError)
+	globalFlags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	common.register(globalFlags)
+	_ = globalFlags.Parse(os.Args[1:])
 
-	app := fiber.New(fiber.Config{DisableStartupMessage: true})
-	app.Use(pprof.New())
-	app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
+	command := "serve"
+	args := globalFlags.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "serve":
+		err = serve(common, args)
+	case "export":
+		err = export(common, args)
+	case "backfill":
+		err = backfill(common, args)
+	case "validate":
+		err = validate(common, args)
+	case "capabilities":
+		err = capabilities(common, args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n%s", command, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msgf("%s failed", command)
+	}
+}
+
+// setup builds the dependencies of the commands exporting costs, they can not do without the Confluent clusters
+func setup(common *commonFlags, stateStore func(config.Config, *client.S3Client) (store.StateStore, error)) (*dependencies, error) {
+	deps, err := setupDependencies(common, stateStore)
+	if err != nil {
+		return nil, err
+	}
+	if deps.discoveryErr != nil {
+		return nil, fmt.Errorf("failed to discover Confluent clusters: %w", deps.discoveryErr)
+	}
+	return deps, nil
+}
 
-	if *configFile != defaultConfigFile {
-		log.Info().Msgf("Using config file: %s", *configFile)
+// setupDependencies builds everything from the configuration, failing to discover the Confluent clusters is left to the caller
+func setupDependencies(common *commonFlags, stateStore func(config.Config, *client.S3Client) (store.StateStore, error)) (*dependencies, error) {
+	if common.configFile != defaultConfigFile {
+		log.Info().Msgf("Using config file: %s", common.configFile)
 	}
 
-	loadedConfig, err := config.LoadConfig(*configFile)
+	loadedConfig, err := config.LoadConfig(common.configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config file %s: %w", common.configFile, err)
+	}
+	promSources, err := service.NewPrometheusSources(loadedConfig.Prometheus)
 	if err != nil {
-		log.Fatal().Err(err).Msgf("Failed to load config file: %s", *configFile)
+		return nil, fmt.Errorf("failed to create prometheus clients: %w", err)
 	}
-	promClient := client.NewPrometheusClient(loadedConfig.Prometheus.Endpoint)
 	confluentClient := client.NewConfluentCloudClient(loadedConfig.Confluent)
 
+	clusterRegistry := service.NewClusterRegistry(confluentClient, loadedConfig.Confluent)
+	discoveryErr := clusterRegistry.Refresh(context.Background())
+
+	principalDirectory, err := service.NewPrincipalDirectory(confluentClient, loadedConfig.Iam)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create principal directory: %w", err)
+	}
+	if err := principalDirectory.Refresh(context.Background()); err != nil {
+		log.Error().Err(err).Msg("Failed to discover Confluent service accounts and api keys, will retry on next refresh")
+	}
+
 	loadedAwsConfig, err := awsConfig.LoadDefaultConfig(context.Background())
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to load AWS config")
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
 	loadedAwsConfig.Region = loadedConfig.S3.Region
-	s3Client, err := client.NewS3Client(loadedAwsConfig)
+	s3Client, err := client.NewS3Client(loadedAwsConfig, loadedConfig.S3)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to create S3 client")
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
 	}
 
-	exporterApplication := application.NewExporterApplication(promClient, confluentClient, s3Client)
-	go exporterApplication.Work(loadedConfig.Worker, loadedConfig.S3)
+	exportStateStore, err := stateStore(loadedConfig, s3Client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create state store: %w", err)
+	}
 
-	err = app.Listen(":8080")
+	exporterApplication, err := application.NewExporterApplication(loadedConfig, promSources, confluentClient, s3Client, clusterRegistry, principalDirectory, exportStateStore)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to create exporter application: %w", err)
 	}
+	exporterApplication.SetDryRun(common.dryRun)
+
+	return &dependencies{
+		config:          loadedConfig,
+		promSources:     promSources,
+		confluentClient: confluentClient,
+		s3Client:        s3Client,
+		clusterRegistry: clusterRegistry,
+		principals:      principalDirectory,
+		exporter:        exporterApplication,
+		discoveryErr:    discoveryErr,
+	}, nil
+}
+
+// configuredStateStore is used by the long-running worker so it can resume after a restart
+func configuredStateStore(loadedConfig config.Config, s3Client *client.S3Client) (store.StateStore, error) {
+	return store.NewStateStore(loadedConfig.State, loadedConfig.S3, s3Client)
+}
+
+// oneShotStateStore keeps one-off commands from touching the state of the worker
+func oneShotStateStore(config.Config, *client.S3Client) (store.StateStore, error) {
+	return store.NewMemoryStore(), nil
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+
+	"github.com/gofiber/adaptor/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/pprof"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"go.dfds.cloud/ccc-exporter/internal/api"
+	"go.dfds.cloud/ccc-exporter/internal/application"
+	"go.dfds.cloud/ccc-exporter/internal/auth"
+)
+
+func serve(common *commonFlags, args []string) error {
+	flagSet := flag.NewFlagSet("serve", flag.ExitOnError)
+	common.register(flagSet)
+	_ = flagSet.Parse(args)
+
+	// dry runs keep their state in memory, so a later real run exports their days again
+	stateStore := configuredStateStore
+	if common.dryRun {
+		stateStore = oneShotStateStore
+	}
+	deps, err := setup(common, stateStore)
+	if err != nil {
+		return err
+	}
+	if common.dryRun {
+		log.Info().Msgf("Dry run, exports are kept in %s and not put in S3", application.DryRunExportDir)
+	}
+
+	if costCollector := deps.exporter.CostCollector(); costCollector != nil {
+		prometheus.MustRegister(costCollector)
+	}
+
+	authenticator, err := auth.NewAuthenticator(deps.config.Server.Auth)
+	if err != nil {
+		return err
+	}
+	adminAddress := deps.config.Server.AdminAddress
+	if authenticator.Mode() == auth.ModeNone {
+		// profiling and forced exports, which replace objects in S3, are never served unauthenticated beyond the pod
+		if adminAddress != "" && !isLoopback(adminAddress) {
+			return fmt.Errorf("admin listener on %s needs auth, set server.auth.mode or bind it to 127.0.0.1", adminAddress)
+		}
+		log.Warn().Msg("Auth mode none, the API accepts every request")
+	}
+
+	// the public listener serves metrics and cost queries, profiling and export triggers are kept on the admin listener
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
+	api.NewCostApi(&deps.exporter).Register(app.Group("/api/v1"), authenticator)
+
+	listenErrs := make(chan error, 2)
+	if adminAddress != "" {
+		admin := fiber.New(fiber.Config{DisableStartupMessage: true})
+		admin.Use("/debug/pprof", authenticator.Require(auth.ScopeProfiling))
+		admin.Use(pprof.New())
+		api.NewExportApi(&deps.exporter).Register(admin.Group("/api/v1"), authenticator)
+		log.Info().Msgf("Admin listener on %s", adminAddress)
+		go func() {
+			if err := admin.Listen(adminAddress); err != nil {
+				listenErrs <- fmt.Errorf("admin listener: %w", err)
+			}
+		}()
+	} else {
+		log.Info().Msg("No admin address, profiling and export endpoints are disabled")
+	}
+
+	go deps.clusterRegistry.Work(deps.config.Confluent.ClusterRefreshIntervalSeconds)
+	go deps.principals.Work(deps.config.Iam.RefreshIntervalSeconds)
+	go deps.exporter.Work(deps.config.Worker, deps.config.S3)
+
+	go func() {
+		listenErrs <- app.Listen(deps.config.Server.Address)
+	}()
+	return <-listenErrs
+}
+
+// isLoopback reports whether address only accepts connections from the same host
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"go.dfds.cloud/ccc-exporter/internal/auth"
+)
+
+// validate checks the configuration and that every upstream accepts the configured credentials.
+// The configuration itself is validated when the dependencies are set up.
+func validate(common *commonFlags, args []string) error {
+	flagSet := flag.NewFlagSet("validate", flag.ExitOnError)
+	common.register(flagSet)
+	_ = flagSet.Parse(args)
+
+	// failing to discover the clusters is reported by the confluent cloud check rather than stopping the other checks
+	deps, err := setupDependencies(common, oneShotStateStore)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stdout, "configuration: ok")
+
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"confluent cloud", func() error {
+			environments, err := deps.confluentClient.GetEnvironments(context.Background())
+			if err != nil {
+				return err
+			}
+			if err := deps.clusterRegistry.Refresh(context.Background()); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stdout, "  %d environments, %d clusters\n", len(environments.Data), len(deps.clusterRegistry.ClusterIds()))
+			if deps.principals.IsEnabled() {
+				if err := deps.principals.Refresh(context.Background()); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"prometheus", func() error {
+			// every source is checked, the exporter would silently skip a broken one
+			var errs []error
+			for _, promClient := range deps.promSources.Clients() {
+				resp, err := promClient.Query("vector(1)", float64(time.Now().Unix()))
+				if err == nil {
+					_, err = resp.ToVector()
+				}
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", promClient.Name(), err))
+					continue
+				}
+				for _, warning := range resp.Warnings {
+					fmt.Fprintf(os.Stdout, "  warning from %s: %s\n", promClient.Name(), warning)
+				}
+			}
+			return errors.Join(errs...)
+		}},
+		{"s3", func() error {
+			if deps.config.S3.BucketName == "" {
+				return errors.New("no bucket name configured")
+			}
+			_, err := deps.s3Client.ListObjects(deps.config.S3.BucketName, deps.config.S3.BucketKey)
+			return err
+		}},
+		{"auth", func() error {
+			authenticator, err := auth.NewAuthenticator(deps.config.Server.Auth)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stdout, "  mode %s\n", authenticator.Mode())
+			return authenticator.Refresh(context.Background())
+		}},
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			fmt.Fprintf(os.Stdout, "%s: failed, %s\n", c.name, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "%s: ok\n", c.name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
@@ -7,29 +7,265 @@ import (
 )
 
 type Worker struct {
-	IntervalSeconds          int  `mapstructure:"intervalSeconds"`
-	DaysToLookBack           int  `mapstructure:"daysToLookBack"`
-	CheckForExportedDataInS3 bool `mapstructure:"checkForExportedDataInS3"`
+	IntervalSeconds             int  `mapstructure:"intervalSeconds"`
+	DaysToLookBack              int  `mapstructure:"daysToLookBack"`
+	CheckForExportedDataInS3    bool `mapstructure:"checkForExportedDataInS3"`
+	CheckForExportedDataLocally bool `mapstructure:"checkForExportedDataLocally"`
+}
+
+type Cluster struct {
+	Id            string `mapstructure:"id"`
+	DisplayName   string `mapstructure:"displayName"`
+	EnvironmentId string `mapstructure:"environmentId"`
+	// RestEndpoint of the Kafka REST v3 API of the cluster, only needed when partitions are counted through it
+	RestEndpoint string `mapstructure:"restEndpoint"`
+	// Kind is the cluster type, e.g. Dedicated. Load based allocation only applies to dedicated clusters,
+	// so static clusters need a kind when costs are allocated by load.
+	Kind string `mapstructure:"kind"`
+}
+
+type Retry struct {
+	MaxAttempts          int `mapstructure:"maxAttempts"`
+	InitialBackoffMillis int `mapstructure:"initialBackoffMillis"`
+	MaxBackoffMillis     int `mapstructure:"maxBackoffMillis"`
 }
 
 type Confluent struct {
-	ApiKeyId     string `mapstructure:"apiKeyId" env:"CCC_EXPORTER_CC_API_KEY_ID"`
-	ApiKeySecret string `mapstructure:"apiKeySecret" env:"CCC_EXPORTER_CC_API_KEY_SECRET"`
+	Endpoint        string `mapstructure:"endpoint"`
+	ApiKeyId        string `mapstructure:"apiKeyId" env:"CCC_EXPORTER_CC_API_KEY_ID"`
+	ApiKeySecret    string `mapstructure:"apiKeySecret" env:"CCC_EXPORTER_CC_API_KEY_SECRET"`
+	BillingPageSize int    `mapstructure:"billingPageSize"`
+	// RequestTimeoutSeconds applies to every single attempt, retries get their own timeout
+	RequestTimeoutSeconds int   `mapstructure:"requestTimeoutSeconds"`
+	Retry                 Retry `mapstructure:"retry"`
+	// Clusters overrides cluster discovery through the Confluent Cloud API when not empty
+	Clusters                      []Cluster `mapstructure:"clusters"`
+	ClusterRefreshIntervalSeconds int       `mapstructure:"clusterRefreshIntervalSeconds"`
 }
 
 type S3 struct {
 	BucketName string `mapstructure:"bucketName"  env:"CCC_EXPORTER_S3_BUCKET_NAME"`
 	BucketKey  string `mapstructure:"bucketKey" env:"CCC_EXPORTER_S3_BUCKET_KEY"`
 	Region     string `mapstructure:"region"`
+	// Endpoint points the client at an S3 compatible service instead of AWS, e.g. a local MinIO
+	Endpoint     string `mapstructure:"endpoint"`
+	UsePathStyle bool   `mapstructure:"usePathStyle"`
+}
+
+type KafkaRestCredentials struct {
+	ClusterId    string `mapstructure:"clusterId"`
+	ApiKeyId     string `mapstructure:"apiKeyId"`
+	ApiKeySecret string `mapstructure:"apiKeySecret"`
+}
+
+type Partitions struct {
+	// Source is none, prometheus or rest. The Kafka REST v3 API only knows the current partition counts,
+	// so backfills through it bill past days by today's partitions.
+	Source string `mapstructure:"source"`
+	// Metric is the Prometheus gauge with the partition count per kafka_id and topic. The partition_count of the
+	// Confluent metrics API has no topic label, so it can not be used.
+	Metric string `mapstructure:"metric"`
+	// Credentials are the cluster API keys for the Kafka REST v3 API
+	Credentials []KafkaRestCredentials `mapstructure:"credentials"`
+}
+
+type Header struct {
+	Name  string `mapstructure:"name"`
+	Value string `mapstructure:"value"`
+}
+
+type PrometheusEndpoint struct {
+	// Name identifies the source in logs and metrics, the endpoint is used when it is empty
+	Name     string `mapstructure:"name"`
+	Endpoint string `mapstructure:"endpoint"`
+	// TenantId is sent as X-Scope-OrgID to multi-tenant setups like Mimir or Thanos
+	TenantId string `mapstructure:"tenantId"`
+	// BearerTokenFile and PasswordFile are read for every request, so rotated credentials are picked up.
+	// BearerTokenEnv and PasswordEnv name environment variables holding the credentials, e.g. for the entries of sources.
+	BearerToken     string `mapstructure:"bearerToken"`
+	BearerTokenFile string `mapstructure:"bearerTokenFile"`
+	BearerTokenEnv  string `mapstructure:"bearerTokenEnv"`
+	Username        string `mapstructure:"username"`
+	Password        string `mapstructure:"password"`
+	PasswordFile    string `mapstructure:"passwordFile"`
+	PasswordEnv     string `mapstructure:"passwordEnv"`
+	// CaFile is added to the system CA bundle, CertFile and KeyFile enable mTLS
+	CaFile             string   `mapstructure:"caFile"`
+	CertFile           string   `mapstructure:"certFile"`
+	KeyFile            string   `mapstructure:"keyFile"`
+	InsecureSkipVerify bool     `mapstructure:"insecureSkipVerify"`
+	Headers            []Header `mapstructure:"headers"`
+	// RequestTimeoutSeconds bounds a single query including reading its result, it defaults to 120
+	RequestTimeoutSeconds int `mapstructure:"requestTimeoutSeconds"`
+}
+
+type Prometheus struct {
+	PrometheusEndpoint `mapstructure:",squash"`
+	// Sources replaces the single endpoint above when set, e.g. for HA pairs or one Prometheus per region
+	Sources []PrometheusEndpoint `mapstructure:"sources"`
+	// MergeStrategy decides the value of series found in more than one source, one of max, first or sum.
+	// Series of replicas within a source always keep the highest value.
+	MergeStrategy string `mapstructure:"mergeStrategy"`
+	// ReplicaLabels are ignored when telling series apart, so the series of each replica are merged
+	ReplicaLabels []string `mapstructure:"replicaLabels"`
+}
+
+type ConnectorCapability struct {
+	// Connector is matched against both the connector id and the connector name
+	Connector  string `mapstructure:"connector"`
+	Capability string `mapstructure:"capability"`
+}
+
+type Connect struct {
+	Capabilities []ConnectorCapability `mapstructure:"capabilities"`
+	// CapabilityPattern is used on connector names without an explicit capability, the first submatch is the capability
+	CapabilityPattern string `mapstructure:"capabilityPattern"`
+}
+
+type CapabilityRule struct {
+	Name string `mapstructure:"name"`
+	// Pattern has to capture the capability in a (?P<capability>...) group
+	Pattern string `mapstructure:"pattern"`
+}
+
+type TopicCapability struct {
+	Topic      string `mapstructure:"topic"`
+	Capability string `mapstructure:"capability"`
+}
+
+type Capabilities struct {
+	// Rules are tried in order, the first matching rule decides the capability of a topic
+	Rules     []CapabilityRule  `mapstructure:"rules"`
+	Overrides []TopicCapability `mapstructure:"overrides"`
+	// OverridesFile holds more overrides as a JSON array of {"topic", "capability"} objects, they win over Overrides.
+	// The file is read again when it changes.
+	OverridesFile string `mapstructure:"overridesFile"`
+	// Exclusions sends topics whose name contains any of them to the default bucket, e.g. the internal topics of ksqlDB
+	Exclusions []string `mapstructure:"exclusions"`
+	Default    string   `mapstructure:"default"`
+}
+
+type Catalogue struct {
+	// Endpoint returns the capabilities as a JSON array, File reads the same array from disk instead
+	Endpoint              string `mapstructure:"endpoint"`
+	File                  string `mapstructure:"file"`
+	Token                 string `mapstructure:"token" env:"CCC_CATALOGUE_TOKEN"`
+	TtlSeconds            int    `mapstructure:"ttlSeconds"`
+	RequestTimeoutSeconds int    `mapstructure:"requestTimeoutSeconds"`
+}
+
+func (c Catalogue) IsConfigured() bool {
+	return c.Endpoint != "" || c.File != ""
+}
+
+type CapabilityWeight struct {
+	Capability string  `mapstructure:"capability"`
+	Weight     float64 `mapstructure:"weight"`
+}
+
+type SharedCostPolicy struct {
+	CostType string `mapstructure:"costType"`
+	// Strategy is one of proportional, even, weighted or load
+	Strategy string             `mapstructure:"strategy"`
+	Weights  []CapabilityWeight `mapstructure:"weights"`
+}
+
+type Allocation struct {
+	// SharedCosts lists the cost types spread across capabilities, cost types without a policy are left out of the export
+	SharedCosts []SharedCostPolicy `mapstructure:"sharedCosts"`
+}
+
+type PrincipalCapability struct {
+	// Principal is the principal_id label value, e.g. the id of a service account
+	Principal  string `mapstructure:"principal"`
+	Capability string `mapstructure:"capability"`
+}
+
+type Attribution struct {
+	// Mode is topic to bill read bytes to the capability owning the topic, or principal to bill them to the consuming principals
+	Mode       string                `mapstructure:"mode"`
+	Principals []PrincipalCapability `mapstructure:"principals"`
+}
+
+type Iam struct {
+	// Discover lists service accounts and API keys through the Confluent Cloud IAM API to resolve principals to their owners
+	Discover               bool `mapstructure:"discover"`
+	RefreshIntervalSeconds int  `mapstructure:"refreshIntervalSeconds"`
+	// CapabilityField is the service account field CapabilityPattern is matched against, description or displayName
+	CapabilityField string `mapstructure:"capabilityField"`
+	// CapabilityPattern extracts the owning capability, the first submatch is the capability
+	CapabilityPattern string `mapstructure:"capabilityPattern"`
+}
+
+type Reconciliation struct {
+	// MaxDriftPercent fails the export when the cost allocated to topics differs more from the invoice, 0 disables the check
+	MaxDriftPercent float64 `mapstructure:"maxDriftPercent"`
+}
+
+// CostMetrics publishes the allocated costs and topic usage of the latest exported day on /metrics
+type CostMetrics struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MaxCapabilitySeries and MaxTopicSeries keep the largest series, the rest is added up under _OTHER. 0 means no limit.
+	MaxCapabilitySeries int `mapstructure:"maxCapabilitySeries"`
+	MaxTopicSeries      int `mapstructure:"maxTopicSeries"`
+}
+
+type State struct {
+	// Store is one of file, s3 or none. The file store replaces a single JSON file at Path on every save,
+	// Path has to be on a persistent volume for the state to survive the pod being replaced, use s3 otherwise.
+	Store string `mapstructure:"store"`
+	Path  string `mapstructure:"path"`
+	// S3Key is the key of the state object in the export bucket
+	S3Key string `mapstructure:"s3Key"`
+}
+
+type Oidc struct {
+	// JwksUrl serves the keys tokens are signed with, it is read again when a token names an unknown key
+	JwksUrl string `mapstructure:"jwksUrl"`
+	// Issuer and Audience have to match the iss and aud claims of every token
+	Issuer   string `mapstructure:"issuer"`
+	Audience string `mapstructure:"audience"`
+	// ScopeClaim holds the granted scopes, either space separated or as an array
+	ScopeClaim             string `mapstructure:"scopeClaim"`
+	RefreshIntervalSeconds int    `mapstructure:"refreshIntervalSeconds"`
+	RequestTimeoutSeconds  int    `mapstructure:"requestTimeoutSeconds"`
+	// LeewaySeconds is the clock skew tolerated when checking exp and nbf
+	LeewaySeconds int `mapstructure:"leewaySeconds"`
+}
+
+type Auth struct {
+	// Mode is none, token or oidc
+	Mode string `mapstructure:"mode"`
+	// TokenFile has a name, a bearer token and the scopes granted to it on every line, it is read again when it changes
+	TokenFile string `mapstructure:"tokenFile"`
+	Oidc      Oidc   `mapstructure:"oidc"`
+}
+
+type Server struct {
+	// Address serves /metrics and the cost queries
+	Address string `mapstructure:"address"`
+	// AdminAddress serves profiling and the export endpoints, empty disables them.
+	// Without auth it has to be a loopback address.
+	AdminAddress string `mapstructure:"adminAddress"`
+	Auth         Auth   `mapstructure:"auth"`
 }
 
 type Config struct {
-	Worker     Worker    `mapstructure:"worker"`
-	S3         S3        `mapstructure:"s3"`
-	Confluent  Confluent `mapstructure:"confluent"`
-	Prometheus struct {
-		Endpoint string `mapstructure:"endpoint"`
-	}
+	Worker         Worker         `mapstructure:"worker"`
+	S3             S3             `mapstructure:"s3"`
+	Confluent      Confluent      `mapstructure:"confluent"`
+	Prometheus     Prometheus     `mapstructure:"prometheus"`
+	Partitions     Partitions     `mapstructure:"partitions"`
+	Capabilities   Capabilities   `mapstructure:"capabilities"`
+	Catalogue      Catalogue      `mapstructure:"catalogue"`
+	Connect        Connect        `mapstructure:"connect"`
+	Allocation     Allocation     `mapstructure:"allocation"`
+	Attribution    Attribution    `mapstructure:"attribution"`
+	Iam            Iam            `mapstructure:"iam"`
+	Reconciliation Reconciliation `mapstructure:"reconciliation"`
+	State          State          `mapstructure:"state"`
+	CostMetrics    CostMetrics    `mapstructure:"costMetrics"`
+	Server         Server         `mapstructure:"server"`
 }
 
 func LoadConfig(configName string) (Config, error) {
@@ -41,11 +277,63 @@ func LoadConfig(configName string) (Config, error) {
 
 	viper.SetDefault("worker.intervalSeconds", 60)
 	viper.SetDefault("worker.daysToLookBack", 7)
+	viper.SetDefault("worker.checkForExportedDataLocally", true)
+	viper.SetDefault("confluent.endpoint", "https://api.confluent.cloud")
+	viper.SetDefault("confluent.clusterRefreshIntervalSeconds", 3600)
+	viper.SetDefault("confluent.requestTimeoutSeconds", 30)
+	viper.SetDefault("confluent.retry.maxAttempts", 5)
+	viper.SetDefault("confluent.retry.initialBackoffMillis", 500)
+	viper.SetDefault("confluent.retry.maxBackoffMillis", 30000)
+
+	viper.SetDefault("prometheus.mergeStrategy", "max")
+	viper.SetDefault("prometheus.replicaLabels", []string{"replica", "prometheus_replica"})
+	viper.SetDefault("partitions.source", "none")
+	viper.SetDefault("partitions.metric", "confluent_kafka_server_partition_count")
+
+	viper.SetDefault("state.store", "file")
+	viper.SetDefault("state.path", "state/export-state.json")
+	viper.SetDefault("state.s3Key", "ccc-exporter/export-state.json")
+	viper.SetDefault("capabilities.rules", []map[string]any{
+		{"name": "capability-root-id", "pattern": "(pub.)?(?P<capability>.*-.{5})\\."},
+	})
+	viper.SetDefault("capabilities.exclusions", []string{"_confluent-ksql"})
+	viper.SetDefault("capabilities.default", "UNKNOWN")
+	viper.SetDefault("catalogue.ttlSeconds", 3600)
+	viper.SetDefault("catalogue.requestTimeoutSeconds", 10)
+	viper.SetDefault("connect.capabilityPattern", "^(.+?-[a-z0-9]{5})(?:[-._]|$)")
+
+	viper.SetDefault("costMetrics.enabled", true)
+	viper.SetDefault("costMetrics.maxCapabilitySeries", 1000)
+	viper.SetDefault("costMetrics.maxTopicSeries", 2000)
+
+	viper.SetDefault("server.address", ":8080")
+	viper.SetDefault("server.adminAddress", "127.0.0.1:8081")
+	viper.SetDefault("server.auth.mode", "none")
+	viper.SetDefault("server.auth.oidc.scopeClaim", "scope")
+	viper.SetDefault("server.auth.oidc.refreshIntervalSeconds", 3600)
+	viper.SetDefault("server.auth.oidc.requestTimeoutSeconds", 10)
+	viper.SetDefault("server.auth.oidc.leewaySeconds", 60)
+
+	viper.SetDefault("attribution.mode", "topic")
+	viper.SetDefault("iam.refreshIntervalSeconds", 3600)
+	viper.SetDefault("iam.capabilityField", "description")
+	viper.SetDefault("iam.capabilityPattern", "([a-z0-9]+(?:-[a-z0-9]+)*-[a-z0-9]{5})")
+	viper.SetDefault("allocation.sharedCosts", []map[string]any{
+		{"costType": "SUPPORT", "strategy": "proportional"},
+		{"costType": "KAFKA_BASE", "strategy": "load"},
+		{"costType": "KAFKA_NUM_CKUS", "strategy": "load"},
+	})
 
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.SetEnvPrefix("CCC")
 	// override with environment variables if any available
 	viper.AutomaticEnv()
+	// keys without a default are only read from the environment when bound, e.g. CCC_PROMETHEUS_BEARERTOKEN
+	for _, key := range []string{"prometheus.bearerToken", "prometheus.username", "prometheus.password"} {
+		if err := viper.BindEnv(key); err != nil {
+			return conf, fmt.Errorf("error binding environment variable for %s: %w", key, err)
+		}
+	}
 
 	if err := viper.ReadInConfig(); err != nil {
 		return conf, fmt.Errorf("error reading configuration file: %w", err)
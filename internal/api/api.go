@@ -0,0 +1,147 @@
+// Package api serves the computed costs and the export queue over HTTP under /api/v1
+package api
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+	// maxDays bounds the number of days a single request reads
+	maxDays = 31
+
+	mimeTextCsv = "text/csv"
+)
+
+//go:embed openapi.json
+var openApiDocument []byte
+
+type Pagination struct {
+	Page     int `json:"page"`
+	PageSize int `json:"pageSize"`
+	Total    int `json:"total"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func errorStatus(c *fiber.Ctx, status int, err error) error {
+	return c.Status(status).JSON(errorResponse{Error: err.Error()})
+}
+
+func getOpenApi(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(openApiDocument)
+}
+
+// parsePagination reads the 1-based page and the page size from the query
+func parsePagination(c *fiber.Ctx) (Pagination, error) {
+	pagination := Pagination{Page: 1, PageSize: defaultPageSize}
+	if value := c.Query("page"); value != "" {
+		page, err := strconv.Atoi(value)
+		if err != nil || page < 1 {
+			return pagination, fmt.Errorf("invalid page %s, expected a number from 1", value)
+		}
+		pagination.Page = page
+	}
+	if value := c.Query("pageSize"); value != "" {
+		pageSize, err := strconv.Atoi(value)
+		if err != nil || pageSize < 1 || pageSize > maxPageSize {
+			return pagination, fmt.Errorf("invalid pageSize %s, expected a number from 1 to %d", value, maxPageSize)
+		}
+		pagination.PageSize = pageSize
+	}
+	return pagination, nil
+}
+
+// paginate returns the items on the page and sets the total, pages past the end are empty
+func paginate[T any](items []T, pagination *Pagination) []T {
+	pagination.Total = len(items)
+	start := (pagination.Page - 1) * pagination.PageSize
+	if start >= len(items) {
+		return []T{}
+	}
+	end := min(start+pagination.PageSize, len(items))
+	return items[start:end]
+}
+
+// parseDateRange reads from and to (YYYY-MM-DD, both included) from the query, both default to yesterday
+func parseDateRange(c *fiber.Ctx) (util.YearMonthDayDate, util.YearMonthDayDate, error) {
+	yesterday := util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -1))
+	from, to := yesterday, yesterday
+	var err error
+	if value := c.Query("to"); value != "" {
+		if to, err = util.ParseYearMonthDayDate(value); err != nil {
+			return from, to, err
+		}
+		from = to
+	}
+	if value := c.Query("from"); value != "" {
+		if from, err = util.ParseYearMonthDayDate(value); err != nil {
+			return from, to, err
+		}
+	}
+
+	if from.ToTimeUTC().After(to.ToTimeUTC()) {
+		return from, to, errors.New("from is after to")
+	}
+	if days := int(to.ToTimeUTC().Sub(from.ToTimeUTC()).Hours()/24) + 1; days > maxDays {
+		return from, to, fmt.Errorf("%d days requested, at most %d days can be read at once", days, maxDays)
+	}
+	return from, to, nil
+}
+
+// queryList reads a comma separated filter, an empty filter matches everything
+func queryList(c *fiber.Ctx, key string) map[string]bool {
+	value := c.Query(key)
+	if value == "" {
+		return nil
+	}
+	values := make(map[string]bool)
+	for _, v := range strings.Split(value, ",") {
+		values[strings.TrimSpace(v)] = true
+	}
+	return values
+}
+
+func matches(filter map[string]bool, value string) bool {
+	return filter == nil || filter[value]
+}
+
+// wantsCsv negotiates the response format, format=csv in the query wins over the Accept header
+func wantsCsv(c *fiber.Ctx) bool {
+	if format := c.Query("format"); format != "" {
+		return format == "csv"
+	}
+	return c.Accepts(fiber.MIMEApplicationJSON, mimeTextCsv) == mimeTextCsv
+}
+
+// sendCsv writes the records as csv, the total of the pagination is sent in the X-Total-Count header
+func sendCsv(c *fiber.Ctx, pagination Pagination, headers []string, records [][]string) error {
+	c.Set(fiber.HeaderContentType, mimeTextCsv)
+	c.Set("X-Total-Count", strconv.Itoa(pagination.Total))
+
+	writer := csv.NewWriter(c.Response().BodyWriter())
+	if err := writer.Write(headers); err != nil {
+		return err
+	}
+	if err := writer.WriteAll(records); err != nil {
+		return err
+	}
+	return writer.Error()
+}
+
+func formatCost(cost float64) string {
+	return fmt.Sprintf("%f", cost)
+}
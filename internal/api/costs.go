@@ -0,0 +1,367 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+	"go.dfds.cloud/ccc-exporter/internal/application"
+	"go.dfds.cloud/ccc-exporter/internal/auth"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+// CostApi serves the rows of stored exports, and of days computed but not exported yet
+type CostApi struct {
+	exporter *application.ExporterApplication
+}
+
+func NewCostApi(exporter *application.ExporterApplication) *CostApi {
+	return &CostApi{exporter: exporter}
+}
+
+// Register adds the cost routes, the OpenAPI document is served without authentication
+func (a *CostApi) Register(router fiber.Router, authenticator *auth.Authenticator) {
+	read := authenticator.Require(auth.ScopeCostsRead)
+	router.Get("/openapi.json", getOpenApi)
+	router.Get("/costs", read, a.getCosts)
+	router.Get("/capabilities", read, a.getCapabilities)
+	router.Get("/capabilities/:capability", read, a.getCapability)
+	router.Get("/clusters", read, a.getClusters)
+}
+
+// CostRow is an export row, the principal and catalogue fields are only set when the export has them
+type CostRow struct {
+	Date               string  `json:"date"`
+	Cost               float64 `json:"cost"`
+	Name               string  `json:"name"`
+	ClusterId          string  `json:"clusterId"`
+	Action             string  `json:"action"`
+	Capability         string  `json:"capability"`
+	PrincipalId        string  `json:"principalId,omitempty"`
+	PrincipalName      string  `json:"principalName,omitempty"`
+	ProducerCapability string  `json:"producerCapability,omitempty"`
+	ConsumerCapability string  `json:"consumerCapability,omitempty"`
+	CapabilityName     string  `json:"capabilityName,omitempty"`
+	Team               string  `json:"team,omitempty"`
+	CostCentre         string  `json:"costCentre,omitempty"`
+	BusinessUnit       string  `json:"businessUnit,omitempty"`
+	CostType           string  `json:"costType,omitempty"`
+}
+
+func toCostRow(row model.ExportRow) CostRow {
+	return CostRow{
+		Date:               row.Date.String(),
+		Cost:               row.Cost,
+		Name:               row.Name,
+		ClusterId:          row.ClusterId,
+		Action:             row.Action,
+		Capability:         row.Capability,
+		PrincipalId:        string(row.PrincipalId),
+		PrincipalName:      row.PrincipalName,
+		ProducerCapability: row.ProducerCapability,
+		ConsumerCapability: row.ConsumerCapability,
+		CapabilityName:     row.CapabilityName,
+		Team:               row.Team,
+		CostCentre:         row.CostCentre,
+		BusinessUnit:       row.BusinessUnit,
+		CostType:           string(row.CostType),
+	}
+}
+
+type CostsResponse struct {
+	From       string     `json:"from"`
+	To         string     `json:"to"`
+	Data       []CostRow  `json:"data"`
+	Pagination Pagination `json:"pagination"`
+	// MissingDays were neither exported nor computed yet
+	MissingDays []string `json:"missingDays"`
+}
+
+// ResourceCosts is the cost of a topic, connector or shared cost, by action
+type ResourceCosts struct {
+	Name      string             `json:"name"`
+	ClusterId string             `json:"clusterId"`
+	Cost      float64            `json:"cost"`
+	Actions   map[string]float64 `json:"actions"`
+}
+
+// CapabilityCosts breaks the cost of a capability down to topics
+type CapabilityCosts struct {
+	Capability string             `json:"capability"`
+	Cost       float64            `json:"cost"`
+	Actions    map[string]float64 `json:"actions"`
+	Topics     []ResourceCosts    `json:"topics"`
+}
+
+type CapabilitiesResponse struct {
+	From        string            `json:"from"`
+	To          string            `json:"to"`
+	Data        []CapabilityCosts `json:"data"`
+	Pagination  Pagination        `json:"pagination"`
+	MissingDays []string          `json:"missingDays"`
+}
+
+type CapabilityResponse struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	CapabilityCosts
+	MissingDays []string `json:"missingDays"`
+}
+
+type ClusterCosts struct {
+	ClusterId string             `json:"clusterId"`
+	Cost      float64            `json:"cost"`
+	Actions   map[string]float64 `json:"actions"`
+}
+
+type ClustersResponse struct {
+	From        string         `json:"from"`
+	To          string         `json:"to"`
+	Data        []ClusterCosts `json:"data"`
+	Pagination  Pagination     `json:"pagination"`
+	MissingDays []string       `json:"missingDays"`
+}
+
+// rowsInRange reads the rows of the requested days, matching the capability, cluster and action filters
+func (a *CostApi) rowsInRange(c *fiber.Ctx) (from util.YearMonthDayDate, to util.YearMonthDayDate, rows []model.ExportRow, missingDays []string, err error) {
+	from, to, err = parseDateRange(c)
+	if err != nil {
+		return from, to, nil, nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	allRows, missing, err := a.exporter.RowsForDays(from, to)
+	if err != nil {
+		return from, to, nil, nil, err
+	}
+
+	capabilities, clusters, actions := queryList(c, "capability"), queryList(c, "cluster"), queryList(c, "action")
+	for _, row := range allRows {
+		if matches(capabilities, row.Capability) && matches(clusters, row.ClusterId) && matches(actions, row.Action) {
+			rows = append(rows, row)
+		}
+	}
+
+	missingDays = make([]string, 0, len(missing))
+	for _, day := range missing {
+		missingDays = append(missingDays, day.String())
+	}
+	return from, to, rows, missingDays, nil
+}
+
+func sendError(c *fiber.Ctx, err error) error {
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return errorStatus(c, fiberErr.Code, fiberErr)
+	}
+	return errorStatus(c, fiber.StatusInternalServerError, err)
+}
+
+func (a *CostApi) getCosts(c *fiber.Ctx) error {
+	pagination, err := parsePagination(c)
+	if err != nil {
+		return errorStatus(c, fiber.StatusBadRequest, err)
+	}
+	from, to, rows, missingDays, err := a.rowsInRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	page := paginate(rows, &pagination)
+
+	if wantsCsv(c) {
+		format := a.exporter.ExportFormat()
+		records := make([][]string, 0, len(page))
+		for _, row := range page {
+			records = append(records, format.Record(row))
+		}
+		return sendCsv(c, pagination, format.Headers(), records)
+	}
+
+	data := make([]CostRow, 0, len(page))
+	for _, row := range page {
+		data = append(data, toCostRow(row))
+	}
+	return c.JSON(CostsResponse{
+		From:        from.String(),
+		To:          to.String(),
+		Data:        data,
+		Pagination:  pagination,
+		MissingDays: missingDays,
+	})
+}
+
+// byCapability adds the rows up per capability and topic, capabilities and topics are sorted by cost, highest first
+func byCapability(rows []model.ExportRow) []CapabilityCosts {
+	capabilities := make(map[string]*CapabilityCosts)
+	topics := make(map[string]map[[2]string]*ResourceCosts)
+	for _, row := range rows {
+		capabilityCosts, ok := capabilities[row.Capability]
+		if !ok {
+			capabilityCosts = &CapabilityCosts{Capability: row.Capability, Actions: make(map[string]float64)}
+			capabilities[row.Capability] = capabilityCosts
+			topics[row.Capability] = make(map[[2]string]*ResourceCosts)
+		}
+		capabilityCosts.Cost += row.Cost
+		capabilityCosts.Actions[row.Action] += row.Cost
+
+		key := [2]string{row.ClusterId, row.Name}
+		topicCosts, ok := topics[row.Capability][key]
+		if !ok {
+			topicCosts = &ResourceCosts{Name: row.Name, ClusterId: row.ClusterId, Actions: make(map[string]float64)}
+			topics[row.Capability][key] = topicCosts
+		}
+		topicCosts.Cost += row.Cost
+		topicCosts.Actions[row.Action] += row.Cost
+	}
+
+	result := make([]CapabilityCosts, 0, len(capabilities))
+	for capability, capabilityCosts := range capabilities {
+		for _, topicCosts := range topics[capability] {
+			capabilityCosts.Topics = append(capabilityCosts.Topics, *topicCosts)
+		}
+		sort.Slice(capabilityCosts.Topics, func(i, j int) bool {
+			return byCostThenName(capabilityCosts.Topics[i].Cost, capabilityCosts.Topics[j].Cost,
+				capabilityCosts.Topics[i].ClusterId+capabilityCosts.Topics[i].Name, capabilityCosts.Topics[j].ClusterId+capabilityCosts.Topics[j].Name)
+		})
+		result = append(result, *capabilityCosts)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return byCostThenName(result[i].Cost, result[j].Cost, result[i].Capability, result[j].Capability)
+	})
+	return result
+}
+
+func byCostThenName(costI float64, costJ float64, nameI string, nameJ string) bool {
+	if costI != costJ {
+		return costI > costJ
+	}
+	return nameI < nameJ
+}
+
+var capabilityCsvHeaders = []string{"Capability", "ClusterId", "Name", "Action", "Cost"}
+
+func capabilityCsvRecords(capabilities []CapabilityCosts) [][]string {
+	var records [][]string
+	for _, capabilityCosts := range capabilities {
+		for _, topicCosts := range capabilityCosts.Topics {
+			for _, action := range sortedKeys(topicCosts.Actions) {
+				records = append(records, []string{capabilityCosts.Capability, topicCosts.ClusterId, topicCosts.Name, action, formatCost(topicCosts.Actions[action])})
+			}
+		}
+	}
+	return records
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (a *CostApi) getCapabilities(c *fiber.Ctx) error {
+	pagination, err := parsePagination(c)
+	if err != nil {
+		return errorStatus(c, fiber.StatusBadRequest, err)
+	}
+	from, to, rows, missingDays, err := a.rowsInRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	page := paginate(byCapability(rows), &pagination)
+
+	if wantsCsv(c) {
+		return sendCsv(c, pagination, capabilityCsvHeaders, capabilityCsvRecords(page))
+	}
+	return c.JSON(CapabilitiesResponse{
+		From:        from.String(),
+		To:          to.String(),
+		Data:        page,
+		Pagination:  pagination,
+		MissingDays: missingDays,
+	})
+}
+
+func (a *CostApi) getCapability(c *fiber.Ctx) error {
+	capability := c.Params("capability")
+	from, to, rows, missingDays, err := a.rowsInRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	var capabilityRows []model.ExportRow
+	for _, row := range rows {
+		if row.Capability == capability {
+			capabilityRows = append(capabilityRows, row)
+		}
+	}
+	capabilities := byCapability(capabilityRows)
+	if len(capabilities) == 0 {
+		return errorStatus(c, fiber.StatusNotFound, fmt.Errorf("no costs found for capability %s from %s to %s", capability, from, to))
+	}
+
+	if wantsCsv(c) {
+		return sendCsv(c, Pagination{Page: 1, PageSize: 1, Total: 1}, capabilityCsvHeaders, capabilityCsvRecords(capabilities))
+	}
+	return c.JSON(CapabilityResponse{
+		From:            from.String(),
+		To:              to.String(),
+		CapabilityCosts: capabilities[0],
+		MissingDays:     missingDays,
+	})
+}
+
+// byCluster adds the rows up per cluster, shared costs without a cluster are reported under an empty cluster id
+func byCluster(rows []model.ExportRow) []ClusterCosts {
+	clusters := make(map[string]*ClusterCosts)
+	for _, row := range rows {
+		clusterCosts, ok := clusters[row.ClusterId]
+		if !ok {
+			clusterCosts = &ClusterCosts{ClusterId: row.ClusterId, Actions: make(map[string]float64)}
+			clusters[row.ClusterId] = clusterCosts
+		}
+		clusterCosts.Cost += row.Cost
+		clusterCosts.Actions[row.Action] += row.Cost
+	}
+
+	result := make([]ClusterCosts, 0, len(clusters))
+	for _, clusterCosts := range clusters {
+		result = append(result, *clusterCosts)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return byCostThenName(result[i].Cost, result[j].Cost, result[i].ClusterId, result[j].ClusterId)
+	})
+	return result
+}
+
+func (a *CostApi) getClusters(c *fiber.Ctx) error {
+	pagination, err := parsePagination(c)
+	if err != nil {
+		return errorStatus(c, fiber.StatusBadRequest, err)
+	}
+	from, to, rows, missingDays, err := a.rowsInRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	page := paginate(byCluster(rows), &pagination)
+
+	if wantsCsv(c) {
+		var records [][]string
+		for _, clusterCosts := range page {
+			for _, action := range sortedKeys(clusterCosts.Actions) {
+				records = append(records, []string{clusterCosts.ClusterId, action, formatCost(clusterCosts.Actions[action])})
+			}
+		}
+		return sendCsv(c, pagination, []string{"ClusterId", "Action", "Cost"}, records)
+	}
+	return c.JSON(ClustersResponse{
+		From:        from.String(),
+		To:          to.String(),
+		Data:        page,
+		Pagination:  pagination,
+		MissingDays: missingDays,
+	})
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/gofiber/fiber/v2"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/application"
+	"go.dfds.cloud/ccc-exporter/internal/auth"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/fake"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/service"
+	"go.dfds.cloud/ccc-exporter/internal/store"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+// newTestApp serves the cost and export routes of an exporter reading the stored exports from a fake S3 server,
+// working in a temporary directory. Nothing else is reachable, so days without a stored export are missing.
+func newTestApp(t *testing.T) (*fiber.App, *application.ExporterApplication, *fake.S3Server) {
+	t.Helper()
+
+	s3Server := fake.NewS3Server()
+	t.Cleanup(s3Server.Close)
+
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(workingDir)
+	})
+
+	conf := config.Config{
+		Prometheus:   config.Prometheus{PrometheusEndpoint: config.PrometheusEndpoint{Endpoint: "http://127.0.0.1:1"}},
+		S3:           config.S3{Endpoint: s3Server.URL, UsePathStyle: true, BucketName: "costs", BucketKey: "prod", Region: "eu-central-1"},
+		Capabilities: config.Capabilities{Default: "UNKNOWN"},
+	}
+	prometheusSources, err := service.NewPrometheusSources(conf.Prometheus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	confluentClient := client.NewConfluentCloudClient(conf.Confluent)
+	clusterRegistry := service.NewClusterRegistry(confluentClient, conf.Confluent)
+	principalDirectory, err := service.NewPrincipalDirectory(confluentClient, conf.Iam)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3Client, err := client.NewS3Client(aws.Config{Region: conf.S3.Region, Credentials: aws.AnonymousCredentials{}}, conf.S3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := application.NewExporterApplication(conf, prometheusSources, confluentClient, s3Client, clusterRegistry, principalDirectory, store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator, err := auth.NewAuthenticator(config.Auth{Mode: string(auth.ModeNone)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	NewCostApi(&exporter).Register(app.Group("/api/v1"), authenticator)
+	NewExportApi(&exporter).Register(app.Group("/api/v1"), authenticator)
+	return app, &exporter, s3Server
+}
+
+// storeExport puts the export of the rows in the fake S3 server, where the exporter reads stored exports from
+func storeExport(t *testing.T, s3Server *fake.S3Server, day util.YearMonthDayDate, rows ...model.ExportRow) {
+	t.Helper()
+	var data bytes.Buffer
+	writer := csv.NewWriter(&data)
+	format := model.ExportFormat{}
+	_ = writer.Write(format.Headers())
+	for _, row := range rows {
+		row.Date = day
+		_ = writer.Write(format.Record(row))
+	}
+	writer.Flush()
+	s3Server.PutObject("costs", "prod/"+day.ToFileNameFormat(), data.Bytes())
+}
+
+// request runs the request against the app and decodes a JSON response into v, unless v is nil
+func request(t *testing.T, app *fiber.App, method string, target string, body string, v any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+	if body != "" {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != nil && resp.StatusCode < 300 {
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatalf("invalid response %s: %s", data, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+var (
+	firstDay  = util.ToYearMonthDayDate(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))
+	secondDay = util.ToYearMonthDayDate(time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC))
+)
+
+func storeTwoDays(t *testing.T, s3Server *fake.S3Server) {
+	t.Helper()
+	storeExport(t, s3Server, firstDay,
+		model.ExportRow{Cost: 3, Name: "pub.dataplatform-ajamn.events", ClusterId: "lkc-1", Action: "KAFKA_NETWORK_READ", Capability: "dataplatform-ajamn"},
+		model.ExportRow{Cost: 1, Name: "cloudengineering-xyzab.stuff", ClusterId: "lkc-2", Action: "KAFKA_NETWORK_WRITE", Capability: "cloudengineering-xyzab"},
+	)
+	storeExport(t, s3Server, secondDay,
+		model.ExportRow{Cost: 2, Name: "pub.dataplatform-ajamn.events", ClusterId: "lkc-1", Action: "KAFKA_NETWORK_WRITE", Capability: "dataplatform-ajamn"},
+	)
+}
+
+func TestGetCosts(t *testing.T) {
+	app, _, s3Server := newTestApp(t)
+	storeTwoDays(t, s3Server)
+
+	tests := []struct {
+		name      string
+		query     string
+		wantCosts []float64
+		wantTotal int
+	}{
+		{name: "both days", query: "from=2024-03-01&to=2024-03-02", wantCosts: []float64{3, 1, 2}, wantTotal: 3},
+		{name: "one day", query: "to=2024-03-02", wantCosts: []float64{2}, wantTotal: 1},
+		{name: "by capability", query: "from=2024-03-01&to=2024-03-02&capability=dataplatform-ajamn", wantCosts: []float64{3, 2}, wantTotal: 2},
+		{name: "by cluster", query: "from=2024-03-01&to=2024-03-02&cluster=lkc-2", wantCosts: []float64{1}, wantTotal: 1},
+		{name: "by actions", query: "from=2024-03-01&to=2024-03-02&action=KAFKA_NETWORK_WRITE,KAFKA_NETWORK_READ&capability=dataplatform-ajamn", wantCosts: []float64{3, 2}, wantTotal: 2},
+		{name: "second page", query: "from=2024-03-01&to=2024-03-02&page=2&pageSize=2", wantCosts: []float64{2}, wantTotal: 3},
+		{name: "no match", query: "from=2024-03-01&to=2024-03-02&cluster=lkc-3", wantCosts: []float64{}, wantTotal: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var response CostsResponse
+			if status := request(t, app, http.MethodGet, "/api/v1/costs?"+test.query, "", &response); status != http.StatusOK {
+				t.Fatalf("got status %d, want 200", status)
+			}
+			costs := make([]float64, 0, len(response.Data))
+			for _, row := range response.Data {
+				costs = append(costs, row.Cost)
+			}
+			if len(costs) != len(test.wantCosts) {
+				t.Fatalf("got costs %v, want %v", costs, test.wantCosts)
+			}
+			for i := range costs {
+				if costs[i] != test.wantCosts[i] {
+					t.Fatalf("got costs %v, want %v", costs, test.wantCosts)
+				}
+			}
+			if response.Pagination.Total != test.wantTotal {
+				t.Errorf("got total %d, want %d", response.Pagination.Total, test.wantTotal)
+			}
+			if len(response.MissingDays) != 0 {
+				t.Errorf("got missing days %v, want none", response.MissingDays)
+			}
+		})
+	}
+}
+
+func TestGetCostsReportsMissingDays(t *testing.T) {
+	app, _, s3Server := newTestApp(t)
+	storeTwoDays(t, s3Server)
+
+	var response CostsResponse
+	if status := request(t, app, http.MethodGet, "/api/v1/costs?from=2024-02-29&to=2024-03-03", "", &response); status != http.StatusOK {
+		t.Fatalf("got status %d, want 200", status)
+	}
+	if len(response.Data) != 3 {
+		t.Errorf("got %d rows, want the 3 rows of the stored days", len(response.Data))
+	}
+	if len(response.MissingDays) != 2 || response.MissingDays[0] != "2024-02-29" || response.MissingDays[1] != "2024-03-03" {
+		t.Errorf("got missing days %v, want 2024-02-29 and 2024-03-03", response.MissingDays)
+	}
+}
+
+func TestGetCostsRejectsInvalidQueries(t *testing.T) {
+	app, _, _ := newTestApp(t)
+
+	for _, query := range []string{
+		"from=2024-03-02&to=2024-03-01",
+		"from=2024-01-01&to=2024-03-01",
+		"from=yesterday",
+		"page=0",
+		"pageSize=1001",
+	} {
+		t.Run(query, func(t *testing.T) {
+			if status := request(t, app, http.MethodGet, "/api/v1/costs?"+query, "", nil); status != http.StatusBadRequest {
+				t.Errorf("got status %d, want 400", status)
+			}
+		})
+	}
+}
+
+func TestGetCapabilities(t *testing.T) {
+	app, _, s3Server := newTestApp(t)
+	storeTwoDays(t, s3Server)
+
+	var response CapabilitiesResponse
+	if status := request(t, app, http.MethodGet, "/api/v1/capabilities?from=2024-03-01&to=2024-03-02", "", &response); status != http.StatusOK {
+		t.Fatalf("got status %d, want 200", status)
+	}
+	if len(response.Data) != 2 || response.Data[0].Capability != "dataplatform-ajamn" || response.Data[0].Cost != 5 || response.Data[1].Cost != 1 {
+		t.Fatalf("got %+v, want dataplatform-ajamn costing 5 before cloudengineering-xyzab costing 1", response.Data)
+	}
+	if actions := response.Data[0].Actions; actions["KAFKA_NETWORK_READ"] != 3 || actions["KAFKA_NETWORK_WRITE"] != 2 {
+		t.Errorf("got actions %v, want the costs of both days by action", actions)
+	}
+}
+
+func TestGetCapability(t *testing.T) {
+	app, _, s3Server := newTestApp(t)
+	storeTwoDays(t, s3Server)
+
+	var response CapabilityResponse
+	if status := request(t, app, http.MethodGet, "/api/v1/capabilities/dataplatform-ajamn?from=2024-03-01&to=2024-03-02", "", &response); status != http.StatusOK {
+		t.Fatalf("got status %d, want 200", status)
+	}
+	if response.Cost != 5 || len(response.Topics) != 1 || response.Topics[0].Name != "pub.dataplatform-ajamn.events" {
+		t.Errorf("got %+v, want the single topic of the capability costing 5", response.CapabilityCosts)
+	}
+
+	if status := request(t, app, http.MethodGet, "/api/v1/capabilities/unknown-abcde?from=2024-03-01&to=2024-03-02", "", nil); status != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown capability, want 404", status)
+	}
+	if status := request(t, app, http.MethodGet, "/api/v1/capabilities/dataplatform-ajamn?to=2024-02-29", "", nil); status != http.StatusNotFound {
+		t.Errorf("got status %d for a day without costs, want 404", status)
+	}
+}
+
+func TestGetClusters(t *testing.T) {
+	app, _, s3Server := newTestApp(t)
+	storeTwoDays(t, s3Server)
+
+	var response ClustersResponse
+	if status := request(t, app, http.MethodGet, "/api/v1/clusters?from=2024-03-01&to=2024-03-02&action=KAFKA_NETWORK_WRITE", "", &response); status != http.StatusOK {
+		t.Fatalf("got status %d, want 200", status)
+	}
+	if len(response.Data) != 2 || response.Data[0].ClusterId != "lkc-1" || response.Data[0].Cost != 2 || response.Data[1].Cost != 1 {
+		t.Errorf("got %+v, want the write costs of lkc-1 before lkc-2", response.Data)
+	}
+}
+
+func TestGetCostsAsCsv(t *testing.T) {
+	app, _, s3Server := newTestApp(t)
+	storeTwoDays(t, s3Server)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/costs?from=2024-03-01&to=2024-03-02&pageSize=2", nil)
+	req.Header.Set(fiber.HeaderAccept, mimeTextCsv)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0][0] != "Date" {
+		t.Errorf("got records %v, want the headers and the 2 rows of the page", records)
+	}
+	if total := resp.Header.Get("X-Total-Count"); total != "3" {
+		t.Errorf("got total count %s, want 3", total)
+	}
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"go.dfds.cloud/ccc-exporter/internal/application"
+	"go.dfds.cloud/ccc-exporter/internal/auth"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+// maxExportDays bounds the number of days a single backfill queues
+const maxExportDays = 366
+
+// ExportApi queues exports for the worker and shows their progress
+type ExportApi struct {
+	exporter *application.ExporterApplication
+}
+
+func NewExportApi(exporter *application.ExporterApplication) *ExportApi {
+	return &ExportApi{exporter: exporter}
+}
+
+func (a *ExportApi) Register(router fiber.Router, authenticator *auth.Authenticator) {
+	read := authenticator.Require(auth.ScopeExportsRead)
+	router.Post("/exports", authenticator.Require(auth.ScopeExportsWrite), a.postExports)
+	router.Get("/exports", read, a.getExports)
+	router.Get("/exports/:date", read, a.getExport)
+}
+
+type ExportRequest struct {
+	From string `json:"from"`
+	// To defaults to From
+	To string `json:"to"`
+	// Force exports days again that were exported already, replacing the stored exports
+	Force bool `json:"force"`
+}
+
+type ExportRequestResponse struct {
+	Data []application.EnqueueResult `json:"data"`
+}
+
+type ExportsResponse struct {
+	Data       []application.ExportProcessView `json:"data"`
+	Pagination Pagination                      `json:"pagination"`
+}
+
+func (r ExportRequest) dateRange() (util.YearMonthDayDate, util.YearMonthDayDate, error) {
+	if r.From == "" {
+		return util.YearMonthDayDate{}, util.YearMonthDayDate{}, errors.New("from is required")
+	}
+	from, err := util.ParseYearMonthDayDate(r.From)
+	if err != nil {
+		return from, from, err
+	}
+	to := from
+	if r.To != "" {
+		if to, err = util.ParseYearMonthDayDate(r.To); err != nil {
+			return from, to, err
+		}
+	}
+
+	if from.ToTimeUTC().After(to.ToTimeUTC()) {
+		return from, to, errors.New("from is after to")
+	}
+	if !to.ToTimeUTC().Before(time.Now().UTC().Truncate(24 * time.Hour)) {
+		return from, to, errors.New("only days before today can be exported")
+	}
+	if days := int(to.ToTimeUTC().Sub(from.ToTimeUTC()).Hours()/24) + 1; days > maxExportDays {
+		return from, to, fmt.Errorf("%d days requested, at most %d days can be exported at once", days, maxExportDays)
+	}
+	return from, to, nil
+}
+
+func (a *ExportApi) postExports(c *fiber.Ctx) error {
+	var request ExportRequest
+	if err := c.BodyParser(&request); err != nil {
+		return errorStatus(c, fiber.StatusBadRequest, fmt.Errorf("invalid export request: %w", err))
+	}
+	from, to, err := request.dateRange()
+	if err != nil {
+		return errorStatus(c, fiber.StatusBadRequest, err)
+	}
+
+	if principal, ok := auth.PrincipalOf(c); ok {
+		log.Infof("%s requested exports from %s to %s, force: %t", principal.Name, from, to, request.Force)
+	}
+	results := a.exporter.EnqueueExports(from, to, request.Force)
+	return c.Status(fiber.StatusAccepted).JSON(ExportRequestResponse{Data: results})
+}
+
+func (a *ExportApi) getExports(c *fiber.Ctx) error {
+	pagination, err := parsePagination(c)
+	if err != nil {
+		return errorStatus(c, fiber.StatusBadRequest, err)
+	}
+	page := paginate(a.exporter.ExportProcesses(), &pagination)
+	return c.JSON(ExportsResponse{Data: page, Pagination: pagination})
+}
+
+func (a *ExportApi) getExport(c *fiber.Ctx) error {
+	date, err := util.ParseYearMonthDayDate(c.Params("date"))
+	if err != nil {
+		return errorStatus(c, fiber.StatusBadRequest, err)
+	}
+	process, ok := a.exporter.ExportProcessForDay(date)
+	if !ok {
+		return errorStatus(c, fiber.StatusNotFound, fmt.Errorf("no export of %s was queued since the exporter started", date))
+	}
+	return c.JSON(process)
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.dfds.cloud/ccc-exporter/internal/application"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+func TestPostExports(t *testing.T) {
+	app, _, s3Server := newTestApp(t)
+	yesterday := util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -1))
+	before := util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -2))
+	storeExport(t, s3Server, before, model.ExportRow{Cost: 1, Name: "x", ClusterId: "lkc-1", Action: "KAFKA_NETWORK_READ", Capability: "UNKNOWN"})
+
+	body := fmt.Sprintf(`{"from": %q, "to": %q}`, before, yesterday)
+	var response ExportRequestResponse
+	if status := request(t, app, http.MethodPost, "/api/v1/exports", body, &response); status != http.StatusAccepted {
+		t.Fatalf("got status %d, want 202", status)
+	}
+	want := []application.EnqueueResult{
+		{Date: before, Status: application.EnqueueStatusAlreadyExported},
+		{Date: yesterday, Status: application.EnqueueStatusQueued},
+	}
+	if fmt.Sprint(response.Data) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", response.Data, want)
+	}
+
+	if status := request(t, app, http.MethodPost, "/api/v1/exports", body, &response); status != http.StatusAccepted {
+		t.Fatalf("got status %d, want 202", status)
+	}
+	if response.Data[1].Status != application.EnqueueStatusAlreadyQueued {
+		t.Errorf("got %v for a day queued twice, want it already queued", response.Data[1])
+	}
+
+	forced := fmt.Sprintf(`{"from": %q, "force": true}`, before)
+	if status := request(t, app, http.MethodPost, "/api/v1/exports", forced, &response); status != http.StatusAccepted {
+		t.Fatalf("got status %d, want 202", status)
+	}
+	if len(response.Data) != 1 || response.Data[0].Status != application.EnqueueStatusQueued {
+		t.Errorf("got %v, want the exported day queued again when forced", response.Data)
+	}
+}
+
+func TestPostExportsRejectsInvalidRequests(t *testing.T) {
+	app, _, _ := newTestApp(t)
+	today := util.ToYearMonthDayDate(time.Now().UTC())
+
+	for name, body := range map[string]string{
+		"not json":     `{`,
+		"no from":      `{"to": "2024-03-01"}`,
+		"invalid from": `{"from": "March"}`,
+		"from after":   `{"from": "2024-03-02", "to": "2024-03-01"}`,
+		"today":        fmt.Sprintf(`{"from": %q}`, today),
+		"too many":     `{"from": "2022-01-01", "to": "2024-01-01"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if status := request(t, app, http.MethodPost, "/api/v1/exports", body, nil); status != http.StatusBadRequest {
+				t.Errorf("got status %d, want 400", status)
+			}
+		})
+	}
+}
+
+func TestGetExports(t *testing.T) {
+	app, exporter, _ := newTestApp(t)
+	first := util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -3))
+	last := util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -1))
+	exporter.EnqueueExports(first, last, false)
+
+	var response ExportsResponse
+	if status := request(t, app, http.MethodGet, "/api/v1/exports?pageSize=2", "", &response); status != http.StatusOK {
+		t.Fatalf("got status %d, want 200", status)
+	}
+	if len(response.Data) != 2 || response.Data[0].Date != first || response.Pagination.Total != 3 {
+		t.Errorf("got %+v, want the first 2 of 3 processes ordered by date", response)
+	}
+
+	var process application.ExportProcessView
+	if status := request(t, app, http.MethodGet, "/api/v1/exports/"+last.String(), "", &process); status != http.StatusOK {
+		t.Fatalf("got status %d, want 200", status)
+	}
+	if process.Date != last || process.State != application.ExportStateNeedCosts {
+		t.Errorf("got %+v, want the queued process of %s", process, last)
+	}
+
+	unknown := util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -10))
+	if status := request(t, app, http.MethodGet, "/api/v1/exports/"+unknown.String(), "", nil); status != http.StatusNotFound {
+		t.Errorf("got status %d for a day never queued, want 404", status)
+	}
+	if status := request(t, app, http.MethodGet, "/api/v1/exports/yesterday", "", nil); status != http.StatusBadRequest {
+		t.Errorf("got status %d for an invalid date, want 400", status)
+	}
+}
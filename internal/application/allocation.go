@@ -0,0 +1,269 @@
+package application
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2/log"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+	"sort"
+)
+
+const SharedCostPlaceholder = "_SHARED"
+
+type AllocationStrategy string
+
+const (
+	// AllocationStrategyProportional splits by each capability's share of the allocated usage cost
+	AllocationStrategyProportional AllocationStrategy = "proportional"
+	// AllocationStrategyEven splits evenly across the capabilities with usage
+	AllocationStrategyEven AllocationStrategy = "even"
+	// AllocationStrategyWeighted splits by the fixed weights from config
+	AllocationStrategyWeighted AllocationStrategy = "weighted"
+	// AllocationStrategyLoad splits cluster costs by each topic's share of the request and response bytes of the cluster
+	AllocationStrategyLoad AllocationStrategy = "load"
+)
+
+type sharedCostPolicy struct {
+	strategy AllocationStrategy
+	weights  map[string]float64
+}
+
+func newSharedCostPolicies(allocationConfig config.Allocation) (map[model.CostType]sharedCostPolicy, error) {
+	policies := make(map[model.CostType]sharedCostPolicy)
+	for _, policyConfig := range allocationConfig.SharedCosts {
+		costType, err := model.TryParseCostType(policyConfig.CostType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shared cost policy: %w", err)
+		}
+		policy := sharedCostPolicy{
+			strategy: AllocationStrategy(policyConfig.Strategy),
+			weights:  make(map[string]float64),
+		}
+		switch policy.strategy {
+		case AllocationStrategyProportional, AllocationStrategyEven:
+		case AllocationStrategyLoad:
+			if costType != model.CostTypeKafkaBase && costType != model.CostTypeKafkaNumCkus {
+				return nil, fmt.Errorf("load allocation strategy only applies to %s and %s, not %s", model.CostTypeKafkaBase, model.CostTypeKafkaNumCkus, costType)
+			}
+		case AllocationStrategyWeighted:
+			for _, weight := range policyConfig.Weights {
+				if weight.Weight < 0 {
+					return nil, fmt.Errorf("negative weight for capability %s in shared cost policy for %s", weight.Capability, costType)
+				}
+				policy.weights[weight.Capability] = weight.Weight
+			}
+			if len(policy.weights) == 0 {
+				return nil, fmt.Errorf("weighted shared cost policy for %s has no weights", costType)
+			}
+		default:
+			return nil, fmt.Errorf("invalid allocation strategy %s for %s", policyConfig.Strategy, costType)
+		}
+		policies[costType] = policy
+	}
+	return policies, nil
+}
+
+// checkClusterKinds rejects static clusters without a kind when costs are allocated by load, their costs would
+// otherwise quietly be allocated proportionally as if the clusters were not dedicated
+func checkClusterKinds(confluentConfig config.Confluent, policies map[model.CostType]sharedCostPolicy) error {
+	for costType, policy := range policies {
+		if policy.strategy != AllocationStrategyLoad {
+			continue
+		}
+		for _, cluster := range confluentConfig.Clusters {
+			if cluster.Kind == "" {
+				return fmt.Errorf("cluster %s has no kind, it is needed to allocate %s by load, e.g. %s", cluster.Id, costType, model.ClusterKindDedicated)
+			}
+		}
+	}
+	return nil
+}
+
+// split divides total between capabilities, usage holds the usage cost already allocated to each capability in scope
+func (p sharedCostPolicy) split(total float64, usage map[string]float64) map[string]float64 {
+	shares := make(map[string]float64)
+
+	switch p.strategy {
+	case AllocationStrategyWeighted:
+		var totalWeight float64
+		for _, weight := range p.weights {
+			totalWeight += weight
+		}
+		if totalWeight > 0 {
+			for capability, weight := range p.weights {
+				shares[capability] = total * weight / totalWeight
+			}
+			return shares
+		}
+	case AllocationStrategyProportional:
+		var totalUsage float64
+		for _, cost := range usage {
+			totalUsage += cost
+		}
+		if totalUsage > 0 {
+			for capability, cost := range usage {
+				shares[capability] = total * cost / totalUsage
+			}
+			return shares
+		}
+	}
+
+	// even split, also used when there is nothing to be proportional to
+	if len(usage) == 0 {
+		shares[UnknownPlaceholder] = total
+		return shares
+	}
+	for capability := range usage {
+		shares[capability] = total / float64(len(usage))
+	}
+	return shares
+}
+
+// AllocateSharedCosts spreads support costs across all capabilities and cluster wide Kafka costs across the capabilities using each cluster.
+// It must be called once every usage row has been added.
+func (e *ExporterApplication) AllocateSharedCosts(rows []model.ExportRow, data model.MetricsDataForDay) []model.ExportRow {
+	date := data.DayDate
+	usageTotal := make(map[string]float64)
+	usagePerCluster := make(map[string]map[string]float64)
+	for _, row := range rows {
+		usageTotal[row.Capability] += row.Cost
+		if !isKafkaUsageCostType(row.CostType) {
+			continue
+		}
+		if _, ok := usagePerCluster[row.ClusterId]; !ok {
+			usagePerCluster[row.ClusterId] = make(map[string]float64)
+		}
+		usagePerCluster[row.ClusterId][row.Capability] += row.Cost
+	}
+
+	var sharedRows []model.ExportRow
+	for _, clusterId := range e.clusterRegistry.ClusterIds() {
+		for _, costType := range []model.CostType{model.CostTypeKafkaBase, model.CostTypeKafkaNumCkus} {
+			policy, ok := e.sharedCostPolicies[costType]
+			if !ok {
+				continue
+			}
+			cost, err := e.costService.GetKafkaCosts(date, clusterId, costType)
+			if err != nil || cost.TotalCost == 0 {
+				continue
+			}
+			if policy.strategy == AllocationStrategyLoad {
+				if loadRows := e.loadRows(data, clusterId, costType, cost.TotalCost); len(loadRows) > 0 {
+					sharedRows = append(sharedRows, loadRows...)
+					continue
+				}
+				policy = sharedCostPolicy{strategy: AllocationStrategyProportional}
+			}
+			shares := policy.split(cost.TotalCost, usagePerCluster[string(clusterId)])
+			sharedRows = appendSharedRows(sharedRows, date, string(clusterId), costType, shares)
+		}
+	}
+
+	supportCosts, err := e.costService.GetSupportCosts(date)
+	if err != nil {
+		log.Warnf("No support costs found for %s: %s", date, err)
+	}
+	for _, cost := range supportCosts {
+		policy, ok := e.sharedCostPolicies[cost.CostType]
+		if !ok || cost.TotalCost == 0 {
+			continue
+		}
+		sharedRows = appendSharedRows(sharedRows, date, "", cost.CostType, policy.split(cost.TotalCost, usageTotal))
+	}
+
+	return append(rows, sharedRows...)
+}
+
+// allocatesByLoad reports whether any shared cost is allocated by load, the export then needs the cost type column
+// as KAFKA_BASE and KAFKA_NUM_CKUS rows share the request-bytes and response-bytes actions
+func (e *ExporterApplication) allocatesByLoad() bool {
+	for _, policy := range e.sharedCostPolicies {
+		if policy.strategy == AllocationStrategyLoad {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRows bills each topic the share of total matching its share of the request and response bytes of the cluster,
+// with a request-bytes and a response-bytes row. No rows are returned for clusters that are not dedicated,
+// their capacity is not billed so their load says nothing about their cost.
+func (e *ExporterApplication) loadRows(data model.MetricsDataForDay, clusterId model.ClusterId, costType model.CostType, total float64) []model.ExportRow {
+	if cluster, _ := e.clusterRegistry.Get(clusterId); !cluster.IsDedicated() {
+		log.Warnf("Cluster %s is not dedicated, allocating %s proportionally to usage", clusterId, costType)
+		return nil
+	}
+
+	var totalLoad float64
+	for _, metricKey := range model.ConfluentLoadMetrics {
+		for _, m := range data.Topics[metricKey][clusterId] {
+			totalLoad += m.Value
+		}
+	}
+	if totalLoad <= 0 {
+		log.Warnf("No request or response bytes found for cluster %s, allocating %s proportionally to usage", clusterId, costType)
+		return nil
+	}
+
+	var rows []model.ExportRow
+	for _, metricKey := range model.ConfluentLoadMetrics {
+		metricData := data.Topics[metricKey][clusterId]
+		topics := make([]model.TopicName, 0, len(metricData))
+		for topic, m := range metricData {
+			if m.Value > 0 {
+				topics = append(topics, topic)
+			}
+		}
+		sort.Slice(topics, func(i, j int) bool {
+			return topics[i] < topics[j]
+		})
+
+		for _, topic := range topics {
+			capability := e.capabilityResolver.Resolve(string(topic)).Capability
+			row := model.ExportRow{
+				Date:       data.DayDate,
+				Cost:       total * metricData[topic].Value / totalLoad,
+				Name:       string(topic),
+				ClusterId:  string(clusterId),
+				Action:     metricKey.ToCsvFormatString(),
+				Capability: capability,
+				CostType:   costType,
+			}
+			if e.attributionMode == AttributionModePrincipal {
+				row.ProducerCapability = capability
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+func appendSharedRows(rows []model.ExportRow, date util.YearMonthDayDate, clusterId string, costType model.CostType, shares map[string]float64) []model.ExportRow {
+	capabilities := make([]string, 0, len(shares))
+	for capability := range shares {
+		capabilities = append(capabilities, capability)
+	}
+	sort.Strings(capabilities)
+
+	for _, capability := range capabilities {
+		rows = append(rows, model.ExportRow{
+			Date:       date,
+			Cost:       shares[capability],
+			Name:       SharedCostPlaceholder,
+			ClusterId:  clusterId,
+			Action:     costType.ToCsvFormatString(),
+			Capability: capability,
+			CostType:   costType,
+		})
+	}
+	return rows
+}
+
+func isKafkaUsageCostType(costType model.CostType) bool {
+	switch costType {
+	case model.CostTypeKafkaNetworkRead, model.CostTypeKafkaNetworkWrite, model.CostTypeKafkaStorage:
+		return true
+	}
+	return false
+}
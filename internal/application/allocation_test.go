@@ -0,0 +1,315 @@
+package application
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/capability"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/service"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+var testDay = util.ToYearMonthDayDate(time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC))
+
+// bill is a billed line of testDay, clusterId is left out for support costs
+func bill(clusterId string, costType model.CostType, unit string, total float64) model.ConfluentCostLine {
+	line := model.ConfluentCostLine{LineType: string(costType), Product: "KAFKA", Unit: unit, Amount: total, StartDate: "2024-03-01"}
+	if costType == model.CostTypeSupport {
+		line.Product = "SUPPORT_CLOUD_BUSINESS"
+	}
+	line.Resource.Id = clusterId
+	return line
+}
+
+// newAllocationTestExporter builds an exporter holding the billed lines of testDay for static clusters, without any upstream
+func newAllocationTestExporter(t *testing.T, clusters []config.Cluster, lines ...model.ConfluentCostLine) *ExporterApplication {
+	t.Helper()
+	confluentConfig := config.Confluent{Clusters: clusters}
+	clusterRegistry := service.NewClusterRegistry(nil, confluentConfig)
+	if err := clusterRegistry.Refresh(nil); err != nil {
+		t.Fatal(err)
+	}
+	costService := service.NewConfluentCostService(nil, clusterRegistry, false)
+	costService.CacheCosts(testDay, model.ConfluentCostResponse{Data: lines})
+
+	capabilityResolver, err := capability.NewResolver(config.Capabilities{
+		Rules:   []config.CapabilityRule{{Name: "capability-root-id", Pattern: `(pub.)?(?P<capability>.*-.{5})\.`}},
+		Default: UnknownPlaceholder,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	principalDirectory, err := service.NewPrincipalDirectory(nil, config.Iam{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ExporterApplication{
+		costService:           costService,
+		clusterRegistry:       clusterRegistry,
+		principalDirectory:    principalDirectory,
+		capabilityResolver:    capabilityResolver,
+		principalCapabilities: newStaticPrincipalResolver(config.Attribution{}),
+		sharedCostPolicies:    make(map[model.CostType]sharedCostPolicy),
+	}
+}
+
+var dedicatedCluster = []config.Cluster{{Id: "lkc-1", Kind: model.ClusterKindDedicated}}
+
+// sumCosts adds up the cost of the rows of costType, all rows are added up when costType is empty
+func sumCosts(rows []model.ExportRow, costType model.CostType) float64 {
+	var total float64
+	for _, row := range rows {
+		if costType == "" || row.CostType == costType {
+			total += row.Cost
+		}
+	}
+	return total
+}
+
+func assertCost(t *testing.T, what string, got float64, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("got %s %f, want %f", what, got, want)
+	}
+}
+
+func TestSharedCostPolicySplit(t *testing.T) {
+	usage := map[string]float64{"a": 1, "b": 3}
+	tests := []struct {
+		name   string
+		policy sharedCostPolicy
+		usage  map[string]float64
+		want   map[string]float64
+	}{
+		{
+			name:   "proportional",
+			policy: sharedCostPolicy{strategy: AllocationStrategyProportional},
+			usage:  usage,
+			want:   map[string]float64{"a": 25, "b": 75},
+		},
+		{
+			name:   "even",
+			policy: sharedCostPolicy{strategy: AllocationStrategyEven},
+			usage:  usage,
+			want:   map[string]float64{"a": 50, "b": 50},
+		},
+		{
+			name:   "weighted ignores usage",
+			policy: sharedCostPolicy{strategy: AllocationStrategyWeighted, weights: map[string]float64{"a": 1, "c": 4}},
+			usage:  usage,
+			want:   map[string]float64{"a": 20, "c": 80},
+		},
+		{
+			name:   "proportional without usage cost splits evenly",
+			policy: sharedCostPolicy{strategy: AllocationStrategyProportional},
+			usage:  map[string]float64{"a": 0, "b": 0},
+			want:   map[string]float64{"a": 50, "b": 50},
+		},
+		{
+			name:   "weighted with zero weights splits evenly",
+			policy: sharedCostPolicy{strategy: AllocationStrategyWeighted, weights: map[string]float64{"c": 0}},
+			usage:  usage,
+			want:   map[string]float64{"a": 50, "b": 50},
+		},
+		{
+			name:   "no capabilities leaves the cost with unknown",
+			policy: sharedCostPolicy{strategy: AllocationStrategyProportional},
+			usage:  map[string]float64{},
+			want:   map[string]float64{UnknownPlaceholder: 100},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shares := test.policy.split(100, test.usage)
+			if len(shares) != len(test.want) {
+				t.Fatalf("got shares %v, want %v", shares, test.want)
+			}
+			var total float64
+			for capability, want := range test.want {
+				assertCost(t, "share of "+capability, shares[capability], want)
+				total += shares[capability]
+			}
+			assertCost(t, "total", total, 100)
+		})
+	}
+}
+
+func TestSharedCostPolicySplitSumsToTotal(t *testing.T) {
+	usage := map[string]float64{"a": 1, "b": 1, "c": 1, "d": 7.3}
+	weights := map[string]float64{"a": 1, "b": 2, "c": 3.7}
+	for _, strategy := range []AllocationStrategy{AllocationStrategyProportional, AllocationStrategyEven, AllocationStrategyWeighted} {
+		policy := sharedCostPolicy{strategy: strategy, weights: weights}
+		for _, total := range []float64{0.01, 1, 1234.56789} {
+			var sum float64
+			for _, share := range policy.split(total, usage) {
+				sum += share
+			}
+			if math.Abs(sum-total) > 1e-9*total {
+				t.Errorf("%s split of %f sums to %f", strategy, total, sum)
+			}
+		}
+	}
+}
+
+func TestNewSharedCostPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  config.SharedCostPolicy
+		wantErr string
+	}{
+		{name: "proportional", policy: config.SharedCostPolicy{CostType: "SUPPORT", Strategy: "proportional"}},
+		{name: "load", policy: config.SharedCostPolicy{CostType: "KAFKA_NUM_CKUS", Strategy: "load"}},
+		{name: "load of support", policy: config.SharedCostPolicy{CostType: "SUPPORT", Strategy: "load"}, wantErr: "only applies to"},
+		{name: "unknown cost type", policy: config.SharedCostPolicy{CostType: "BEER", Strategy: "even"}, wantErr: "invalid cost type"},
+		{name: "unknown strategy", policy: config.SharedCostPolicy{CostType: "SUPPORT", Strategy: "random"}, wantErr: "invalid allocation strategy"},
+		{name: "no weights", policy: config.SharedCostPolicy{CostType: "SUPPORT", Strategy: "weighted"}, wantErr: "has no weights"},
+		{
+			name:    "negative weight",
+			policy:  config.SharedCostPolicy{CostType: "SUPPORT", Strategy: "weighted", Weights: []config.CapabilityWeight{{Capability: "a", Weight: -1}}},
+			wantErr: "negative weight",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newSharedCostPolicies(config.Allocation{SharedCosts: []config.SharedCostPolicy{test.policy}})
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("got error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckClusterKinds(t *testing.T) {
+	load := map[model.CostType]sharedCostPolicy{model.CostTypeKafkaNumCkus: {strategy: AllocationStrategyLoad}}
+	proportional := map[model.CostType]sharedCostPolicy{model.CostTypeKafkaNumCkus: {strategy: AllocationStrategyProportional}}
+	withoutKind := config.Confluent{Clusters: []config.Cluster{{Id: "lkc-1", Kind: model.ClusterKindDedicated}, {Id: "lkc-2"}}}
+
+	if err := checkClusterKinds(withoutKind, load); err == nil || !strings.Contains(err.Error(), "lkc-2") {
+		t.Errorf("got error %v, want lkc-2 to be rejected", err)
+	}
+	if err := checkClusterKinds(withoutKind, proportional); err != nil {
+		t.Errorf("got error %v, the kind is only needed for load allocation", err)
+	}
+	if err := checkClusterKinds(config.Confluent{}, load); err != nil {
+		t.Errorf("got error %v, discovered clusters have their kind", err)
+	}
+}
+
+func TestAllocateSharedCosts(t *testing.T) {
+	exporter := newAllocationTestExporter(t, dedicatedCluster,
+		bill("lkc-1", model.CostTypeKafkaBase, model.Hour, 48),
+		bill("", model.CostTypeSupport, "", 10),
+	)
+	exporter.sharedCostPolicies[model.CostTypeKafkaBase] = sharedCostPolicy{strategy: AllocationStrategyProportional}
+	exporter.sharedCostPolicies[model.CostTypeSupport] = sharedCostPolicy{strategy: AllocationStrategyEven}
+
+	usageRows := []model.ExportRow{
+		{ClusterId: "lkc-1", Capability: "a", Cost: 1, CostType: model.CostTypeKafkaNetworkRead},
+		{ClusterId: "lkc-1", Capability: "b", Cost: 3, CostType: model.CostTypeKafkaStorage},
+		// connect costs count for support, not for the cluster
+		{ClusterId: "lcc-1", Capability: "c", Cost: 100, CostType: model.CostTypeConnectThroughPut},
+	}
+	rows := exporter.AllocateSharedCosts(usageRows, model.MetricsDataForDay{DayDate: testDay})
+
+	shared := make(map[model.CostType]map[string]float64)
+	for _, row := range rows[len(usageRows):] {
+		if row.Name != SharedCostPlaceholder {
+			t.Errorf("got shared row named %s", row.Name)
+		}
+		if shared[row.CostType] == nil {
+			shared[row.CostType] = make(map[string]float64)
+		}
+		shared[row.CostType][row.Capability] += row.Cost
+	}
+	assertCost(t, "base of a", shared[model.CostTypeKafkaBase]["a"], 12)
+	assertCost(t, "base of b", shared[model.CostTypeKafkaBase]["b"], 36)
+	if _, ok := shared[model.CostTypeKafkaBase]["c"]; ok {
+		t.Error("capability without usage of the cluster got base costs")
+	}
+	assertCost(t, "support", sumCosts(rows, model.CostTypeSupport), 10)
+	if len(shared[model.CostTypeSupport]) != 3 {
+		t.Errorf("got support for %v, want it spread evenly across a, b and c", shared[model.CostTypeSupport])
+	}
+}
+
+func TestAllocateSharedCostsLeavesCostTypesWithoutPolicyOut(t *testing.T) {
+	exporter := newAllocationTestExporter(t, dedicatedCluster, bill("lkc-1", model.CostTypeKafkaBase, model.Hour, 48))
+	usageRows := []model.ExportRow{{ClusterId: "lkc-1", Capability: "a", Cost: 1, CostType: model.CostTypeKafkaNetworkRead}}
+
+	rows := exporter.AllocateSharedCosts(usageRows, model.MetricsDataForDay{DayDate: testDay})
+	if len(rows) != len(usageRows) {
+		t.Errorf("got %d rows, want only the usage rows", len(rows))
+	}
+}
+
+// loadData holds request and response bytes of topics on lkc-1
+func loadData(request map[model.TopicName]float64, response map[model.TopicName]float64) model.MetricsDataForDay {
+	data := model.MetricsDataForDay{DayDate: testDay, Topics: make(map[model.MetricKey]map[model.ClusterId]map[model.TopicName]model.MetricData)}
+	for metricKey, values := range map[model.MetricKey]map[model.TopicName]float64{model.ConfluentKafkaServerRequestBytes: request, model.ConfluentKafkaServerResponseBytes: response} {
+		data.Topics[metricKey] = map[model.ClusterId]map[model.TopicName]model.MetricData{"lkc-1": {}}
+		for topic, value := range values {
+			data.Topics[metricKey]["lkc-1"][topic] = model.MetricData{Value: value}
+		}
+	}
+	return data
+}
+
+func TestAllocateSharedCostsByLoad(t *testing.T) {
+	data := loadData(
+		map[model.TopicName]float64{"pub.a-abcde.x": 30, "b-fghij.y": 10},
+		map[model.TopicName]float64{"pub.a-abcde.x": 50, "b-fghij.y": 10},
+	)
+	usageRows := []model.ExportRow{{ClusterId: "lkc-1", Capability: "c-klmno", Cost: 1, CostType: model.CostTypeKafkaNetworkRead}}
+	lines := []model.ConfluentCostLine{bill("lkc-1", model.CostTypeKafkaNumCkus, model.CKUHour, 100), bill("lkc-1", model.CostTypeKafkaBase, model.Hour, 20)}
+
+	t.Run("dedicated", func(t *testing.T) {
+		exporter := newAllocationTestExporter(t, dedicatedCluster, lines...)
+		exporter.sharedCostPolicies[model.CostTypeKafkaNumCkus] = sharedCostPolicy{strategy: AllocationStrategyLoad}
+		exporter.sharedCostPolicies[model.CostTypeKafkaBase] = sharedCostPolicy{strategy: AllocationStrategyLoad}
+
+		rows := exporter.AllocateSharedCosts(usageRows, data)[len(usageRows):]
+		assertCost(t, "CKU costs", sumCosts(rows, model.CostTypeKafkaNumCkus), 100)
+		assertCost(t, "base costs", sumCosts(rows, model.CostTypeKafkaBase), 20)
+
+		costs := make(map[string]float64)
+		for _, row := range rows {
+			if row.Action != "request-bytes" && row.Action != "response-bytes" {
+				t.Errorf("got action %s", row.Action)
+			}
+			if row.CostType == model.CostTypeKafkaNumCkus {
+				costs[row.Name+" "+row.Action] += row.Cost
+			}
+		}
+		assertCost(t, "request bytes cost of a", costs["pub.a-abcde.x request-bytes"], 30)
+		assertCost(t, "response bytes cost of a", costs["pub.a-abcde.x response-bytes"], 50)
+		assertCost(t, "request bytes cost of b", costs["b-fghij.y request-bytes"], 10)
+	})
+
+	t.Run("not dedicated", func(t *testing.T) {
+		exporter := newAllocationTestExporter(t, []config.Cluster{{Id: "lkc-1", Kind: "Standard"}}, lines...)
+		exporter.sharedCostPolicies[model.CostTypeKafkaNumCkus] = sharedCostPolicy{strategy: AllocationStrategyLoad}
+
+		rows := exporter.AllocateSharedCosts(usageRows, data)[len(usageRows):]
+		if len(rows) != 1 || rows[0].Capability != "c-klmno" || rows[0].Name != SharedCostPlaceholder {
+			t.Fatalf("got rows %+v, want the CKU costs allocated proportionally to usage", rows)
+		}
+		assertCost(t, "CKU costs", rows[0].Cost, 100)
+	})
+
+	t.Run("without load", func(t *testing.T) {
+		exporter := newAllocationTestExporter(t, dedicatedCluster, lines...)
+		exporter.sharedCostPolicies[model.CostTypeKafkaNumCkus] = sharedCostPolicy{strategy: AllocationStrategyLoad}
+
+		rows := exporter.AllocateSharedCosts(usageRows, loadData(nil, nil))[len(usageRows):]
+		if len(rows) != 1 || rows[0].Capability != "c-klmno" {
+			t.Fatalf("got rows %+v, want the CKU costs allocated proportionally to usage", rows)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"github.com/gofiber/fiber/v2/log"
+	"go.dfds.cloud/ccc-exporter/internal/capability"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+	"sort"
+)
+
+func (e *ExporterApplication) ResolveCapability(topic string) capability.Match {
+	e.refreshCapabilityOverrides()
+	return e.capabilityResolver.Resolve(topic)
+}
+
+// refreshCapabilityOverrides picks up changes to the capability overrides file, the last read overrides are kept on failure
+func (e *ExporterApplication) refreshCapabilityOverrides() {
+	if err := e.capabilityResolver.Refresh(); err != nil {
+		log.Warnf("Keeping the last read capability overrides: %s", err)
+	}
+}
+
+// CapabilityReport resolves every topic with usage on the day, sorted by topic name
+func (e *ExporterApplication) CapabilityReport(day util.YearMonthDayDate) ([]capability.Match, error) {
+	metricsData, err := e.gathererService.GetMetricsForDay(day)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get prometheus usage data: %w", err)
+	}
+
+	topics := make(map[model.TopicName]bool)
+	for _, clusters := range metricsData.Topics {
+		for _, clusterTopics := range clusters {
+			for topic := range clusterTopics {
+				topics[topic] = true
+			}
+		}
+	}
+
+	e.refreshCapabilityOverrides()
+	matches := make([]capability.Match, 0, len(topics))
+	for topic := range topics {
+		matches = append(matches, e.capabilityResolver.Resolve(string(topic)))
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Topic < matches[j].Topic
+	})
+	return matches, nil
+}
+
+// enrichWithCatalogue adds the catalogue metadata of the capability of each row, rows are left as they are without a catalogue
+func (e *ExporterApplication) enrichWithCatalogue(rows []model.ExportRow) []model.ExportRow {
+	if e.capabilityCatalogue == nil {
+		return rows
+	}
+	capabilities := e.capabilityCatalogue.Capabilities(context.Background())
+	for i, row := range rows {
+		metadata, ok := capabilities[model.CapabilityId(row.Capability)]
+		if !ok {
+			continue
+		}
+		rows[i].CapabilityName = metadata.DisplayName
+		rows[i].Team = metadata.Team
+		rows[i].CostCentre = metadata.CostCentre
+		rows[i].BusinessUnit = metadata.BusinessUnit
+	}
+	return rows
+}
@@ -0,0 +1,74 @@
+package application
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2/log"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+	"regexp"
+)
+
+// connectorCapabilityResolver maps connectors to the capability running them, explicit mappings from config win over the name pattern
+type connectorCapabilityResolver struct {
+	capabilities map[string]string
+	pattern      *regexp.Regexp
+}
+
+func newConnectorCapabilityResolver(connectConfig config.Connect) (*connectorCapabilityResolver, error) {
+	resolver := &connectorCapabilityResolver{
+		capabilities: make(map[string]string),
+	}
+	for _, mapping := range connectConfig.Capabilities {
+		resolver.capabilities[mapping.Connector] = mapping.Capability
+	}
+	if connectConfig.CapabilityPattern != "" {
+		pattern, err := regexp.Compile(connectConfig.CapabilityPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid connector capability pattern: %w", err)
+		}
+		resolver.pattern = pattern
+	}
+	return resolver, nil
+}
+
+func (r *connectorCapabilityResolver) Resolve(connectorId model.ConnectorId, connectorName string) string {
+	if capability, ok := r.capabilities[string(connectorId)]; ok {
+		return capability
+	}
+	if capability, ok := r.capabilities[connectorName]; ok {
+		return capability
+	}
+	if r.pattern != nil {
+		if match := r.pattern.FindStringSubmatch(connectorName); len(match) > 1 && match[1] != "" {
+			return match[1]
+		}
+	}
+	return UnknownPlaceholder
+}
+
+// TryAddConnectLines adds a row per connector and connect cost type, the connector id is used as ClusterId
+func (e *ExporterApplication) TryAddConnectLines(rows []model.ExportRow, date util.YearMonthDayDate) []model.ExportRow {
+	costs, err := e.costService.GetConnectCosts(date)
+	if err != nil {
+		log.Warnf("No connect costs found for %s: %s", date, err)
+		return rows
+	}
+
+	for _, cost := range costs {
+		name := cost.ConnectorName
+		if name == "" {
+			name = string(cost.ConnectorId)
+		}
+		rows = append(rows, model.ExportRow{
+			Date:       date,
+			Cost:       cost.TotalCost,
+			Name:       name,
+			ClusterId:  string(cost.ConnectorId),
+			Action:     cost.CostType.ToCsvFormatString(),
+			Capability: e.connectorCapabilities.Resolve(cost.ConnectorId, cost.ConnectorName),
+			CostType:   cost.CostType,
+		})
+	}
+	return rows
+}
@@ -0,0 +1,61 @@
+package application
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/metrics"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+// CostCollector returns the collector publishing the costs of the latest exported day, nil when cost metrics are disabled
+func (e *ExporterApplication) CostCollector() *metrics.CostCollector {
+	return e.costCollector
+}
+
+func (e *ExporterApplication) publishCosts(rows []model.ExportRow, data model.MetricsDataForDay) {
+	if e.costCollector != nil {
+		e.costCollector.Update(rows, data)
+	}
+}
+
+// publishLatestExport publishes the most recent day exported locally before the worker started,
+// otherwise the cost metrics would be missing until the next day is exported
+func (e *ExporterApplication) publishLatestExport(workerConfig config.Worker) {
+	if e.costCollector == nil {
+		return
+	}
+	if _, ok := e.costCollector.Day(); ok {
+		return
+	}
+
+	year, month, day := time.Now().UTC().Date()
+	date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < workerConfig.DaysToLookBack; i++ {
+		date = date.Add(-time.Hour * 24)
+		dayTime := util.ToYearMonthDayDate(date)
+		if !e.HasExportedDataForDay(dayTime) {
+			continue
+		}
+
+		if err := e.fetchCosts(dayTime); err != nil {
+			log.Errorf("unable to publish cost metrics for %s: %s", dayTime, err)
+			return
+		}
+		metricsData, err := e.gathererService.GetMetricsForDay(dayTime)
+		if err != nil {
+			log.Errorf("unable to publish cost metrics for %s: %s", dayTime, err)
+			return
+		}
+		rows, err := e.BuildRows(metricsData)
+		if err != nil {
+			log.Errorf("unable to publish cost metrics for %s: %s", dayTime, err)
+			return
+		}
+		e.publishCosts(rows, metricsData)
+		log.Infof("published cost metrics for %s", dayTime)
+		return
+	}
+}
@@ -1,22 +1,33 @@
 package application
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gofiber/fiber/v2/log"
 	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/telemetry"
 	"go.dfds.cloud/ccc-exporter/internal/util"
+	"io"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strings"
 )
 import "encoding/csv"
 
 const CostsExportDir = "export"
+
+// DryRunExportDir holds the local exports of dry runs
+const DryRunExportDir = "export-dry-run"
 const UnknownPlaceholder = "UNKNOWN"
 
+// kafkaUsageMetrics are the metrics used to allocate usage based Kafka costs to topics
+var kafkaUsageMetrics = []model.MetricKey{
+	model.ConfluentKafkaServerReceivedBytes,
+	model.ConfluentKafkaServerSentBytes,
+	model.ConfluentKafkaServerRetainedBytes,
+}
+
 func (e *ExporterApplication) EnsureCSVDataFolderExists() error {
-	err := os.MkdirAll(CostsExportDir, 0755)
+	err := os.MkdirAll(e.exportDir, 0755)
 	if err != nil {
 		return err
 	}
@@ -25,7 +36,6 @@ func (e *ExporterApplication) EnsureCSVDataFolderExists() error {
 
 func calcCost(m model.MetricData, costs model.KafkaConfluentCost) float64 {
 	inGB := m.Value / 1024 / 1024 / 1024
-	fmt.Printf("%s\n", costs.CostType)
 	switch costs.CostUnit {
 	case model.GB:
 		return inGB * costs.CostPerUnit
@@ -38,49 +48,77 @@ func calcCost(m model.MetricData, costs model.KafkaConfluentCost) float64 {
 	return 0
 }
 
-func (e *ExporterApplication) TryAddLine(writer *csv.Writer, data model.MetricsDataForDay, clusterId model.ClusterId, pattern *regexp.Regexp, metricsKey model.MetricKey) {
+func (e *ExporterApplication) TryAddLine(rows []model.ExportRow, data model.MetricsDataForDay, clusterId model.ClusterId, metricsKey model.MetricKey) []model.ExportRow {
 	metricData, ok := data.Topics[metricsKey][clusterId]
 	if !ok {
 		log.Warnf("No data found for cluster %s and metric %s", clusterId, metricsKey)
-		return
+		return rows
 	}
 	costType := metricsKey.ToConfluentCostType()
 	costs, err := e.costService.GetKafkaCosts(data.DayDate, clusterId, costType)
 	if err != nil {
 		log.Warnf("No cost found for cluster %s and cost type %s", clusterId, costType)
-		return
+		telemetry.SkippedRows.WithLabelValues("no_cost", string(costType)).Add(float64(len(metricData)))
+		return rows
 	}
 
 	for topic, m := range metricData {
-		capabilityRootId := pattern.FindStringSubmatch(string(topic))
-		capability := "UNKNOWN"
-
-		if len(capabilityRootId) > 2 { // matching pattern of Capability rootid
-			capability = capabilityRootId[2]
-			if strings.Contains(capabilityRootId[2], "_confluent-ksql") {
-				capability = UnknownPlaceholder
-			}
+		capability := e.capabilityResolver.Resolve(string(topic)).Capability
+		row := model.ExportRow{
+			Date:       data.DayDate,
+			Cost:       calcCost(m, costs),
+			Name:       string(topic),
+			ClusterId:  string(clusterId),
+			Action:     metricsKey.ToCsvFormatString(),
+			Capability: capability,
+			CostType:   costType,
+		}
+
+		if e.attributionMode != AttributionModePrincipal {
+			rows = append(rows, row)
+			continue
+		}
+		row.ProducerCapability = capability
+		if metricsKey != model.ConfluentKafkaServerSentBytes {
+			rows = append(rows, row)
+			continue
+		}
+		rows = append(rows, e.attributeToPrincipals(row, data.SentBytesByPrincipal[clusterId][topic])...)
+	}
+	return rows
+}
+
+// BuildRows allocates the costs of the day to topics, connectors and shared costs to capabilities,
+// reconciles the result against the invoice and adds the capability catalogue metadata
+func (e *ExporterApplication) BuildRows(data model.MetricsDataForDay) ([]model.ExportRow, error) {
+	// without clusters the export would hold no Kafka rows at all, so it is retried once clusters are known
+	clusterIds := e.clusterRegistry.ClusterIds()
+	if len(clusterIds) == 0 {
+		return nil, errors.New("no Confluent clusters known, unable to build export rows")
+	}
+
+	e.refreshCapabilityOverrides()
+	var rows []model.ExportRow
+	for _, clusterId := range clusterIds {
+		for _, metricKey := range kafkaUsageMetrics {
+			rows = e.TryAddLine(rows, data, clusterId, metricKey)
 		}
+		if e.allocatePartitions {
+			rows = e.TryAddPartitionLines(rows, data, clusterId)
+		}
+	}
+	rows = e.TryAddConnectLines(rows, data.DayDate)
+	rows = e.AllocateSharedCosts(rows, data)
 
-		err = writer.Write([]string{
-			data.DayDate.ToCSVString(),
-			fmt.Sprintf("%f", calcCost(m, costs)),
-			string(topic),
-			string(clusterId),
-			metricsKey.ToCsvFormatString(),
-			capability,
-		})
-
-		//key := fmt.Sprintf("%s-%s-%s", clusterId, topic, metricsKey.ToCsvFormatString())
-		//cost := calcCost(m, costs)
-		//if strings.Contains(key, "lkc-4npj6-dataplatform-ajamn.ft-unithandling-phx-source-written-bytes") || strings.Contains(key, "lkc-4npj6-onboardcustomers-npxkm.customerbookings-internal-prod-written-bytes") {
-		//	fmt.Printf("key: %s\ncost: %f\n", key, cost)
-		//}
+	rows, err := e.Reconcile(rows, data.DayDate)
+	if err != nil {
+		return nil, err
 	}
+	return e.enrichWithCatalogue(rows), nil
 }
 
 func (e *ExporterApplication) ReadCsvRaw(date util.YearMonthDayDate) ([]byte, error) {
-	pathToFile := filepath.Join(CostsExportDir, date.ToFileNameFormat())
+	pathToFile := filepath.Join(e.exportDir, date.ToFileNameFormat())
 	byteData, err := os.ReadFile(pathToFile)
 	if err != nil {
 		return nil, err
@@ -95,39 +133,72 @@ func (e *ExporterApplication) WriteCSV(data model.MetricsDataForDay) error {
 		return err
 	}
 
-	pathToFile := filepath.Join(CostsExportDir, data.DayDate.ToFileNameFormat())
+	pathToFile := filepath.Join(e.exportDir, data.DayDate.ToFileNameFormat())
 	_, err = os.Stat(pathToFile)
 	if err == nil {
 		return fmt.Errorf("file %s already exists", pathToFile)
 	}
 
-	dataFile, err := os.Create(pathToFile)
+	rows, err := e.BuildRows(data)
 	if err != nil {
 		return err
 	}
-	defer dataFile.Close()
 
-	writer := csv.NewWriter(dataFile)
-	defer writer.Flush()
+	// the export is written next to its final path and renamed, so readers never see a partial export
+	dataFile, err := os.CreateTemp(e.exportDir, "."+data.DayDate.ToFileNameFormat()+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dataFile.Name())
 
-	pattern, err := regexp.Compile("(pub.)?(.*-.{5})\\.")
+	err = writeRows(dataFile, e.ExportFormat(), rows)
+	if closeErr := dataFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return err
 	}
+	if err := os.Rename(dataFile.Name(), pathToFile); err != nil {
+		return err
+	}
+	e.storedRows.forget(data.DayDate)
+	e.publishCosts(rows, data)
+	return nil
+}
 
-	// new headers: Date,Cost,Name,Action,Capability
-	//headers := []string{"Date", "ServiceName", "Cost"}
-	headers := []string{"Date", "Cost", "Name", "ClusterId", "Action", "Capability"}
-	err = writer.Write(headers)
+// WriteCSVTo writes the export for the day to w instead of the local export folder
+func (e *ExporterApplication) WriteCSVTo(w io.Writer, data model.MetricsDataForDay) error {
+	rows, err := e.BuildRows(data)
 	if err != nil {
 		return err
 	}
-	for _, clusterId := range model.ConfluentClusters {
-		e.TryAddLine(writer, data, clusterId, pattern, model.ConfluentKafkaServerReceivedBytes)
-		e.TryAddLine(writer, data, clusterId, pattern, model.ConfluentKafkaServerSentBytes)
-		e.TryAddLine(writer, data, clusterId, pattern, model.ConfluentKafkaServerRetainedBytes)
+	return writeRows(w, e.ExportFormat(), rows)
+}
+
+func writeRows(w io.Writer, format model.ExportFormat, rows []model.ExportRow) error {
+	writer := csv.NewWriter(w)
+
+	err := writer.Write(format.Headers())
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		err = writer.Write(format.Record(row))
+		if err != nil {
+			return err
+		}
 	}
 
+	writer.Flush()
+	return writer.Error()
+}
+
+func (e *ExporterApplication) RemoveLocalCsv(date util.YearMonthDayDate) error {
+	err := os.Remove(filepath.Join(e.exportDir, date.ToFileNameFormat()))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	e.storedRows.forget(date)
 	return nil
 }
 
@@ -138,7 +209,7 @@ func (e *ExporterApplication) HasExportedDataForDay(date util.YearMonthDayDate)
 		return false
 	}
 
-	pathToFile := filepath.Join(CostsExportDir, date.ToFileNameFormat())
+	pathToFile := filepath.Join(e.exportDir, date.ToFileNameFormat())
 	_, err = os.Stat(pathToFile)
 	return err == nil
 }
@@ -1,13 +1,20 @@
 package application
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/gofiber/fiber/v2/log"
 	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/capability"
 	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/metrics"
+	"go.dfds.cloud/ccc-exporter/internal/model"
 	"go.dfds.cloud/ccc-exporter/internal/service"
+	"go.dfds.cloud/ccc-exporter/internal/store"
+	"go.dfds.cloud/ccc-exporter/internal/telemetry"
 	"go.dfds.cloud/ccc-exporter/internal/util"
 )
 
@@ -19,159 +26,353 @@ const (
 	ExportStateNeedLocalCSVExport      ExportState = "NEED_LOCAL_CSV_EXPORT"
 	ExportStateNeedToPutCSVInS3        ExportState = "NEED_TO_PUT_CSV_IN_S3"
 	ExportStateDone                    ExportState = "DONE"
+	// ExportStateFailed is reached when an upstream rejects the configured credentials, retrying cannot help.
+	// The day is not exported again until it is queued through the API, the state is kept across restarts.
+	ExportStateFailed ExportState = "FAILED"
 )
 
+// exportStates lists every ExportState in the order an export goes through them
+var exportStates = []ExportState{
+	ExportStateNeedCosts,
+	ExportStateNeedPrometheusUsageData,
+	ExportStateNeedLocalCSVExport,
+	ExportStateNeedToPutCSVInS3,
+	ExportStateDone,
+	ExportStateFailed,
+}
+
+// isFinished reports whether the worker is done with an export in the state, successfully or not
+func (s ExportState) isFinished() bool {
+	return s == ExportStateDone || s == ExportStateFailed
+}
+
 type ExportProcess struct {
 	dayTime      util.YearMonthDayDate
 	currentState ExportState
+	// attempts counts the failed steps, a clean export has none
+	attempts  int
+	lastError string
+	createdAt time.Time
+	updatedAt time.Time
+	// force replaces the costs, usage and export of the day that are already there
+	force bool
+	sinks map[string]SinkResult
+}
+
+func newExportProcess(dayTime util.YearMonthDayDate) *ExportProcess {
+	now := time.Now().UTC()
+	return &ExportProcess{
+		dayTime:      dayTime,
+		currentState: ExportStateNeedCosts,
+		createdAt:    now,
+		updatedAt:    now,
+	}
 }
 
 // ExporterApplication responsible for using various clients and services to be able to create a csv with confluent costs and output them in a s3 bucket in AWS
 type ExporterApplication struct {
 	gathererService *service.GathererService
 	costService     *service.ConfluentCostService
-	s3Client        *client.S3Client
+	clusterRegistry *service.ClusterRegistry
+	// principalDirectory holds the owners of service accounts and API keys discovered through the IAM API
+	principalDirectory *service.PrincipalDirectory
+	s3Client           *client.S3Client
+	// s3Config is where the worker puts exports, stored exports are read back from there
+	s3Config   config.S3
+	stateStore store.StateStore
+
+	capabilityResolver *capability.Resolver
+	// capabilityCatalogue is nil unless a capability catalogue is configured
+	capabilityCatalogue   *service.CapabilityCatalogue
+	connectorCapabilities *connectorCapabilityResolver
+	attributionMode       AttributionMode
+	principalCapabilities PrincipalCapabilityResolver
+	sharedCostPolicies    map[model.CostType]sharedCostPolicy
+	// allocatePartitions bills KAFKA_PARTITION costs to topics by their partition counts
+	allocatePartitions bool
+	maxDriftPercent    float64
+	// costCollector is nil unless cost metrics are enabled
+	costCollector *metrics.CostCollector
 
-	exportProcesses []*ExportProcess
+	// dryRun keeps exports local, nothing is put in s3
+	dryRun bool
+	// exportDir holds the local exports, dry runs use their own so their exports are never taken for real ones
+	exportDir string
+	// storedRows caches the rows of stored exports read by the API
+	storedRows *rowCache
+
+	// queue holds the export processes, it is shared by the worker and the API
+	queue *exportQueue
 }
 
-func NewExporterApplication(prometheusClient *client.PrometheusClient, confluentClient *client.ConfluentCloudClient, s3Client *client.S3Client) ExporterApplication {
+func NewExporterApplication(conf config.Config, prometheusSources *service.PrometheusSources, confluentClient *client.ConfluentCloudClient, s3Client *client.S3Client, clusterRegistry *service.ClusterRegistry, principalDirectory *service.PrincipalDirectory, stateStore store.StateStore) (ExporterApplication, error) {
+	capabilityResolver, err := capability.NewResolver(conf.Capabilities)
+	if err != nil {
+		return ExporterApplication{}, err
+	}
+	connectorCapabilities, err := newConnectorCapabilityResolver(conf.Connect)
+	if err != nil {
+		return ExporterApplication{}, err
+	}
+	attributionMode, err := parseAttributionMode(conf.Attribution.Mode)
+	if err != nil {
+		return ExporterApplication{}, err
+	}
+	sharedCostPolicies, err := newSharedCostPolicies(conf.Allocation)
+	if err != nil {
+		return ExporterApplication{}, err
+	}
+	if err := checkClusterKinds(conf.Confluent, sharedCostPolicies); err != nil {
+		return ExporterApplication{}, err
+	}
+
+	partitionCounter, err := service.NewPartitionCounter(conf.Partitions, prometheusSources, confluentClient, clusterRegistry)
+	if err != nil {
+		return ExporterApplication{}, err
+	}
+
+	var costCollector *metrics.CostCollector
+	if conf.CostMetrics.Enabled {
+		costCollector = metrics.NewCostCollector(conf.CostMetrics)
+	}
+
+	var capabilityCatalogue *service.CapabilityCatalogue
+	if conf.Catalogue.IsConfigured() {
+		capabilityCatalogue = service.NewCapabilityCatalogue(client.NewCapabilityCatalogueClient(conf.Catalogue), time.Duration(conf.Catalogue.TtlSeconds)*time.Second)
+	}
 
 	return ExporterApplication{
-		gathererService: service.NewGatherer(prometheusClient),
-		costService:     service.NewConfluentCostService(confluentClient, false),
-		s3Client:        s3Client,
+		gathererService: service.NewGatherer(prometheusSources, clusterRegistry, service.GathererOptions{
+			GatherPrincipals: attributionMode == AttributionModePrincipal,
+			PartitionCounter: partitionCounter,
+		}),
+		costService:           service.NewConfluentCostService(confluentClient, clusterRegistry, false),
+		clusterRegistry:       clusterRegistry,
+		principalDirectory:    principalDirectory,
+		s3Client:              s3Client,
+		s3Config:              conf.S3,
+		stateStore:            stateStore,
+		capabilityResolver:    capabilityResolver,
+		capabilityCatalogue:   capabilityCatalogue,
+		connectorCapabilities: connectorCapabilities,
+		attributionMode:       attributionMode,
+		principalCapabilities: chainedPrincipalResolver{newStaticPrincipalResolver(conf.Attribution), principalDirectory},
+		sharedCostPolicies:    sharedCostPolicies,
+		maxDriftPercent:       conf.Reconciliation.MaxDriftPercent,
+		allocatePartitions:    partitionCounter != nil,
+		costCollector:         costCollector,
+		queue:                 newExportQueue(),
+		exportDir:             CostsExportDir,
+		storedRows:            newRowCache(maxCachedDays),
+	}, nil
+}
+
+// ExportFormat returns the columns of the exports, they depend on the attribution mode and the capability catalogue
+func (e *ExporterApplication) ExportFormat() model.ExportFormat {
+	return model.ExportFormat{
+		PrincipalAttribution: e.attributionMode == AttributionModePrincipal,
+		CapabilityMetadata:   e.capabilityCatalogue != nil,
+		CostType:             e.allocatesByLoad(),
 	}
 }
 
-// SetupProcesses setup fetch processes for days looking back by daysToLookBack
-// For now only checks local exports and not in s3
-func (e *ExporterApplication) SetupProcesses(checkS3 bool, daysToLookBack int) {
-	e.exportProcesses = []*ExportProcess{}
+func (e *ExporterApplication) SetDryRun(dryRun bool) {
+	e.dryRun = dryRun
+	e.exportDir = CostsExportDir
+	if dryRun {
+		e.exportDir = DryRunExportDir
+	}
+}
 
+// SetupProcesses setup fetch processes for days looking back by daysToLookBack,
+// skipping days already exported locally and/or in s3 depending on the worker config
+func (e *ExporterApplication) SetupProcesses(workerConfig config.Worker, s3Config config.S3) {
 	var daysToExport []util.YearMonthDayDate
 	year, month, day := time.Now().UTC().Date()
 	date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
-	for i := 0; i < daysToLookBack; i++ {
+	for i := 0; i < workerConfig.DaysToLookBack; i++ {
 		date = date.Add(-time.Hour * 24)
 		daysToExport = append(daysToExport, util.ToYearMonthDayDate(date))
 	}
 
-	if checkS3 {
-		log.Errorf("checking s3 for exported data is not implemented yet")
+	if workerConfig.CheckForExportedDataInS3 {
+		log.Infof("checking s3 for exported data for the last %d days", workerConfig.DaysToLookBack)
 	}
-
-	log.Infof("checking locally for exported data for the last %d days", daysToLookBack)
+	if workerConfig.CheckForExportedDataLocally {
+		log.Infof("checking locally for exported data for the last %d days", workerConfig.DaysToLookBack)
+	}
+	// days that left the lookback window are no longer reported
+	telemetry.ExportDayState.Reset()
+	telemetry.ExportDayAttempts.Reset()
+	if len(daysToExport) > 0 {
+		telemetry.ForgetExportSuccessesBefore(daysToExport[len(daysToExport)-1].String())
+	}
+	var processes []*ExportProcess
 	for _, yearMonthDayDate := range daysToExport {
-		if e.HasExportedDataForDay(yearMonthDayDate) {
+		if e.hasFailed(yearMonthDayDate) {
+			reportDayState(yearMonthDayDate, ExportStateFailed)
+			continue
+		}
+		if (workerConfig.CheckForExportedDataLocally && e.HasExportedDataForDay(yearMonthDayDate)) ||
+			(workerConfig.CheckForExportedDataInS3 && e.isExportedInS3(s3Config, yearMonthDayDate)) {
+			reportDayState(yearMonthDayDate, ExportStateDone)
 			continue
 		}
-		e.exportProcesses = append(e.exportProcesses, &ExportProcess{
-			dayTime:      yearMonthDayDate,
-			currentState: ExportStateNeedCosts,
-		})
+		process := newExportProcess(yearMonthDayDate)
+		reportProcess(process)
+		processes = append(processes, process)
 	}
+	e.queue.add(processes)
 }
 
-func (e *ExporterApplication) setProcesses(exportProcesses []*ExportProcess) {
-	e.exportProcesses = exportProcesses
+// isExportedInS3 looks up the export of the day in s3, the whole bucket prefix is never listed as it grows every day.
+// A failing lookup is taken for a missing export, exporting the day again is harmless.
+func (e *ExporterApplication) isExportedInS3(s3Config config.S3, day util.YearMonthDayDate) bool {
+	exported, err := e.s3Client.HeadObject(s3Config.BucketName, s3ObjectKey(s3Config, day))
+	if err != nil {
+		log.Errorf("unable to check s3 for the export of %s: %s", day, err)
+		return false
+	}
+	return exported
+}
+
+func s3ObjectKey(s3Config config.S3, dayTime util.YearMonthDayDate) string {
+	return fmt.Sprintf("%s/%s", s3Config.BucketKey, dayTime.ToFileNameFormat())
 }
 
 // TODO: the 4 following functions could be combined - do we need so many states?
-func (e *ExporterApplication) fetchCosts(dayTime util.YearMonthDayDate) bool {
+func (e *ExporterApplication) fetchCosts(dayTime util.YearMonthDayDate) error {
 	if !e.costService.HasCostsForDate(dayTime) {
-		e.costService.FetchAndCacheCosts(dayTime)
-		if !e.costService.HasCostsForDate(dayTime) {
-			log.Errorf("unable to fetch costs for %s", dayTime)
-			return false
+		err := e.costService.FetchAndCacheCosts(context.Background(), dayTime)
+		if errors.Is(err, client.ErrUnauthorized) {
+			return fmt.Errorf("confluent cloud rejected the configured api key, check the confluent credentials: %w", err)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to fetch costs: %w", err)
 		}
 	}
 	log.Infof("successfully found confluent costs for %s", dayTime)
-	return true
+	return nil
 }
 
-func (e *ExporterApplication) getPrometheusUsageData(dayTime util.YearMonthDayDate) bool {
+func (e *ExporterApplication) getPrometheusUsageData(dayTime util.YearMonthDayDate) error {
 	_, err := e.gathererService.GetMetricsForDay(dayTime)
 	if err != nil {
-		log.Warnf("unable to get prometheus usage data for %s: %s", dayTime, err)
-		return false
+		return fmt.Errorf("unable to get prometheus usage data: %w", err)
 	}
 	log.Infof("successfully found prometheus usage data for %s", dayTime)
-	return true
+	return nil
 }
 
-func (e *ExporterApplication) writeToCsv(dayTime util.YearMonthDayDate) bool {
+func (e *ExporterApplication) writeToCsv(dayTime util.YearMonthDayDate) error {
 	metricsData, err := e.gathererService.GetMetricsForDay(dayTime)
 	if err != nil {
-		return false
+		return fmt.Errorf("unable to get prometheus usage data: %w", err)
 	}
 	err = e.WriteCSV(metricsData)
 	if err != nil {
-		log.Errorf("unable to write csv for %s: %s", dayTime, err)
-		return false
+		return fmt.Errorf("unable to write csv: %w", err)
 	}
+	telemetry.ExportSucceeded(dayTime.String(), telemetry.SinkLocal)
 	log.Infof("successfully wrote csv for %s", dayTime)
-	return true
+	return nil
 }
 
-func (e *ExporterApplication) putCsvInS3(dayTime util.YearMonthDayDate, s3Config config.S3) bool {
+func (e *ExporterApplication) putCsvInS3(dayTime util.YearMonthDayDate, s3Config config.S3) error {
 	data, err := e.ReadCsvRaw(dayTime)
 	if err != nil {
-		log.Errorf("unable to find csv locally %s", dayTime, err)
-		return false
+		return fmt.Errorf("unable to find csv locally: %w", err)
 	}
-	err = e.s3Client.PutObject(s3Config.BucketName, fmt.Sprintf("%s/%s", s3Config.BucketKey, dayTime.ToFileNameFormat()), data)
+	err = e.s3Client.PutObject(s3Config.BucketName, s3ObjectKey(s3Config, dayTime), data)
 	if err != nil {
-		log.Errorf("unable to put csv in s3 for %s: %s", dayTime, err)
-		return false
+		return fmt.Errorf("unable to put csv in s3: %w", err)
 	}
+	telemetry.ExportSucceeded(dayTime.String(), telemetry.SinkS3)
 	log.Infof("successfully put csv in s3 for %s", dayTime)
-	return true
+	return nil
 }
 
-func (e *ExporterApplication) removeDoneProcesses(endedProcessesIndices []int) {
-	for id := range endedProcessesIndices {
-		e.setProcesses(append(e.exportProcesses[:id], e.exportProcesses[id+1:]...)) //all processes except for #i
-	}
-}
+// executeProcessAndUpdateState runs the step of the current state. The queue is not locked while the step runs,
+// the process is only read before and updated after it.
+func (e *ExporterApplication) executeProcessAndUpdateState(process *ExportProcess, s3Config config.S3) {
+	e.queue.mu.Lock()
+	dayTime, state, force := process.dayTime, process.currentState, process.force
+	e.queue.mu.Unlock()
 
-func (e *ExporterApplication) executeProcessAndUpdateState(process *ExportProcess, s3Config config.S3) bool {
 	//TODO: are so many states really necessary?
-	fmt.Printf("Processing entry '%s', current state: %s\n", process.dayTime.String(), process.currentState)
-	isDone := false
-	switch process.currentState {
+	log.Debugf("processing export of %s, current state: %s", dayTime, state)
+	var err error
+	nextState := state
+	sink := ""
+	switch state {
 	case ExportStateNeedCosts:
-		if e.fetchCosts(process.dayTime) {
-			process.currentState = ExportStateNeedPrometheusUsageData
+		if force {
+			e.costService.Forget(dayTime)
+			e.gathererService.Forget(dayTime)
+		}
+		if err = e.fetchCosts(dayTime); err == nil {
+			nextState = ExportStateNeedPrometheusUsageData
 		}
 
 	case ExportStateNeedPrometheusUsageData:
-		if e.getPrometheusUsageData(process.dayTime) {
-			process.currentState = ExportStateNeedLocalCSVExport
+		if err = e.getPrometheusUsageData(dayTime); err == nil {
+			nextState = ExportStateNeedLocalCSVExport
 		}
 	case ExportStateNeedLocalCSVExport:
-		if e.writeToCsv(process.dayTime) {
-			process.currentState = ExportStateNeedToPutCSVInS3
+		sink = telemetry.SinkLocal
+		if force {
+			err = e.RemoveLocalCsv(dayTime)
+		}
+		if err == nil {
+			err = e.writeToCsv(dayTime)
+		}
+		if err == nil {
+			nextState = ExportStateNeedToPutCSVInS3
 		}
 	case ExportStateNeedToPutCSVInS3:
-		if e.putCsvInS3(process.dayTime, s3Config) {
-			process.currentState = ExportStateDone
+		if e.dryRun {
+			log.Infof("dry run, not putting csv for %s in s3", dayTime)
+			nextState = ExportStateDone
+			break
+		}
+		sink = telemetry.SinkS3
+		if err = e.putCsvInS3(dayTime, s3Config); err == nil {
+			nextState = ExportStateDone
+		}
+	case ExportStateDone, ExportStateFailed:
+		return
+	}
+	if errors.Is(err, client.ErrUnauthorized) {
+		nextState = ExportStateFailed
+	}
+
+	e.queue.mu.Lock()
+	defer e.queue.mu.Unlock()
+	process.currentState = nextState
+	process.updatedAt = time.Now().UTC()
+	if sink != "" {
+		process.setSinkResult(sink, err)
+	}
+	if err != nil {
+		process.attempts++
+		process.lastError = err.Error()
+		log.Errorf("export of %s failed in state %s: %s", dayTime, state, err)
+		if nextState == ExportStateFailed {
+			log.Errorf("giving up on the export of %s, queue it again once the credentials are fixed", dayTime)
 		}
-	case ExportStateDone:
-		isDone = true
+	} else {
+		process.lastError = ""
 	}
-	return isDone
+	reportProcess(process)
 }
 
 func (e *ExporterApplication) processesListFold(s3Config config.S3) {
-	ongoingProcesses := []*ExportProcess{}
-	for _, process := range e.exportProcesses {
-		if !e.executeProcessAndUpdateState(process, s3Config) {
-			ongoingProcesses = append(ongoingProcesses, process)
-		}
-		//e.removeDoneProcesses(endedProcesses)
+	for _, process := range e.queue.ongoing() {
+		e.executeProcessAndUpdateState(process, s3Config)
 	}
-	e.setProcesses(ongoingProcesses)
+	e.queue.retireDone()
+	e.saveState()
+	e.reportProcesses()
 }
 
 func (e *ExporterApplication) Work(config config.Worker, s3Config config.S3) {
@@ -179,16 +380,22 @@ func (e *ExporterApplication) Work(config config.Worker, s3Config config.S3) {
 	if err != nil {
 		panic(err)
 	}
+	e.restoreState()
+	e.publishLatestExport(config)
 	for {
-		if len(e.exportProcesses) == 0 {
-			e.SetupProcesses(config.CheckForExportedDataInS3, config.DaysToLookBack)
+		if len(e.queue.ongoing()) == 0 {
+			e.SetupProcesses(config, s3Config)
 		}
-		fmt.Println("eventProcesses")
-		for _, proc := range e.exportProcesses {
-			fmt.Printf("%s - %v\n", proc.currentState, proc.dayTime.String())
+		for _, proc := range e.ExportProcesses() {
+			if !proc.State.isFinished() {
+				log.Debugf("export of %s in state %s", proc.Date, proc.State)
+			}
 		}
 		e.processesListFold(s3Config)
-		time.Sleep(sleepInterval)
+		select {
+		case <-time.After(sleepInterval):
+		case <-e.queue.wake:
+		}
 		log.Infof("woke up, checking for work")
 	}
 }
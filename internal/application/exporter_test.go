@@ -0,0 +1,174 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/fake"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/service"
+	"go.dfds.cloud/ccc-exporter/internal/store"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+const gigabyte = 1024 * 1024 * 1024
+
+func costLine(lineType string, amount float64, price float64, unit string, date string) model.ConfluentCostLine {
+	line := model.ConfluentCostLine{LineType: lineType, Product: "KAFKA", StartDate: date, Amount: amount, Price: price, Unit: unit}
+	line.Resource.Id = "lkc-1"
+	line.Resource.DisplayName = "prod"
+	return line
+}
+
+// newTestExporter builds an exporter against fake Confluent Cloud, Prometheus and S3 servers, working in a temporary directory
+func newTestExporter(t *testing.T, day util.YearMonthDayDate) (*ExporterApplication, *fake.S3Server, config.Config) {
+	t.Helper()
+
+	billDate := day.ToTimeUTC().AddDate(0, 0, -1).Format("2006-01-02")
+	confluentServer := fake.NewConfluentCloudServer()
+	t.Cleanup(confluentServer.Close)
+	confluentServer.AddCluster("env-1", "lkc-1", "prod", model.ClusterKindDedicated)
+	confluentServer.AddCostLines(
+		costLine("KAFKA_NETWORK_READ", 10, 0.05, "GB", billDate),
+		costLine("KAFKA_NETWORK_WRITE", 20, 0.05, "GB", billDate),
+		costLine("KAFKA_STORAGE", 5, 0.0001, "GB-hour", billDate),
+	)
+
+	prometheusServer := fake.NewPrometheusServer()
+	t.Cleanup(prometheusServer.Close)
+	for _, metric := range []model.MetricKey{model.ConfluentKafkaServerReceivedBytes, model.ConfluentKafkaServerSentBytes, model.ConfluentKafkaServerRetainedBytes} {
+		prometheusServer.AddTopicSeries(string(metric), "lkc-1", "pub.dataplatform-ajamn.events", 3*gigabyte)
+		prometheusServer.AddTopicSeries(string(metric), "lkc-1", "cloudengineering-xyzab.stuff", 1*gigabyte)
+	}
+
+	s3Server := fake.NewS3Server()
+	t.Cleanup(s3Server.Close)
+
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(workingDir)
+	})
+
+	configJson := fmt.Sprintf(`{"confluent": {"endpoint": %q}, "prometheus": {"endpoint": %q}, "s3": {"endpoint": %q, "usePathStyle": true, "bucketName": "costs", "bucketKey": "prod", "region": "eu-central-1"}}`,
+		confluentServer.URL, prometheusServer.URL, s3Server.URL)
+	if err := os.WriteFile("config.json", []byte(configJson), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := config.LoadConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prometheusSources, err := service.NewPrometheusSources(conf.Prometheus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	confluentClient := client.NewConfluentCloudClient(conf.Confluent)
+	clusterRegistry := service.NewClusterRegistry(confluentClient, conf.Confluent)
+	if err := clusterRegistry.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	principalDirectory, err := service.NewPrincipalDirectory(confluentClient, conf.Iam)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3Client, err := client.NewS3Client(aws.Config{Region: conf.S3.Region, Credentials: aws.AnonymousCredentials{}}, conf.S3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exporter, err := NewExporterApplication(conf, prometheusSources, confluentClient, s3Client, clusterRegistry, principalDirectory, store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &exporter, s3Server, conf
+}
+
+func TestExportGoesFromNeedCostsToDone(t *testing.T) {
+	day := util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -3))
+	exporter, s3Server, conf := newTestExporter(t, day)
+
+	results := exporter.EnqueueExports(day, day, false)
+	if len(results) != 1 || results[0].Status != EnqueueStatusQueued {
+		t.Fatalf("got enqueue results %v, want the day to be queued", results)
+	}
+
+	var states []ExportState
+	for i := 0; i < len(exportStates); i++ {
+		process, _ := exporter.ExportProcessForDay(day)
+		states = append(states, process.State)
+		if process.State == ExportStateDone {
+			break
+		}
+		exporter.processesListFold(conf.S3)
+	}
+
+	want := []ExportState{ExportStateNeedCosts, ExportStateNeedPrometheusUsageData, ExportStateNeedLocalCSVExport, ExportStateNeedToPutCSVInS3, ExportStateDone}
+	if fmt.Sprint(states) != fmt.Sprint(want) {
+		t.Fatalf("got states %v, want %v", states, want)
+	}
+	process, _ := exporter.ExportProcessForDay(day)
+	if process.Attempts != 0 || process.LastError != "" {
+		t.Errorf("got %d failed attempts and last error %q, want a clean export", process.Attempts, process.LastError)
+	}
+
+	local, err := exporter.ReadCsvRaw(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded, ok := s3Server.Object("costs", "prod/"+day.ToFileNameFormat())
+	if !ok {
+		t.Fatal("export was not put in s3")
+	}
+	if string(uploaded) != string(local) {
+		t.Error("export in s3 differs from the local export")
+	}
+	for _, capability := range []string{"dataplatform-ajamn", "cloudengineering-xyzab"} {
+		if !strings.Contains(string(local), capability) {
+			t.Errorf("export has no rows for capability %s:\n%s", capability, local)
+		}
+	}
+}
+
+func TestSetupProcessesLooksUpEachDayInS3(t *testing.T) {
+	yesterday := util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -1))
+	exporter, s3Server, conf := newTestExporter(t, yesterday)
+	s3Server.PutObject(conf.S3.BucketName, s3ObjectKey(conf.S3, yesterday), []byte("Date,Cost\n"))
+	// an old export outside the lookback window must not be looked at
+	s3Server.PutObject(conf.S3.BucketName, s3ObjectKey(conf.S3, util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -30))), []byte("Date,Cost\n"))
+
+	exporter.SetupProcesses(config.Worker{DaysToLookBack: 3, CheckForExportedDataInS3: true}, conf.S3)
+
+	ongoing := exporter.queue.ongoing()
+	if len(ongoing) != 2 {
+		t.Fatalf("got %d processes, want the 2 days not exported in s3", len(ongoing))
+	}
+	for _, process := range ongoing {
+		if process.dayTime == yesterday {
+			t.Errorf("%s was queued although it is exported in s3", yesterday)
+		}
+	}
+
+	requests := s3Server.Requests()
+	if len(requests) != 3 {
+		t.Errorf("got requests %v, want one per lookback day", requests)
+	}
+	for _, request := range requests {
+		if !strings.HasPrefix(request, "HEAD /costs/prod/") {
+			t.Errorf("got request %s, want only lookups of single exports", request)
+		}
+	}
+}
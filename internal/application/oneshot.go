@@ -0,0 +1,67 @@
+package application
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+type ExportOptions struct {
+	// Force replaces an existing local export for the day
+	Force bool
+	// OutputDir receives the csv of dry runs, it is printed to Stdout when empty
+	OutputDir string
+	Stdout    io.Writer
+}
+
+// ExportDay runs every step of the export for a single day straight away, outside the worker loop.
+// Dry runs write the csv to the output dir or stdout and leave the local export folder and s3 untouched.
+func (e *ExporterApplication) ExportDay(dayTime util.YearMonthDayDate, s3Config config.S3, options ExportOptions) error {
+	err := e.fetchCosts(dayTime)
+	if err != nil {
+		return err
+	}
+	err = e.getPrometheusUsageData(dayTime)
+	if err != nil {
+		return err
+	}
+
+	if e.dryRun {
+		metricsData, err := e.gathererService.GetMetricsForDay(dayTime)
+		if err != nil {
+			return err
+		}
+		if options.OutputDir == "" {
+			return e.WriteCSVTo(options.Stdout, metricsData)
+		}
+
+		err = os.MkdirAll(options.OutputDir, 0755)
+		if err != nil {
+			return err
+		}
+		outputFile, err := os.Create(filepath.Join(options.OutputDir, dayTime.ToFileNameFormat()))
+		if err != nil {
+			return err
+		}
+		defer outputFile.Close()
+		return e.WriteCSVTo(outputFile, metricsData)
+	}
+
+	if options.Force {
+		err = e.RemoveLocalCsv(dayTime)
+		if err != nil {
+			return fmt.Errorf("unable to remove existing csv: %w", err)
+		}
+	}
+	if options.Force || !e.HasExportedDataForDay(dayTime) {
+		err = e.writeToCsv(dayTime)
+		if err != nil {
+			return err
+		}
+	}
+	return e.putCsvInS3(dayTime, s3Config)
+}
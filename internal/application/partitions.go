@@ -0,0 +1,59 @@
+package application
+
+import (
+	"github.com/gofiber/fiber/v2/log"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/telemetry"
+	"sort"
+)
+
+// PartitionsAction is the action of rows billing KAFKA_PARTITION costs
+const PartitionsAction = "partitions"
+
+// TryAddPartitionLines bills each topic its share of the partition-hours of its cluster
+func (e *ExporterApplication) TryAddPartitionLines(rows []model.ExportRow, data model.MetricsDataForDay, clusterId model.ClusterId) []model.ExportRow {
+	partitions, ok := data.Partitions[clusterId]
+	if !ok {
+		log.Warnf("No partition counts found for cluster %s", clusterId)
+		return rows
+	}
+	cost, err := e.costService.GetKafkaCosts(data.DayDate, clusterId, model.CostTypeKafkaPartition)
+	if err != nil {
+		telemetry.SkippedRows.WithLabelValues("no_cost", string(model.CostTypeKafkaPartition)).Add(float64(len(partitions)))
+		return rows
+	}
+
+	var totalPartitions float64
+	topics := make([]model.TopicName, 0, len(partitions))
+	for topic, count := range partitions {
+		if count <= 0 {
+			continue
+		}
+		totalPartitions += count
+		topics = append(topics, topic)
+	}
+	if totalPartitions == 0 {
+		return rows
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i] < topics[j]
+	})
+
+	for _, topic := range topics {
+		capability := e.capabilityResolver.Resolve(string(topic)).Capability
+		row := model.ExportRow{
+			Date:       data.DayDate,
+			Cost:       cost.TotalCost * partitions[topic] / totalPartitions,
+			Name:       string(topic),
+			ClusterId:  string(clusterId),
+			Action:     PartitionsAction,
+			Capability: capability,
+			CostType:   model.CostTypeKafkaPartition,
+		}
+		if e.attributionMode == AttributionModePrincipal {
+			row.ProducerCapability = capability
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
@@ -0,0 +1,75 @@
+package application
+
+import (
+	"strings"
+	"testing"
+
+	"go.dfds.cloud/ccc-exporter/internal/model"
+)
+
+func TestTryAddPartitionLines(t *testing.T) {
+	tests := []struct {
+		name       string
+		partitions map[model.ClusterId]map[model.TopicName]float64
+		lines      []model.ConfluentCostLine
+		wantCosts  map[string]float64
+	}{
+		{
+			name:       "split by partition count",
+			partitions: map[model.ClusterId]map[model.TopicName]float64{"lkc-1": {"pub.a-abcde.x": 1, "b-fghij.y": 3}},
+			lines:      []model.ConfluentCostLine{bill("lkc-1", model.CostTypeKafkaPartition, model.PartitionHour, 40)},
+			wantCosts:  map[string]float64{"pub.a-abcde.x": 10, "b-fghij.y": 30},
+		},
+		{
+			name:       "topics without partitions",
+			partitions: map[model.ClusterId]map[model.TopicName]float64{"lkc-1": {"pub.a-abcde.x": 2, "b-fghij.y": 0}},
+			lines:      []model.ConfluentCostLine{bill("lkc-1", model.CostTypeKafkaPartition, model.PartitionHour, 40)},
+			wantCosts:  map[string]float64{"pub.a-abcde.x": 40},
+		},
+		{
+			name:       "no topics",
+			partitions: map[model.ClusterId]map[model.TopicName]float64{"lkc-1": {}},
+			lines:      []model.ConfluentCostLine{bill("lkc-1", model.CostTypeKafkaPartition, model.PartitionHour, 40)},
+		},
+		{
+			name:       "no partition counts for the cluster",
+			partitions: map[model.ClusterId]map[model.TopicName]float64{"lkc-2": {"pub.a-abcde.x": 1}},
+			lines:      []model.ConfluentCostLine{bill("lkc-1", model.CostTypeKafkaPartition, model.PartitionHour, 40)},
+		},
+		{
+			name:       "no partition costs",
+			partitions: map[model.ClusterId]map[model.TopicName]float64{"lkc-1": {"pub.a-abcde.x": 1}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exporter := newAllocationTestExporter(t, dedicatedCluster, test.lines...)
+			rows := exporter.TryAddPartitionLines(nil, model.MetricsDataForDay{DayDate: testDay, Partitions: test.partitions}, "lkc-1")
+			if len(rows) != len(test.wantCosts) {
+				t.Fatalf("got rows %+v, want costs %v", rows, test.wantCosts)
+			}
+			for _, row := range rows {
+				assertCost(t, "cost of "+row.Name, row.Cost, test.wantCosts[row.Name])
+				if row.Action != PartitionsAction || row.CostType != model.CostTypeKafkaPartition || !strings.Contains(row.Name, row.Capability+".") {
+					t.Errorf("got row %+v", row)
+				}
+			}
+		})
+	}
+}
+
+func TestPartitionsLeftUnallocatedAreReconciled(t *testing.T) {
+	exporter := newAllocationTestExporter(t, dedicatedCluster, bill("lkc-1", model.CostTypeKafkaPartition, model.PartitionHour, 40))
+	exporter.allocatePartitions = true
+	exporter.maxDriftPercent = 1
+
+	rows := exporter.TryAddPartitionLines(nil, model.MetricsDataForDay{DayDate: testDay}, "lkc-1")
+	rows, err := exporter.Reconcile(rows, testDay)
+	if err != nil {
+		t.Fatalf("got error %v, unallocated partition costs are no drift", err)
+	}
+	if len(rows) != 1 || rows[0].Name != UnallocatedPlaceholder {
+		t.Fatalf("got rows %+v, want the partition costs as residual", rows)
+	}
+	assertCost(t, "residual", rows[0].Cost, 40)
+}
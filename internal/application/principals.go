@@ -0,0 +1,97 @@
+package application
+
+import (
+	"fmt"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"sort"
+)
+
+type AttributionMode string
+
+const (
+	// AttributionModeTopic bills read bytes to the capability owning the topic
+	AttributionModeTopic AttributionMode = "topic"
+	// AttributionModePrincipal bills read bytes to the capabilities of the consuming principals
+	AttributionModePrincipal AttributionMode = "principal"
+)
+
+func parseAttributionMode(mode string) (AttributionMode, error) {
+	switch AttributionMode(mode) {
+	case "", AttributionModeTopic:
+		return AttributionModeTopic, nil
+	case AttributionModePrincipal:
+		return AttributionModePrincipal, nil
+	}
+	return "", fmt.Errorf("invalid attribution mode %s", mode)
+}
+
+// PrincipalCapabilityResolver maps a principal, usually a service account, to the capability it belongs to
+type PrincipalCapabilityResolver interface {
+	Resolve(principalId model.PrincipalId) (string, bool)
+}
+
+// staticPrincipalResolver resolves principals from the mapping in config
+type staticPrincipalResolver struct {
+	capabilities map[model.PrincipalId]string
+}
+
+func newStaticPrincipalResolver(attributionConfig config.Attribution) *staticPrincipalResolver {
+	resolver := &staticPrincipalResolver{capabilities: make(map[model.PrincipalId]string)}
+	for _, mapping := range attributionConfig.Principals {
+		resolver.capabilities[model.PrincipalId(mapping.Principal)] = mapping.Capability
+	}
+	return resolver
+}
+
+func (r *staticPrincipalResolver) Resolve(principalId model.PrincipalId) (string, bool) {
+	capability, ok := r.capabilities[principalId]
+	return capability, ok
+}
+
+// chainedPrincipalResolver asks each resolver in turn, the first one knowing the principal wins
+type chainedPrincipalResolver []PrincipalCapabilityResolver
+
+func (r chainedPrincipalResolver) Resolve(principalId model.PrincipalId) (string, bool) {
+	for _, resolver := range r {
+		if capability, ok := resolver.Resolve(principalId); ok {
+			return capability, true
+		}
+	}
+	return "", false
+}
+
+// attributeToPrincipals splits the row by each principal's share of the read bytes of the topic.
+// Rows for principals without a capability stay with the producer.
+func (e *ExporterApplication) attributeToPrincipals(row model.ExportRow, principals map[model.PrincipalId]model.MetricData) []model.ExportRow {
+	var total float64
+	for _, m := range principals {
+		total += m.Value
+	}
+	if total <= 0 {
+		return []model.ExportRow{row}
+	}
+
+	principalIds := make([]model.PrincipalId, 0, len(principals))
+	for principalId := range principals {
+		principalIds = append(principalIds, principalId)
+	}
+	sort.Slice(principalIds, func(i, j int) bool {
+		return principalIds[i] < principalIds[j]
+	})
+
+	rows := make([]model.ExportRow, 0, len(principalIds))
+	for _, principalId := range principalIds {
+		principalRow := row
+		principalRow.Cost = row.Cost * principals[principalId].Value / total
+		principalRow.PrincipalId = principalId
+		principalRow.PrincipalName = e.principalDirectory.DisplayName(principalId)
+		principalRow.ConsumerCapability = UnknownPlaceholder
+		if capability, ok := e.principalCapabilities.Resolve(principalId); ok {
+			principalRow.Capability = capability
+			principalRow.ConsumerCapability = capability
+		}
+		rows = append(rows, principalRow)
+	}
+	return rows
+}
@@ -0,0 +1,77 @@
+package application
+
+import (
+	"testing"
+
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+)
+
+func TestAttributeToPrincipals(t *testing.T) {
+	exporter := newAllocationTestExporter(t, dedicatedCluster)
+	exporter.principalCapabilities = newStaticPrincipalResolver(config.Attribution{Principals: []config.PrincipalCapability{
+		{Principal: "sa-1", Capability: "consumer-abcde"},
+		{Principal: "sa-2", Capability: "other-fghij"},
+	}})
+	row := model.ExportRow{
+		Name:               "pub.producer-klmno.topic",
+		Capability:         "producer-klmno",
+		ProducerCapability: "producer-klmno",
+		CostType:           model.CostTypeKafkaNetworkRead,
+		Cost:               12,
+	}
+
+	tests := []struct {
+		name       string
+		principals map[model.PrincipalId]model.MetricData
+		// wantCosts are the costs by principal, wantCapabilities the capabilities billed for them
+		wantCosts        map[model.PrincipalId]float64
+		wantCapabilities map[model.PrincipalId]string
+	}{
+		{
+			// the principals read 30 bytes of a topic the row billed more bytes for, the row cost is still split in full
+			name:             "shares not adding up to the topic usage",
+			principals:       map[model.PrincipalId]model.MetricData{"sa-1": {Value: 10}, "sa-2": {Value: 20}},
+			wantCosts:        map[model.PrincipalId]float64{"sa-1": 4, "sa-2": 8},
+			wantCapabilities: map[model.PrincipalId]string{"sa-1": "consumer-abcde", "sa-2": "other-fghij"},
+		},
+		{
+			name:             "principal without a capability",
+			principals:       map[model.PrincipalId]model.MetricData{"sa-1": {Value: 1}, "sa-unknown": {Value: 3}},
+			wantCosts:        map[model.PrincipalId]float64{"sa-1": 3, "sa-unknown": 9},
+			wantCapabilities: map[model.PrincipalId]string{"sa-1": "consumer-abcde", "sa-unknown": "producer-klmno"},
+		},
+		{
+			name:             "no principals",
+			wantCosts:        map[model.PrincipalId]float64{"": 12},
+			wantCapabilities: map[model.PrincipalId]string{"": "producer-klmno"},
+		},
+		{
+			name:             "principals without usage",
+			principals:       map[model.PrincipalId]model.MetricData{"sa-1": {Value: 0}},
+			wantCosts:        map[model.PrincipalId]float64{"": 12},
+			wantCapabilities: map[model.PrincipalId]string{"": "producer-klmno"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rows := exporter.attributeToPrincipals(row, test.principals)
+			if len(rows) != len(test.wantCosts) {
+				t.Fatalf("got rows %+v, want costs %v", rows, test.wantCosts)
+			}
+			for _, got := range rows {
+				assertCost(t, "cost of "+string(got.PrincipalId), got.Cost, test.wantCosts[got.PrincipalId])
+				if got.Capability != test.wantCapabilities[got.PrincipalId] {
+					t.Errorf("got capability %s for %s, want %s", got.Capability, got.PrincipalId, test.wantCapabilities[got.PrincipalId])
+				}
+				if got.ProducerCapability != "producer-klmno" {
+					t.Errorf("got producer capability %s", got.ProducerCapability)
+				}
+				if got.PrincipalId == "sa-unknown" && got.ConsumerCapability != UnknownPlaceholder {
+					t.Errorf("got consumer capability %s for a principal without a capability", got.ConsumerCapability)
+				}
+			}
+			assertCost(t, "total", sumCosts(rows, ""), row.Cost)
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package application
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+// maxCachedDays bounds the stored exports kept in memory, enough for the longest range the API reads at once
+const maxCachedDays = 31
+
+// ErrNoCostsForDay is returned when the costs of a day were neither exported nor computed yet
+var ErrNoCostsForDay = errors.New("no costs computed for day")
+
+// rowCache holds the rows of the most recently read stored exports. Exports only change when a day is
+// exported again, which forgets the day.
+type rowCache struct {
+	mu      sync.Mutex
+	maxDays int
+	rows    map[util.YearMonthDayDate][]model.ExportRow
+	// days are ordered by when they were cached, oldest first
+	days []util.YearMonthDayDate
+}
+
+func newRowCache(maxDays int) *rowCache {
+	return &rowCache{maxDays: maxDays, rows: make(map[util.YearMonthDayDate][]model.ExportRow)}
+}
+
+func (c *rowCache) get(day util.YearMonthDayDate) ([]model.ExportRow, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rows, ok := c.rows[day]
+	return rows, ok
+}
+
+func (c *rowCache) put(day util.YearMonthDayDate, rows []model.ExportRow) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.rows[day]; !ok {
+		c.days = append(c.days, day)
+	}
+	c.rows[day] = rows
+	for len(c.days) > c.maxDays {
+		delete(c.rows, c.days[0])
+		c.days = c.days[1:]
+	}
+}
+
+func (c *rowCache) forget(day util.YearMonthDayDate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.rows[day]; !ok {
+		return
+	}
+	delete(c.rows, day)
+	for i, cached := range c.days {
+		if cached == day {
+			c.days = append(c.days[:i], c.days[i+1:]...)
+			break
+		}
+	}
+}
+
+// RowsForDay returns the export rows of a day. Stored exports are read first, locally and then from s3.
+// Days that were not exported yet are built from the cached costs and usage when both are cached.
+func (e *ExporterApplication) RowsForDay(day util.YearMonthDayDate) ([]model.ExportRow, error) {
+	if rows, ok := e.storedRows.get(day); ok {
+		return rows, nil
+	}
+	rows, err := e.readStoredRows(day)
+	if err == nil {
+		e.storedRows.put(day, rows)
+		return rows, nil
+	}
+	if !errors.Is(err, ErrNoCostsForDay) {
+		return nil, err
+	}
+
+	metricsData, ok := e.gathererService.CachedMetricsForDay(day)
+	if !ok || !e.costService.HasCostsForDate(day) {
+		return nil, fmt.Errorf("%w %s", ErrNoCostsForDay, day)
+	}
+	return e.BuildRows(metricsData)
+}
+
+// readStoredRows reads the export of a day locally and then from s3, ErrNoCostsForDay is returned when neither has it
+func (e *ExporterApplication) readStoredRows(day util.YearMonthDayDate) ([]model.ExportRow, error) {
+	data, err := e.ReadCsvRaw(day)
+	if err == nil {
+		return model.ParseExportRows(bytes.NewReader(data))
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if e.s3Config.BucketName != "" && !e.dryRun {
+		data, err := e.s3Client.GetObject(e.s3Config.BucketName, s3ObjectKey(e.s3Config, day))
+		if err == nil {
+			return model.ParseExportRows(bytes.NewReader(data))
+		}
+		if !errors.Is(err, client.ErrObjectNotFound) {
+			return nil, err
+		}
+	}
+	return nil, ErrNoCostsForDay
+}
+
+// RowsForDays returns the rows of every day from from to to, both included. Days without costs are returned as missing.
+func (e *ExporterApplication) RowsForDays(from util.YearMonthDayDate, to util.YearMonthDayDate) ([]model.ExportRow, []util.YearMonthDayDate, error) {
+	var rows []model.ExportRow
+	var missing []util.YearMonthDayDate
+	for date := from.ToTimeUTC(); !date.After(to.ToTimeUTC()); date = date.AddDate(0, 0, 1) {
+		day := util.ToYearMonthDayDate(date)
+		dayRows, err := e.RowsForDay(day)
+		if errors.Is(err, ErrNoCostsForDay) {
+			missing = append(missing, day)
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read costs for %s: %w", day, err)
+		}
+		rows = append(rows, dayRows...)
+	}
+	return rows, missing, nil
+}
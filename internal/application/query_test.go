@@ -0,0 +1,103 @@
+package application
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+func TestRowCacheEvictsTheOldestDays(t *testing.T) {
+	cache := newRowCache(2)
+	days := []util.YearMonthDayDate{testDay, util.ToYearMonthDayDate(testDay.ToTimeUTC().AddDate(0, 0, 1)), util.ToYearMonthDayDate(testDay.ToTimeUTC().AddDate(0, 0, 2))}
+	for i, day := range days {
+		cache.put(day, []model.ExportRow{{Date: day, Cost: float64(i)}})
+	}
+	// putting a cached day again does not make room for another day
+	cache.put(days[2], []model.ExportRow{{Date: days[2], Cost: 3}})
+
+	if _, ok := cache.get(days[0]); ok {
+		t.Error("oldest day is still cached")
+	}
+	if rows, ok := cache.get(days[2]); !ok || rows[0].Cost != 3 {
+		t.Errorf("got rows %v, want the rows put last", rows)
+	}
+
+	cache.forget(days[1])
+	cache.forget(days[0])
+	if _, ok := cache.get(days[1]); ok {
+		t.Error("forgotten day is still cached")
+	}
+	if len(cache.days) != 1 || len(cache.rows) != 1 {
+		t.Errorf("got days %v and %d cached days, want only %s", cache.days, len(cache.rows), days[2])
+	}
+}
+
+func TestRowsForDayReadsAgainOnceTheExportChanges(t *testing.T) {
+	day := util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -3))
+	exporter, s3Server, conf := newTestExporter(t, day)
+	exporter.EnqueueExports(day, day, false)
+	foldUntil(t, exporter, conf.S3, day, ExportStateDone)
+
+	exported, err := exporter.RowsForDay(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) == 0 {
+		t.Fatal("got no rows for the exported day")
+	}
+
+	changed := fmt.Sprintf("Date,Cost,Name,ClusterId,Action,Capability\n%s,42,x,lkc-1,KAFKA_NETWORK_READ,changed-abcde\n", day.ToCSVString())
+	if err := os.WriteFile(filepath.Join(exporter.exportDir, day.ToFileNameFormat()), []byte(changed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s3Server.PutObject(conf.S3.BucketName, s3ObjectKey(conf.S3, day), []byte(changed))
+
+	// the export was changed behind the back of the exporter, the cached rows are still served
+	rows, err := exporter.RowsForDay(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(exported) || rows[0] != exported[0] {
+		t.Errorf("got rows %v, want the cached rows %v", rows, exported)
+	}
+
+	// removing the local export, as exporting the day again does, forgets the cached rows
+	if err := exporter.RemoveLocalCsv(day); err != nil {
+		t.Fatal(err)
+	}
+	rows, err = exporter.RowsForDay(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Cost != 42 || rows[0].Capability != "changed-abcde" {
+		t.Errorf("got rows %v, want the rows of the export in s3", rows)
+	}
+}
+
+func TestWriteCSVForgetsTheCachedRows(t *testing.T) {
+	day := util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -3))
+	exporter, _, conf := newTestExporter(t, day)
+	exporter.EnqueueExports(day, day, false)
+	foldUntil(t, exporter, conf.S3, day, ExportStateNeedLocalCSVExport)
+
+	exporter.storedRows.put(day, []model.ExportRow{{Date: day, Cost: 42}})
+	exporter.processesListFold(conf.S3)
+
+	if _, ok := exporter.storedRows.get(day); ok {
+		t.Fatal("rows cached before the export are still cached after it")
+	}
+	rows, err := exporter.RowsForDay(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if row.Cost == 42 {
+			t.Fatalf("got rows %v, want the rows of the new export", rows)
+		}
+	}
+}
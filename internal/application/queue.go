@@ -0,0 +1,260 @@
+package application
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+// maxFinishedProcesses bounds the finished processes kept around to be shown by the API
+const maxFinishedProcesses = 100
+
+// SinkResult is the outcome of the last attempt to write the export of a day to a sink
+type SinkResult struct {
+	Sink      string    `json:"sink"`
+	Succeeded bool      `json:"succeeded"`
+	Error     string    `json:"error,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// ExportProcessView is a copy of an export process that is safe to use outside the queue
+type ExportProcessView struct {
+	Date      util.YearMonthDayDate `json:"date"`
+	State     ExportState           `json:"state"`
+	Attempts  int                   `json:"attempts"`
+	LastError string                `json:"lastError,omitempty"`
+	Force     bool                  `json:"force"`
+	CreatedAt time.Time             `json:"createdAt"`
+	UpdatedAt time.Time             `json:"updatedAt"`
+	Sinks     []SinkResult          `json:"sinks"`
+}
+
+type EnqueueStatus string
+
+const (
+	EnqueueStatusQueued          EnqueueStatus = "queued"
+	EnqueueStatusAlreadyQueued   EnqueueStatus = "already queued"
+	EnqueueStatusAlreadyExported EnqueueStatus = "already exported"
+)
+
+type EnqueueResult struct {
+	Date   util.YearMonthDayDate `json:"date"`
+	Status EnqueueStatus         `json:"status"`
+}
+
+// exportQueue holds the export processes. The worker and the API share it, so the processes
+// and every field of them are only accessed while holding mu.
+type exportQueue struct {
+	mu        sync.Mutex
+	processes []*ExportProcess
+	// finished holds the most recently finished processes, oldest first
+	finished []*ExportProcess
+	// wake cuts the sleep of the worker short when processes are enqueued
+	wake chan struct{}
+}
+
+func newExportQueue() *exportQueue {
+	return &exportQueue{wake: make(chan struct{}, 1)}
+}
+
+// add queues the processes of days that are not queued yet, e.g. by the API while the worker was looking for work
+func (q *exportQueue) add(processes []*ExportProcess) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, process := range processes {
+		if !q.isQueued(process.dayTime) {
+			q.processes = append(q.processes, process)
+		}
+	}
+}
+
+// addFinished keeps the processes as finished, e.g. the ones restored from a previous run
+func (q *exportQueue) addFinished(processes []*ExportProcess) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.finished = append(q.finished, processes...)
+	if len(q.finished) > maxFinishedProcesses {
+		q.finished = q.finished[len(q.finished)-maxFinishedProcesses:]
+	}
+}
+
+// ongoing returns the processes that are not finished yet
+func (q *exportQueue) ongoing() []*ExportProcess {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]*ExportProcess(nil), q.processes...)
+}
+
+// retireDone moves the finished processes out of the ongoing processes
+func (q *exportQueue) retireDone() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ongoing := q.processes[:0]
+	for _, process := range q.processes {
+		if process.currentState.isFinished() {
+			q.finished = append(q.finished, process)
+			continue
+		}
+		ongoing = append(ongoing, process)
+	}
+	q.processes = ongoing
+	if len(q.finished) > maxFinishedProcesses {
+		q.finished = q.finished[len(q.finished)-maxFinishedProcesses:]
+	}
+}
+
+// find returns the ongoing process of the day, or else the one that finished last. Call it holding mu.
+func (q *exportQueue) find(day util.YearMonthDayDate) (*ExportProcess, bool) {
+	for _, process := range q.processes {
+		if process.dayTime == day {
+			return process, true
+		}
+	}
+	for i := len(q.finished) - 1; i >= 0; i-- {
+		if q.finished[i].dayTime == day {
+			return q.finished[i], true
+		}
+	}
+	return nil, false
+}
+
+func (q *exportQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// view copies the process, call it holding mu
+func (p *ExportProcess) view() ExportProcessView {
+	sinks := make([]SinkResult, 0, len(p.sinks))
+	for _, result := range p.sinks {
+		sinks = append(sinks, result)
+	}
+	sort.Slice(sinks, func(i, j int) bool {
+		return sinks[i].Sink < sinks[j].Sink
+	})
+	return ExportProcessView{
+		Date:      p.dayTime,
+		State:     p.currentState,
+		Attempts:  p.attempts,
+		LastError: p.lastError,
+		Force:     p.force,
+		CreatedAt: p.createdAt,
+		UpdatedAt: p.updatedAt,
+		Sinks:     sinks,
+	}
+}
+
+// setSinkResult records the outcome of writing to a sink, call it holding mu
+func (p *ExportProcess) setSinkResult(sink string, err error) {
+	if p.sinks == nil {
+		p.sinks = make(map[string]SinkResult)
+	}
+	result := SinkResult{Sink: sink, Succeeded: err == nil, At: time.Now().UTC()}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	p.sinks[sink] = result
+}
+
+// ExportProcesses returns the ongoing and the recently finished processes, ordered by date.
+// Only the latest process of a day is returned.
+func (e *ExporterApplication) ExportProcesses() []ExportProcessView {
+	e.queue.mu.Lock()
+	defer e.queue.mu.Unlock()
+
+	latest := make(map[util.YearMonthDayDate]*ExportProcess)
+	for _, process := range e.queue.finished {
+		latest[process.dayTime] = process
+	}
+	for _, process := range e.queue.processes {
+		latest[process.dayTime] = process
+	}
+	views := make([]ExportProcessView, 0, len(latest))
+	for _, process := range latest {
+		views = append(views, process.view())
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].Date.ToTimeUTC().Before(views[j].Date.ToTimeUTC())
+	})
+	return views
+}
+
+// ExportProcessForDay returns the ongoing process of the day, or the one that finished last
+func (e *ExporterApplication) ExportProcessForDay(day util.YearMonthDayDate) (ExportProcessView, bool) {
+	e.queue.mu.Lock()
+	defer e.queue.mu.Unlock()
+	process, ok := e.queue.find(day)
+	if !ok {
+		return ExportProcessView{}, false
+	}
+	return process.view(), true
+}
+
+// EnqueueExports queues an export for every day from from to to, both included, and wakes the worker up.
+// Days already queued are left alone, days already exported are only queued again when forced.
+func (e *ExporterApplication) EnqueueExports(from util.YearMonthDayDate, to util.YearMonthDayDate, force bool) []EnqueueResult {
+	var results []EnqueueResult
+	for date := from.ToTimeUTC(); !date.After(to.ToTimeUTC()); date = date.AddDate(0, 0, 1) {
+		day := util.ToYearMonthDayDate(date)
+		if !force && e.isExported(day) {
+			results = append(results, EnqueueResult{Date: day, Status: EnqueueStatusAlreadyExported})
+			continue
+		}
+
+		e.queue.mu.Lock()
+		if e.queue.isQueued(day) {
+			e.queue.mu.Unlock()
+			results = append(results, EnqueueResult{Date: day, Status: EnqueueStatusAlreadyQueued})
+			continue
+		}
+		process := newExportProcess(day)
+		process.force = force
+		e.queue.processes = append(e.queue.processes, process)
+		reportProcess(process)
+		e.queue.mu.Unlock()
+
+		log.Infof("queued export of %s, force: %t", day, force)
+		results = append(results, EnqueueResult{Date: day, Status: EnqueueStatusQueued})
+	}
+	e.queue.notify()
+	return results
+}
+
+// isQueued reports whether the day has an ongoing process, call it holding mu
+func (q *exportQueue) isQueued(day util.YearMonthDayDate) bool {
+	for _, process := range q.processes {
+		if process.dayTime == day {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFailed reports whether the last export of the day gave up on rejected credentials
+func (e *ExporterApplication) hasFailed(day util.YearMonthDayDate) bool {
+	e.queue.mu.Lock()
+	defer e.queue.mu.Unlock()
+	process, ok := e.queue.find(day)
+	return ok && process.currentState == ExportStateFailed
+}
+
+// isExported reports whether the export of the day is stored locally or in s3
+func (e *ExporterApplication) isExported(day util.YearMonthDayDate) bool {
+	if e.HasExportedDataForDay(day) {
+		return true
+	}
+	if e.s3Config.BucketName == "" || e.dryRun {
+		return false
+	}
+	exported, err := e.s3Client.HeadObject(e.s3Config.BucketName, s3ObjectKey(e.s3Config, day))
+	if err != nil {
+		log.Errorf("unable to check s3 for the export of %s: %s", day, err)
+		return false
+	}
+	return exported
+}
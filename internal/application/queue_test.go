@@ -0,0 +1,63 @@
+package application
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+func TestEnqueueExportsConcurrently(t *testing.T) {
+	last := util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -1))
+	first := util.ToYearMonthDayDate(last.ToTimeUTC().AddDate(0, 0, -4))
+	exporter, _, conf := newTestExporter(t, last)
+
+	const callers = 8
+	results := make([][]EnqueueResult, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = exporter.EnqueueExports(first, last, false)
+		}(i)
+	}
+	// the API reads the queue and the worker works through it while days are queued
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < callers; i++ {
+			exporter.ExportProcesses()
+			exporter.ExportProcessForDay(last)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		exporter.processesListFold(conf.S3)
+	}()
+	wg.Wait()
+
+	queued := make(map[util.YearMonthDayDate]int)
+	for _, callerResults := range results {
+		if len(callerResults) != 5 {
+			t.Fatalf("got %d results, want one per day", len(callerResults))
+		}
+		for _, result := range callerResults {
+			if result.Status == EnqueueStatusQueued {
+				queued[result.Date]++
+			}
+		}
+	}
+	for date := first.ToTimeUTC(); !date.After(last.ToTimeUTC()); date = date.AddDate(0, 0, 1) {
+		if day := util.ToYearMonthDayDate(date); queued[day] != 1 {
+			t.Errorf("%s was queued %d times, want once", day, queued[day])
+		}
+	}
+	if processes := exporter.ExportProcesses(); len(processes) != 5 {
+		t.Errorf("got %d processes, want one per day", len(processes))
+	}
+	if ongoing := exporter.queue.ongoing(); len(ongoing) != 5 {
+		t.Errorf("got %d ongoing processes, want one per day", len(ongoing))
+	}
+}
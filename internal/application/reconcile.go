@@ -0,0 +1,110 @@
+package application
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2/log"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+	"math"
+)
+
+const UnallocatedPlaceholder = "_UNALLOCATED"
+
+// residualEpsilon ignores residuals caused by float rounding alone
+const residualEpsilon = 0.000001
+
+type reconciliationResult struct {
+	clusterId    model.ClusterId
+	costType     model.CostType
+	allocated    float64
+	billed       float64
+	residual     float64
+	driftPercent float64
+}
+
+// reconciledCostType is a cost type allocated to topics, with the action used for its rows
+type reconciledCostType struct {
+	costType model.CostType
+	action   string
+	// mayBeUnallocated is set for cost types deliberately left unallocated when their usage is unknown,
+	// their residual is exported but never counted as drift
+	mayBeUnallocated bool
+}
+
+func (e *ExporterApplication) reconciledCostTypes() []reconciledCostType {
+	var costTypes []reconciledCostType
+	for _, metricKey := range kafkaUsageMetrics {
+		costTypes = append(costTypes, reconciledCostType{costType: metricKey.ToConfluentCostType(), action: metricKey.ToCsvFormatString()})
+	}
+	if e.allocatePartitions {
+		// partition costs are left unallocated when partitions can not be counted, see GathererService.GetMetricsForDay
+		costTypes = append(costTypes, reconciledCostType{costType: model.CostTypeKafkaPartition, action: PartitionsAction, mayBeUnallocated: true})
+	}
+	return costTypes
+}
+
+// Reconcile compares the cost allocated to topics with the billed cost per cluster and usage cost type.
+// A row carrying the residual is added for every mismatch, and an error is returned when any drift exceeds the configured tolerance.
+// Cost types that may be left unallocated only get the residual row.
+func (e *ExporterApplication) Reconcile(rows []model.ExportRow, date util.YearMonthDayDate) ([]model.ExportRow, error) {
+	allocated := make(map[string]map[model.CostType]float64)
+	for _, row := range rows {
+		if _, ok := allocated[row.ClusterId]; !ok {
+			allocated[row.ClusterId] = make(map[model.CostType]float64)
+		}
+		allocated[row.ClusterId][row.CostType] += row.Cost
+	}
+
+	var exceeded []reconciliationResult
+	for _, clusterId := range e.clusterRegistry.ClusterIds() {
+		for _, reconciled := range e.reconciledCostTypes() {
+			costType := reconciled.costType
+			cost, err := e.costService.GetKafkaCosts(date, clusterId, costType)
+			if err != nil {
+				continue
+			}
+
+			result := reconciliationResult{
+				clusterId: clusterId,
+				costType:  costType,
+				allocated: allocated[string(clusterId)][costType],
+				billed:    cost.TotalCost,
+			}
+			result.residual = result.billed - result.allocated
+			if math.Abs(result.residual) < residualEpsilon {
+				continue
+			}
+			result.driftPercent = 100
+			if result.billed != 0 {
+				result.driftPercent = math.Abs(result.residual) / math.Abs(result.billed) * 100
+			}
+
+			log.Infof("%s %s on %s: allocated %f of %f billed, drift %.2f%%", date, costType, clusterId, result.allocated, result.billed, result.driftPercent)
+			rows = append(rows, model.ExportRow{
+				Date:       date,
+				Cost:       result.residual,
+				Name:       UnallocatedPlaceholder,
+				ClusterId:  string(clusterId),
+				Action:     reconciled.action,
+				Capability: UnallocatedPlaceholder,
+				CostType:   costType,
+			})
+
+			if e.maxDriftPercent > 0 && result.driftPercent > e.maxDriftPercent && !reconciled.mayBeUnallocated {
+				exceeded = append(exceeded, result)
+			}
+		}
+	}
+
+	if len(exceeded) > 0 {
+		worst := exceeded[0]
+		for _, result := range exceeded {
+			if result.driftPercent > worst.driftPercent {
+				worst = result
+			}
+		}
+		return rows, fmt.Errorf("allocated costs drift from the invoice for %d cluster and cost type combinations, worst is %s %s with %.2f%% (allocated %f, billed %f), tolerance is %.2f%%",
+			len(exceeded), worst.clusterId, worst.costType, worst.driftPercent, worst.allocated, worst.billed, e.maxDriftPercent)
+	}
+	return rows, nil
+}
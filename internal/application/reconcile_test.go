@@ -0,0 +1,101 @@
+package application
+
+import (
+	"strings"
+	"testing"
+
+	"go.dfds.cloud/ccc-exporter/internal/model"
+)
+
+func TestReconcile(t *testing.T) {
+	lines := []model.ConfluentCostLine{
+		bill("lkc-1", model.CostTypeKafkaNetworkRead, model.GB, 10),
+		bill("lkc-1", model.CostTypeKafkaStorage, model.GBHour, 20),
+		bill("lkc-1", model.CostTypeKafkaPartition, model.PartitionHour, 30),
+	}
+	tests := []struct {
+		name            string
+		rows            []model.ExportRow
+		maxDriftPercent float64
+		// wantResiduals are the costs of the _UNALLOCATED rows by cost type
+		wantResiduals map[model.CostType]float64
+		wantErr       string
+	}{
+		{
+			name: "fully allocated",
+			rows: []model.ExportRow{
+				{ClusterId: "lkc-1", CostType: model.CostTypeKafkaNetworkRead, Cost: 4},
+				{ClusterId: "lkc-1", CostType: model.CostTypeKafkaNetworkRead, Cost: 6},
+				{ClusterId: "lkc-1", CostType: model.CostTypeKafkaStorage, Cost: 20},
+				{ClusterId: "lkc-1", CostType: model.CostTypeKafkaPartition, Cost: 30},
+			},
+			maxDriftPercent: 1,
+			wantResiduals:   map[model.CostType]float64{},
+		},
+		{
+			name: "drift within the tolerance",
+			rows: []model.ExportRow{
+				{ClusterId: "lkc-1", CostType: model.CostTypeKafkaNetworkRead, Cost: 9.95},
+				{ClusterId: "lkc-1", CostType: model.CostTypeKafkaStorage, Cost: 20.1},
+				{ClusterId: "lkc-1", CostType: model.CostTypeKafkaPartition, Cost: 30},
+			},
+			maxDriftPercent: 1,
+			wantResiduals:   map[model.CostType]float64{model.CostTypeKafkaNetworkRead: 0.05, model.CostTypeKafkaStorage: -0.1},
+		},
+		{
+			name: "drift above the tolerance",
+			rows: []model.ExportRow{
+				{ClusterId: "lkc-1", CostType: model.CostTypeKafkaNetworkRead, Cost: 5},
+				{ClusterId: "lkc-1", CostType: model.CostTypeKafkaStorage, Cost: 20},
+				{ClusterId: "lkc-1", CostType: model.CostTypeKafkaPartition, Cost: 30},
+			},
+			maxDriftPercent: 1,
+			wantResiduals:   map[model.CostType]float64{model.CostTypeKafkaNetworkRead: 5},
+			wantErr:         "KAFKA_NETWORK_READ with 50.00%",
+		},
+		{
+			name: "drift without a tolerance",
+			rows: []model.ExportRow{
+				{ClusterId: "lkc-1", CostType: model.CostTypeKafkaStorage, Cost: 20},
+			},
+			wantResiduals: map[model.CostType]float64{model.CostTypeKafkaNetworkRead: 10, model.CostTypeKafkaPartition: 30},
+		},
+		{
+			name: "unallocated partitions are not drift",
+			rows: []model.ExportRow{
+				{ClusterId: "lkc-1", CostType: model.CostTypeKafkaNetworkRead, Cost: 10},
+				{ClusterId: "lkc-1", CostType: model.CostTypeKafkaStorage, Cost: 20},
+			},
+			maxDriftPercent: 1,
+			wantResiduals:   map[model.CostType]float64{model.CostTypeKafkaPartition: 30},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exporter := newAllocationTestExporter(t, dedicatedCluster, lines...)
+			exporter.allocatePartitions = true
+			exporter.maxDriftPercent = test.maxDriftPercent
+
+			rows, err := exporter.Reconcile(test.rows, testDay)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+			}
+
+			residuals := rows[len(test.rows):]
+			if len(residuals) != len(test.wantResiduals) {
+				t.Fatalf("got residual rows %+v, want %v", residuals, test.wantResiduals)
+			}
+			for _, row := range residuals {
+				if row.Name != UnallocatedPlaceholder || row.Capability != UnallocatedPlaceholder || row.ClusterId != "lkc-1" {
+					t.Errorf("got residual row %+v", row)
+				}
+				assertCost(t, "residual of "+string(row.CostType), row.Cost, test.wantResiduals[row.CostType])
+			}
+			// with the residuals every billed cost is accounted for
+			assertCost(t, "total", sumCosts(rows, ""), 60)
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package application
+
+import (
+	"github.com/gofiber/fiber/v2/log"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/store"
+	"go.dfds.cloud/ccc-exporter/internal/telemetry"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+// saveState saves the ongoing processes with the costs and usage their next steps need, and the finished processes
+// so days that failed stay failed after a restart
+func (e *ExporterApplication) saveState() {
+	e.queue.mu.Lock()
+	var records []store.ExportProcessRecord
+	for _, process := range e.queue.finished {
+		records = append(records, process.record())
+	}
+	var ongoing []store.ExportProcessRecord
+	for _, process := range e.queue.processes {
+		ongoing = append(ongoing, process.record())
+	}
+	e.queue.mu.Unlock()
+
+	for _, record := range ongoing {
+		state := ExportState(record.State)
+		if state == ExportStateNeedPrometheusUsageData || state == ExportStateNeedLocalCSVExport {
+			record.Costs, _ = e.costService.CachedCostLines(record.Date)
+		}
+		if state == ExportStateNeedLocalCSVExport {
+			if usage, ok := e.gathererService.CachedMetricsForDay(record.Date); ok {
+				record.Usage = &usage
+			}
+		}
+		records = append(records, record)
+	}
+
+	if err := e.stateStore.Save(records); err != nil {
+		log.Errorf("unable to save export state: %s", err)
+	}
+}
+
+// record copies the process without its stage data, call it holding mu
+func (p *ExportProcess) record() store.ExportProcessRecord {
+	return store.ExportProcessRecord{
+		Date:      p.dayTime,
+		State:     string(p.currentState),
+		Attempts:  p.attempts,
+		LastError: p.lastError,
+		Force:     p.force,
+		CreatedAt: p.createdAt,
+		UpdatedAt: p.updatedAt,
+	}
+}
+
+// restoreState loads the processes saved by a previous run. Ongoing processes resume in their saved state
+// with the costs and usage saved along, and go back to the first step whose data is missing.
+func (e *ExporterApplication) restoreState() {
+	records, err := e.stateStore.Load()
+	if err != nil {
+		log.Errorf("unable to load export state, starting from scratch: %s", err)
+		return
+	}
+
+	var processes []*ExportProcess
+	var finished []*ExportProcess
+	for _, record := range records {
+		process := &ExportProcess{
+			dayTime:      record.Date,
+			currentState: ExportState(record.State),
+			attempts:     record.Attempts,
+			lastError:    record.LastError,
+			force:        record.Force,
+			createdAt:    record.CreatedAt,
+			updatedAt:    record.UpdatedAt,
+		}
+		if process.currentState.isFinished() {
+			reportProcess(process)
+			finished = append(finished, process)
+			continue
+		}
+
+		if record.Costs != nil {
+			e.costService.CacheCosts(record.Date, model.ConfluentCostResponse{Data: record.Costs})
+		}
+		if record.Usage != nil {
+			e.gathererService.CacheMetricsForDay(*record.Usage)
+		}
+		process.currentState = e.resumableState(process.dayTime, process.currentState)
+		log.Infof("resuming export of %s in state %s after %d failed attempts", process.dayTime, process.currentState, process.attempts)
+		reportProcess(process)
+		processes = append(processes, process)
+	}
+	e.queue.addFinished(finished)
+	e.queue.add(processes)
+	e.reportProcesses()
+}
+
+// resumableState is the saved state when the data the step needs is there, or else the state of the step fetching it
+func (e *ExporterApplication) resumableState(day util.YearMonthDayDate, state ExportState) ExportState {
+	hasCosts := e.costService.HasCostsForDate(day)
+	_, hasUsage := e.gathererService.CachedMetricsForDay(day)
+	switch {
+	case state == ExportStateNeedToPutCSVInS3 && e.HasExportedDataForDay(day):
+		return state
+	case state == ExportStateNeedToPutCSVInS3 || state == ExportStateNeedLocalCSVExport:
+		if hasCosts && hasUsage {
+			return ExportStateNeedLocalCSVExport
+		}
+		if hasCosts {
+			return ExportStateNeedPrometheusUsageData
+		}
+	case state == ExportStateNeedPrometheusUsageData && hasCosts:
+		return state
+	}
+	return ExportStateNeedCosts
+}
+
+// reportProcesses publishes the number of ongoing processes in each state on /metrics
+func (e *ExporterApplication) reportProcesses() {
+	e.queue.mu.Lock()
+	counts := make(map[ExportState]int)
+	for _, process := range e.queue.processes {
+		counts[process.currentState]++
+	}
+	e.queue.mu.Unlock()
+
+	for _, state := range exportStates {
+		telemetry.ExportProcesses.WithLabelValues(string(state)).Set(float64(counts[state]))
+	}
+}
+
+func reportProcess(process *ExportProcess) {
+	reportDayState(process.dayTime, process.currentState)
+	telemetry.ExportDayAttempts.WithLabelValues(process.dayTime.String()).Set(float64(process.attempts))
+}
+
+// reportDayState publishes the state of the export of a day, replacing the state reported before
+func reportDayState(date util.YearMonthDayDate, state ExportState) {
+	telemetry.ExportDayState.DeletePartialMatch(map[string]string{"date": date.String()})
+	telemetry.ExportDayState.WithLabelValues(date.String(), string(state)).Set(1)
+}
@@ -0,0 +1,121 @@
+package application
+
+import (
+	"testing"
+	"time"
+
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/service"
+	"go.dfds.cloud/ccc-exporter/internal/store"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+// foldUntil runs the worker steps until the export of day reaches state
+func foldUntil(t *testing.T, exporter *ExporterApplication, s3Config config.S3, day util.YearMonthDayDate, state ExportState) {
+	t.Helper()
+	for i := 0; i < len(exportStates); i++ {
+		if process, _ := exporter.ExportProcessForDay(day); process.State == state {
+			return
+		}
+		exporter.processesListFold(s3Config)
+	}
+	process, _ := exporter.ExportProcessForDay(day)
+	t.Fatalf("export of %s is in state %s, want %s", day, process.State, state)
+}
+
+func TestRestoreStateResumesWithTheSavedCostsAndUsage(t *testing.T) {
+	day := util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -3))
+	stateStore := store.NewMemoryStore()
+
+	exporter, s3Server, conf := newTestExporter(t, day)
+	exporter.stateStore = stateStore
+	exporter.EnqueueExports(day, day, false)
+	foldUntil(t, exporter, conf.S3, day, ExportStateNeedLocalCSVExport)
+
+	// a restarted worker starts without any cached data and has no way to fetch costs or usage again
+	restarted := *exporter
+	restarted.queue = newExportQueue()
+	restarted.costService = service.NewConfluentCostService(nil, exporter.clusterRegistry, false)
+	restarted.gathererService = service.NewGatherer(nil, exporter.clusterRegistry, service.GathererOptions{})
+	restarted.restoreState()
+
+	process, ok := restarted.ExportProcessForDay(day)
+	if !ok || process.State != ExportStateNeedLocalCSVExport {
+		t.Fatalf("got process %+v, want it to resume in %s", process, ExportStateNeedLocalCSVExport)
+	}
+	if !restarted.costService.HasCostsForDate(day) {
+		t.Error("costs were not restored")
+	}
+	if _, ok := restarted.gathererService.CachedMetricsForDay(day); !ok {
+		t.Error("usage was not restored")
+	}
+
+	foldUntil(t, &restarted, conf.S3, day, ExportStateDone)
+	if _, ok := s3Server.Object(conf.S3.BucketName, s3ObjectKey(conf.S3, day)); !ok {
+		t.Error("export was not put in s3")
+	}
+}
+
+func TestRestoreStateKeepsFailedDaysFailed(t *testing.T) {
+	day := util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -1))
+	exporter, _, conf := newTestExporter(t, day)
+	err := exporter.stateStore.Save([]store.ExportProcessRecord{
+		{Date: day, State: string(ExportStateFailed), Attempts: 1, LastError: "unauthorized"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exporter.restoreState()
+	exporter.SetupProcesses(config.Worker{DaysToLookBack: 1}, conf.S3)
+
+	if ongoing := exporter.queue.ongoing(); len(ongoing) != 0 {
+		t.Errorf("got %d ongoing processes, want the failed day to be left alone", len(ongoing))
+	}
+	process, ok := exporter.ExportProcessForDay(day)
+	if !ok || process.State != ExportStateFailed || process.LastError != "unauthorized" {
+		t.Errorf("got process %+v, want the failed one", process)
+	}
+
+	// saving again keeps the failed day for the next restart
+	exporter.saveState()
+	records, err := exporter.stateStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].State != string(ExportStateFailed) {
+		t.Errorf("got records %+v, want the failed day", records)
+	}
+}
+
+func TestRestoreStateGoesBackToTheStepFetchingMissingData(t *testing.T) {
+	day := util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, -3))
+	costs := []model.ConfluentCostLine{costLine("KAFKA_NETWORK_READ", 10, 0.05, "GB", "2024-03-01")}
+	tests := []struct {
+		name      string
+		record    store.ExportProcessRecord
+		wantState ExportState
+	}{
+		{name: "upload without csv", record: store.ExportProcessRecord{State: string(ExportStateNeedToPutCSVInS3)}, wantState: ExportStateNeedCosts},
+		{name: "csv export without data", record: store.ExportProcessRecord{State: string(ExportStateNeedLocalCSVExport)}, wantState: ExportStateNeedCosts},
+		{name: "csv export without usage", record: store.ExportProcessRecord{State: string(ExportStateNeedLocalCSVExport), Costs: costs}, wantState: ExportStateNeedPrometheusUsageData},
+		{name: "usage with costs", record: store.ExportProcessRecord{State: string(ExportStateNeedPrometheusUsageData), Costs: costs}, wantState: ExportStateNeedPrometheusUsageData},
+		{name: "usage without costs", record: store.ExportProcessRecord{State: string(ExportStateNeedPrometheusUsageData)}, wantState: ExportStateNeedCosts},
+		{name: "unknown state", record: store.ExportProcessRecord{State: "NEED_COFFEE"}, wantState: ExportStateNeedCosts},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exporter, _, _ := newTestExporter(t, day)
+			test.record.Date = day
+			if err := exporter.stateStore.Save([]store.ExportProcessRecord{test.record}); err != nil {
+				t.Fatal(err)
+			}
+
+			exporter.restoreState()
+			if process, _ := exporter.ExportProcessForDay(day); process.State != test.wantState {
+				t.Errorf("got state %s, want %s", process.State, test.wantState)
+			}
+		})
+	}
+}
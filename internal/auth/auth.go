@@ -0,0 +1,133 @@
+// Package auth authenticates requests to the API and the admin listener with bearer tokens
+// and checks the scopes granted to them
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/telemetry"
+)
+
+// Scopes routes require
+const (
+	// ScopeCostsRead allows reading the computed costs
+	ScopeCostsRead = "costs:read"
+	// ScopeExportsRead allows following the progress of exports
+	ScopeExportsRead = "exports:read"
+	// ScopeExportsWrite allows queueing exports and backfills
+	ScopeExportsWrite = "exports:write"
+	// ScopeProfiling allows reading the pprof profiles
+	ScopeProfiling = "debug:pprof"
+)
+
+// AllScopes lists every scope, granting * in the token file grants all of them
+var AllScopes = []string{ScopeCostsRead, ScopeExportsRead, ScopeExportsWrite, ScopeProfiling}
+
+type Mode string
+
+const (
+	ModeNone  Mode = "none"
+	ModeToken Mode = "token"
+	ModeOidc  Mode = "oidc"
+)
+
+// principalKey is the fiber local the principal of an authenticated request is stored under
+const principalKey = "principal"
+
+// Principal is the caller a token belongs to
+type Principal struct {
+	Name   string
+	Scopes map[string]bool
+}
+
+// Verifier turns a bearer token into the principal it belongs to
+type Verifier interface {
+	Verify(ctx context.Context, token string) (Principal, error)
+	// Refresh reads the tokens or keys again
+	Refresh(ctx context.Context) error
+}
+
+// Authenticator guards routes with the configured verifier, every request is let through in mode none
+type Authenticator struct {
+	mode     Mode
+	verifier Verifier
+}
+
+func NewAuthenticator(authConfig config.Auth) (*Authenticator, error) {
+	switch mode := Mode(authConfig.Mode); mode {
+	case ModeNone:
+		return &Authenticator{mode: mode}, nil
+	case ModeToken:
+		if authConfig.TokenFile == "" {
+			return nil, errors.New("auth mode token needs a token file")
+		}
+		return &Authenticator{mode: mode, verifier: NewTokenFileVerifier(authConfig.TokenFile)}, nil
+	case ModeOidc:
+		oidcConfig := authConfig.Oidc
+		if oidcConfig.JwksUrl == "" || oidcConfig.Issuer == "" || oidcConfig.Audience == "" {
+			return nil, errors.New("auth mode oidc needs a JWKS url, an issuer and an audience")
+		}
+		return &Authenticator{mode: mode, verifier: NewOidcVerifier(client.NewJwksClient(oidcConfig), oidcConfig)}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth mode %s, expected none, token or oidc", authConfig.Mode)
+	}
+}
+
+func (a *Authenticator) Mode() Mode {
+	return a.mode
+}
+
+// Refresh reads the tokens or keys of the verifier, e.g. to check the configuration
+func (a *Authenticator) Refresh(ctx context.Context) error {
+	if a.verifier == nil {
+		return nil
+	}
+	return a.verifier.Refresh(ctx)
+}
+
+// Require lets requests through whose bearer token grants scope. Requests without a valid token
+// are answered with 401, requests with a token lacking the scope with 403.
+func (a *Authenticator) Require(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if a.verifier == nil {
+			return c.Next()
+		}
+
+		token, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !found || token == "" {
+			return deny(c, fiber.StatusUnauthorized, scope, "missing_token", `Bearer realm="ccc-exporter"`)
+		}
+		principal, err := a.verifier.Verify(c.UserContext(), token)
+		if err != nil {
+			log.Warn().Err(err).Msgf("rejected token for %s %s", c.Method(), c.Path())
+			return deny(c, fiber.StatusUnauthorized, scope, "invalid_token", `Bearer realm="ccc-exporter", error="invalid_token"`)
+		}
+		if !principal.Scopes[scope] {
+			log.Warn().Msgf("%s lacks scope %s for %s %s", principal.Name, scope, c.Method(), c.Path())
+			return deny(c, fiber.StatusForbidden, scope, "insufficient_scope",
+				fmt.Sprintf(`Bearer realm="ccc-exporter", error="insufficient_scope", scope="%s"`, scope))
+		}
+
+		c.Locals(principalKey, principal)
+		return c.Next()
+	}
+}
+
+// PrincipalOf returns the principal of an authenticated request
+func PrincipalOf(c *fiber.Ctx) (Principal, bool) {
+	principal, ok := c.Locals(principalKey).(Principal)
+	return principal, ok
+}
+
+func deny(c *fiber.Ctx, status int, scope string, reason string, challenge string) error {
+	telemetry.AuthDenied.WithLabelValues(reason, scope).Inc()
+	c.Set(fiber.HeaderWWWAuthenticate, challenge)
+	return c.Status(status).JSON(fiber.Map{"error": strings.ReplaceAll(reason, "_", " ")})
+}
@@ -0,0 +1,408 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+)
+
+// minKeyRefreshInterval bounds how often tokens signed by unknown keys make the keys be read again
+const minKeyRefreshInterval = 30 * time.Second
+
+// signingAlgorithm is a JWS algorithm, HMAC and none are never accepted
+type signingAlgorithm struct {
+	hash crypto.Hash
+	// curve is set for ECDSA, pss tells RSASSA-PSS from RSASSA-PKCS1-v1_5
+	curve elliptic.Curve
+	pss   bool
+}
+
+var signingAlgorithms = map[string]signingAlgorithm{
+	"RS256": {hash: crypto.SHA256},
+	"RS384": {hash: crypto.SHA384},
+	"RS512": {hash: crypto.SHA512},
+	"PS256": {hash: crypto.SHA256, pss: true},
+	"PS384": {hash: crypto.SHA384, pss: true},
+	"PS512": {hash: crypto.SHA512, pss: true},
+	"ES256": {hash: crypto.SHA256, curve: elliptic.P256()},
+	"ES384": {hash: crypto.SHA384, curve: elliptic.P384()},
+	"ES512": {hash: crypto.SHA512, curve: elliptic.P521()},
+}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+type signingKey struct {
+	id string
+	// alg restricts the key to one algorithm when the JWKS names one
+	alg string
+	key crypto.PublicKey
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// OidcVerifier accepts JWTs signed by the keys served at the JWKS URL of an OIDC provider. The keys are
+// cached for the refresh interval, and read again early when a token is signed by an unknown key.
+type OidcVerifier struct {
+	jwksClient      *client.JwksClient
+	config          config.Oidc
+	refreshInterval time.Duration
+	leeway          time.Duration
+
+	// minRefreshInterval keeps tokens naming unknown keys from making the keys be read on every request
+	minRefreshInterval time.Duration
+
+	mu            sync.RWMutex
+	keys          []signingKey
+	refreshedAt   time.Time
+	lastAttemptAt time.Time
+	// refreshing is closed once the keys being read right now are stored, it is nil while no read is going on
+	refreshing chan struct{}
+}
+
+func NewOidcVerifier(jwksClient *client.JwksClient, oidcConfig config.Oidc) *OidcVerifier {
+	return &OidcVerifier{
+		jwksClient:      jwksClient,
+		config:          oidcConfig,
+		refreshInterval: time.Duration(oidcConfig.RefreshIntervalSeconds) * time.Second,
+		leeway:          time.Duration(oidcConfig.LeewaySeconds) * time.Second,
+
+		minRefreshInterval: minKeyRefreshInterval,
+	}
+}
+
+func (v *OidcVerifier) Verify(ctx context.Context, token string) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, errors.New("token is not a JWT")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Principal{}, fmt.Errorf("invalid JWT header: %w", err)
+	}
+	algorithm, ok := signingAlgorithms[header.Alg]
+	if !ok {
+		return Principal{}, fmt.Errorf("unsupported JWT algorithm %s", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, fmt.Errorf("invalid JWT signature: %w", err)
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return Principal{}, err
+	}
+	if key.alg != "" && key.alg != header.Alg {
+		return Principal{}, fmt.Errorf("key %s is not used with %s", key.id, header.Alg)
+	}
+	if err := verifySignature(algorithm, key.key, parts[0]+"."+parts[1], signature); err != nil {
+		return Principal{}, err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Principal{}, fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return Principal{}, err
+	}
+
+	var rawClaims map[string]json.RawMessage
+	if err := decodeSegment(parts[1], &rawClaims); err != nil {
+		return Principal{}, fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	principal := Principal{Name: claims.Subject, Scopes: make(map[string]bool)}
+	if raw, ok := rawClaims[v.config.ScopeClaim]; ok {
+		scopes, err := stringList(raw, true)
+		if err != nil {
+			return Principal{}, fmt.Errorf("invalid %s claim: %w", v.config.ScopeClaim, err)
+		}
+		for _, scope := range scopes {
+			principal.Scopes[scope] = true
+		}
+	}
+	return principal, nil
+}
+
+func (v *OidcVerifier) checkClaims(claims jwtClaims) error {
+	now := time.Now()
+	if claims.ExpiresAt == nil {
+		return errors.New("JWT has no exp claim")
+	}
+	if now.After(time.Unix(int64(*claims.ExpiresAt), 0).Add(v.leeway)) {
+		return errors.New("JWT is expired")
+	}
+	if claims.NotBefore != nil && now.Add(v.leeway).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return errors.New("JWT is not valid yet")
+	}
+	if claims.Issuer != v.config.Issuer {
+		return fmt.Errorf("JWT issued by %s, expected %s", claims.Issuer, v.config.Issuer)
+	}
+	audiences, err := stringList(claims.Audience, false)
+	if err != nil {
+		return fmt.Errorf("invalid aud claim: %w", err)
+	}
+	for _, audience := range audiences {
+		if audience == v.config.Audience {
+			return nil
+		}
+	}
+	return fmt.Errorf("JWT is not meant for audience %s", v.config.Audience)
+}
+
+// key returns the key the token was signed with, a token without kid may only be signed by the only key.
+// Known keys are used straight away, expired keys are read again in the background. Tokens signed by
+// unknown keys wait for the keys to be read again, at most once per minRefreshInterval.
+func (v *OidcVerifier) key(ctx context.Context, kid string) (signingKey, error) {
+	v.mu.RLock()
+	key, found := v.findKey(kid)
+	expired := time.Since(v.refreshedAt) >= v.refreshInterval
+	v.mu.RUnlock()
+
+	if found {
+		if expired {
+			go v.refreshIfDue(context.Background())
+		}
+		return key, nil
+	}
+
+	v.refreshIfDue(ctx)
+	v.mu.RLock()
+	key, found = v.findKey(kid)
+	v.mu.RUnlock()
+	if !found {
+		return key, fmt.Errorf("JWT signed by unknown key %s", kid)
+	}
+	return key, nil
+}
+
+// findKey looks the key up, call it holding mu
+func (v *OidcVerifier) findKey(kid string) (signingKey, bool) {
+	if kid == "" {
+		if len(v.keys) == 1 {
+			return v.keys[0], true
+		}
+		return signingKey{}, false
+	}
+	for _, key := range v.keys {
+		if key.id == kid {
+			return key, true
+		}
+	}
+	return signingKey{}, false
+}
+
+// refreshIfDue reads the keys unless they were read less than minRefreshInterval ago. Callers arriving
+// while the keys are being read wait for that read instead of starting another one.
+func (v *OidcVerifier) refreshIfDue(ctx context.Context) {
+	v.mu.Lock()
+	if done := v.refreshing; done != nil {
+		v.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		return
+	}
+	if time.Since(v.lastAttemptAt) < v.minRefreshInterval {
+		v.mu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	v.refreshing = done
+	v.lastAttemptAt = time.Now()
+	v.mu.Unlock()
+
+	// the read is shared by every waiting request, so it must not end with the request that started it
+	err := v.refresh(context.WithoutCancel(ctx))
+
+	v.mu.Lock()
+	v.refreshing = nil
+	known := len(v.keys)
+	v.mu.Unlock()
+	close(done)
+	if err != nil {
+		log.Err(err).Msgf("failed to refresh JWKS, keeping %d last known keys", known)
+	}
+}
+
+// Refresh reads the keys from the JWKS URL
+func (v *OidcVerifier) Refresh(ctx context.Context) error {
+	v.mu.Lock()
+	v.lastAttemptAt = time.Now()
+	v.mu.Unlock()
+	return v.refresh(ctx)
+}
+
+// refresh reads the keys without holding mu, it is only held to store them
+func (v *OidcVerifier) refresh(ctx context.Context) error {
+	keySet, err := v.jwksClient.GetKeySet(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]signingKey, 0, len(keySet.Keys))
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseKey(jwk)
+		if err != nil {
+			log.Warn().Err(err).Msgf("skipping key %s of JWKS", jwk.Kid)
+			continue
+		}
+		keys = append(keys, signingKey{id: jwk.Kid, alg: jwk.Alg, key: key})
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS holds no usable signing keys")
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.refreshedAt = time.Now()
+	v.mu.Unlock()
+	log.Info().Msgf("JWKS refreshed, %d keys known", len(keys))
+	return nil
+}
+
+func parseKey(jwk model.JsonWebKey) (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeInt(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := decodeInt(jwk.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		if n.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key of %d bits is too short", n.BitLen())
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := curves[jwk.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeInt(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %w", err)
+		}
+		y, err := decodeInt(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+	}
+}
+
+func verifySignature(algorithm signingAlgorithm, key crypto.PublicKey, signed string, signature []byte) error {
+	hasher := algorithm.hash.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm.curve != nil {
+			return errors.New("RSA key used with an ECDSA algorithm")
+		}
+		if algorithm.pss {
+			return rsa.VerifyPSS(key, algorithm.hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.VerifyPKCS1v15(key, algorithm.hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if algorithm.curve != key.Curve {
+			return errors.New("EC key used with another algorithm than its curve")
+		}
+		// the signature is r and s padded to the size of the curve, not ASN.1
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid ECDSA signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	default:
+		return errors.New("unsupported key")
+	}
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// stringList reads a claim that is either a string or an array of strings. Strings are split
+// on spaces when split is set, like the OAuth scope claim.
+func stringList(raw json.RawMessage, split bool) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		if split {
+			return strings.Fields(value), nil
+		}
+		return []string{value}, nil
+	}
+	var values []string
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, errors.New("expected a string or an array of strings")
+	}
+	return values, nil
+}
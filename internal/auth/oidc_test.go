@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+)
+
+const (
+	testIssuer   = "https://issuer.example"
+	testAudience = "ccc-exporter"
+)
+
+type testKeys struct {
+	rsa  *rsa.PrivateKey
+	p256 *ecdsa.PrivateKey
+}
+
+var keys = func() testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return testKeys{rsa: rsaKey, p256: p256Key}
+}()
+
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// testKeySet serves the RSA key twice, restricted to RS256 as rsa-rs256 and unrestricted as rsa, and the P-256 key as ec
+func testKeySet() model.JsonWebKeySet {
+	rsaKey := model.JsonWebKey{Kty: "RSA", Use: "sig", N: encodeInt(keys.rsa.N), E: encodeInt(big.NewInt(int64(keys.rsa.E)))}
+	restricted := rsaKey
+	restricted.Kid = "rsa-rs256"
+	restricted.Alg = "RS256"
+	rsaKey.Kid = "rsa"
+	ecKey := model.JsonWebKey{Kty: "EC", Kid: "ec", Use: "sig", Crv: "P-256", X: encodeInt(keys.p256.X), Y: encodeInt(keys.p256.Y)}
+	return model.JsonWebKeySet{Keys: []model.JsonWebKey{restricted, rsaKey, ecKey}}
+}
+
+// newJwksServer serves keySet and counts the requests, handler runs before every response when set
+func newJwksServer(t *testing.T, keySet model.JsonWebKeySet, handler func(request int64)) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := requests.Add(1)
+		if handler != nil {
+			handler(request)
+		}
+		_ = json.NewEncoder(w).Encode(keySet)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func newTestVerifier(t *testing.T, jwksUrl string) *OidcVerifier {
+	t.Helper()
+	oidcConfig := config.Oidc{JwksUrl: jwksUrl, Issuer: testIssuer, Audience: testAudience, ScopeClaim: "scope", RefreshIntervalSeconds: 3600}
+	verifier := NewOidcVerifier(client.NewJwksClient(oidcConfig), oidcConfig)
+	verifier.minRefreshInterval = 0
+	return verifier
+}
+
+func validClaims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":   testIssuer,
+		"sub":   "alice",
+		"aud":   []string{"other", testAudience},
+		"exp":   now.Add(time.Hour).Unix(),
+		"nbf":   now.Add(-time.Minute).Unix(),
+		"scope": "exports:read costs:read",
+	}
+}
+
+func encodeSegment(t *testing.T, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// sign builds a JWT, alg picks how it is signed and is put in the header as it is
+func sign(t *testing.T, alg string, kid string, claims map[string]any) string {
+	t.Helper()
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, keys.rsa, crypto.SHA256, digest[:])
+	case "PS256":
+		signature, err = rsa.SignPSS(rand.Reader, keys.rsa, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256", "ES384":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, keys.p256, digest[:])
+		if err == nil {
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	case "HS256":
+		// the key confusion attack uses the public RSA key as the HMAC secret
+		mac := hmac.New(sha256.New, keys.rsa.N.Bytes())
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "none":
+	default:
+		t.Fatalf("unknown algorithm %s", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func withClaim(name string, value any) map[string]any {
+	claims := validClaims()
+	if value == nil {
+		delete(claims, name)
+	} else {
+		claims[name] = value
+	}
+	return claims
+}
+
+// withPayload swaps the claims of token, keeping its signature
+func withPayload(token string, payload string) string {
+	parts := strings.Split(token, ".")
+	parts[1] = payload
+	return strings.Join(parts, ".")
+}
+
+func TestOidcVerifierVerify(t *testing.T) {
+	server, _ := newJwksServer(t, testKeySet(), nil)
+	verifier := newTestVerifier(t, server.URL)
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		token string
+		// wantErr is part of the expected error, the token is expected to be accepted when empty
+		wantErr string
+	}{
+		{name: "RS256", token: sign(t, "RS256", "rsa-rs256", validClaims())},
+		{name: "PS256", token: sign(t, "PS256", "rsa", validClaims())},
+		{name: "ES256", token: sign(t, "ES256", "ec", validClaims())},
+		{name: "audience as a string", token: sign(t, "RS256", "rsa", withClaim("aud", testAudience))},
+		{name: "alg not allowed for key", token: sign(t, "PS256", "rsa-rs256", validClaims()), wantErr: "is not used with PS256"},
+		{name: "RSA key with ECDSA alg", token: sign(t, "ES256", "rsa", validClaims()), wantErr: "RSA key used with an ECDSA algorithm"},
+		{name: "EC key with RSA alg", token: sign(t, "RS256", "ec", validClaims()), wantErr: "EC key used with another algorithm"},
+		{name: "curve mismatch", token: sign(t, "ES384", "ec", validClaims()), wantErr: "EC key used with another algorithm"},
+		{name: "unknown kid", token: sign(t, "RS256", "rotated-away", validClaims()), wantErr: "unknown key rotated-away"},
+		{name: "no kid with several keys", token: sign(t, "RS256", "", validClaims()), wantErr: "unknown key"},
+		{name: "alg none", token: sign(t, "none", "rsa", validClaims()), wantErr: "unsupported JWT algorithm none"},
+		{name: "HS256 with the RSA key as secret", token: sign(t, "HS256", "rsa", validClaims()), wantErr: "unsupported JWT algorithm HS256"},
+		{name: "tampered claims", token: withPayload(sign(t, "RS256", "rsa", validClaims()), encodeSegment(t, withClaim("sub", "mallory"))), wantErr: "verification error"},
+		{name: "expired", token: sign(t, "RS256", "rsa", withClaim("exp", now.Add(-time.Minute).Unix())), wantErr: "expired"},
+		{name: "no exp", token: sign(t, "RS256", "rsa", withClaim("exp", nil)), wantErr: "no exp claim"},
+		{name: "not valid yet", token: sign(t, "RS256", "rsa", withClaim("nbf", now.Add(time.Hour).Unix())), wantErr: "not valid yet"},
+		{name: "wrong issuer", token: sign(t, "RS256", "rsa", withClaim("iss", "https://evil.example")), wantErr: "issued by https://evil.example"},
+		{name: "wrong audience", token: sign(t, "RS256", "rsa", withClaim("aud", "someone-else")), wantErr: "audience"},
+		{name: "no audience", token: sign(t, "RS256", "rsa", withClaim("aud", nil)), wantErr: "audience"},
+		{name: "not a JWT", token: "abc.def", wantErr: "not a JWT"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			principal, err := verifier.Verify(context.Background(), test.token)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("got error %v, want the token to be accepted", err)
+				}
+				if principal.Name != "alice" || !principal.Scopes[ScopeExportsRead] || !principal.Scopes[ScopeCostsRead] || principal.Scopes[ScopeExportsWrite] {
+					t.Errorf("got principal %+v", principal)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestOidcVerifierScopesAsArray(t *testing.T) {
+	server, _ := newJwksServer(t, testKeySet(), nil)
+	verifier := newTestVerifier(t, server.URL)
+
+	principal, err := verifier.Verify(context.Background(), sign(t, "RS256", "rsa", withClaim("scope", []string{ScopeExportsWrite})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !principal.Scopes[ScopeExportsWrite] || len(principal.Scopes) != 1 {
+		t.Errorf("got scopes %v, want only %s", principal.Scopes, ScopeExportsWrite)
+	}
+}
+
+func TestOidcVerifierReadsKeysAgainForUnknownKidAtMostOncePerInterval(t *testing.T) {
+	server, requests := newJwksServer(t, testKeySet(), nil)
+	verifier := newTestVerifier(t, server.URL)
+	verifier.minRefreshInterval = time.Hour
+
+	for i := 0; i < 5; i++ {
+		if _, err := verifier.Verify(context.Background(), sign(t, "RS256", "unknown", validClaims())); err == nil {
+			t.Fatal("got no error for an unknown kid")
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d JWKS requests, want 1", got)
+	}
+	if _, err := verifier.Verify(context.Background(), sign(t, "RS256", "rsa", validClaims())); err != nil {
+		t.Errorf("got error %v for a known kid", err)
+	}
+}
+
+func TestOidcVerifierUsesKnownKeysWhileTheKeysAreRead(t *testing.T) {
+	unblock := make(chan struct{})
+	server, requests := newJwksServer(t, testKeySet(), func(request int64) {
+		if request > 1 {
+			<-unblock
+		}
+	})
+	t.Cleanup(func() { close(unblock) })
+	verifier := newTestVerifier(t, server.URL)
+	if err := verifier.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// every key is expired from now on, so each request finds the keys being read
+	verifier.refreshInterval = 0
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 3; i++ {
+			if _, err := verifier.Verify(context.Background(), sign(t, "RS256", "rsa", validClaims())); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("verifying a token with a known key waited for the keys to be read")
+	}
+	for deadline := time.Now().Add(5 * time.Second); requests.Load() < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("got %d JWKS requests, want the initial one and a single refresh", got)
+	}
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TokenFileVerifier accepts the static tokens listed in a file. Every line holds a name, a token and
+// the scopes granted to it separated by whitespace, * grants every scope. Empty lines and lines
+// starting with # are skipped. The file is read again when it changes, so tokens can be rotated.
+type TokenFileVerifier struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	// tokens are keyed by their hash, so looking them up does not leak how much of a token matched
+	tokens map[[sha256.Size]byte]Principal
+}
+
+func NewTokenFileVerifier(path string) *TokenFileVerifier {
+	return &TokenFileVerifier{path: path}
+}
+
+func (v *TokenFileVerifier) Verify(ctx context.Context, token string) (Principal, error) {
+	if err := v.Refresh(ctx); err != nil {
+		v.mu.Lock()
+		known := v.tokens != nil
+		v.mu.Unlock()
+		if !known {
+			return Principal{}, err
+		}
+		log.Err(err).Msg("failed to read token file, keeping the last known tokens")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	principal, ok := v.tokens[sha256.Sum256([]byte(token))]
+	if !ok {
+		return Principal{}, errors.New("unknown token")
+	}
+	return principal, nil
+}
+
+// Refresh reads the token file when it changed since it was read last
+func (v *TokenFileVerifier) Refresh(_ context.Context) error {
+	info, err := os.Stat(v.path)
+	if err != nil {
+		return fmt.Errorf("unable to read token file: %w", err)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.tokens != nil && info.ModTime().Equal(v.modTime) {
+		return nil
+	}
+	tokens, err := readTokenFile(v.path)
+	if err != nil {
+		return err
+	}
+	v.tokens = tokens
+	v.modTime = info.ModTime()
+	log.Info().Msgf("token file read, %d tokens known", len(tokens))
+	return nil
+}
+
+func readTokenFile(path string) (map[[sha256.Size]byte]Principal, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token file: %w", err)
+	}
+	defer file.Close()
+
+	tokens := make(map[[sha256.Size]byte]Principal)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("token file line %d: expected a name, a token and at least one scope", line)
+		}
+
+		principal := Principal{Name: fields[0], Scopes: make(map[string]bool)}
+		for _, scope := range fields[2:] {
+			if scope == "*" {
+				for _, s := range AllScopes {
+					principal.Scopes[s] = true
+				}
+				continue
+			}
+			principal.Scopes[scope] = true
+		}
+		hash := sha256.Sum256([]byte(fields[1]))
+		if _, ok := tokens[hash]; ok {
+			return nil, fmt.Errorf("token file line %d: token of %s is listed twice", line, principal.Name)
+		}
+		tokens[hash] = principal
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read token file: %w", err)
+	}
+	return tokens, nil
+}
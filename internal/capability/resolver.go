@@ -0,0 +1,163 @@
+// Package capability works out which capability owns a topic
+package capability
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.dfds.cloud/ccc-exporter/config"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CapabilityGroup is the named group every rule pattern has to capture the capability in
+const CapabilityGroup = "capability"
+
+type MatchSource string
+
+const (
+	MatchSourceOverride  MatchSource = "override"
+	MatchSourceExclusion MatchSource = "exclusion"
+	MatchSourceRule      MatchSource = "rule"
+	MatchSourceDefault   MatchSource = "default"
+)
+
+// Match explains how the capability of a topic was resolved
+type Match struct {
+	Topic      string
+	Capability string
+	Source     MatchSource
+	// Rule is the name of the matching rule, or the matching exclusion
+	Rule string
+}
+
+// Matched reports whether the capability came from an override or a rule rather than the default bucket
+func (m Match) Matched() bool {
+	return m.Source == MatchSourceOverride || m.Source == MatchSourceRule
+}
+
+type rule struct {
+	name    string
+	pattern *regexp.Regexp
+	group   int
+}
+
+// Resolver resolves topics to capabilities. Explicit overrides win, those from the overrides file first,
+// then exclusions, then the rules in the configured order. Topics matching nothing go to the default bucket.
+type Resolver struct {
+	overrides         map[string]string
+	exclusions        []string
+	rules             []rule
+	defaultCapability string
+
+	overridesFile string
+	mu            sync.RWMutex
+	fileModTime   time.Time
+	fileOverrides map[string]string
+}
+
+type fileOverride struct {
+	Topic      string `json:"topic"`
+	Capability string `json:"capability"`
+}
+
+func NewResolver(capabilitiesConfig config.Capabilities) (*Resolver, error) {
+	resolver := &Resolver{
+		overrides:         make(map[string]string),
+		exclusions:        capabilitiesConfig.Exclusions,
+		defaultCapability: capabilitiesConfig.Default,
+		overridesFile:     capabilitiesConfig.OverridesFile,
+	}
+	if err := resolver.Refresh(); err != nil {
+		return nil, err
+	}
+	for _, override := range capabilitiesConfig.Overrides {
+		resolver.overrides[override.Topic] = override.Capability
+	}
+	for i, ruleConfig := range capabilitiesConfig.Rules {
+		name := ruleConfig.Name
+		if name == "" {
+			name = fmt.Sprintf("rule-%d", i+1)
+		}
+		pattern, err := regexp.Compile(ruleConfig.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for capability rule %s: %w", name, err)
+		}
+		group := pattern.SubexpIndex(CapabilityGroup)
+		if group < 0 {
+			return nil, fmt.Errorf("pattern for capability rule %s has no (?P<%s>...) group", name, CapabilityGroup)
+		}
+		resolver.rules = append(resolver.rules, rule{name: name, pattern: pattern, group: group})
+	}
+	return resolver, nil
+}
+
+// Refresh reads the overrides file when it changed since it was read last. On failure the overrides read before are kept.
+func (r *Resolver) Refresh() error {
+	if r.overridesFile == "" {
+		return nil
+	}
+	info, err := os.Stat(r.overridesFile)
+	if err != nil {
+		return fmt.Errorf("unable to read capability overrides file: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fileOverrides != nil && info.ModTime().Equal(r.fileModTime) {
+		return nil
+	}
+	overrides, err := readOverridesFile(r.overridesFile)
+	if err != nil {
+		return err
+	}
+	r.fileOverrides = overrides
+	r.fileModTime = info.ModTime()
+	return nil
+}
+
+func readOverridesFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read capability overrides file: %w", err)
+	}
+	var entries []fileOverride
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("unable to parse capability overrides file %s: %w", path, err)
+	}
+
+	overrides := make(map[string]string, len(entries))
+	for i, entry := range entries {
+		if entry.Topic == "" || entry.Capability == "" {
+			return nil, fmt.Errorf("capability overrides file %s: entry %d needs a topic and a capability", path, i+1)
+		}
+		overrides[entry.Topic] = entry.Capability
+	}
+	return overrides, nil
+}
+
+func (r *Resolver) Resolve(topic string) Match {
+	r.mu.RLock()
+	capability, ok := r.fileOverrides[topic]
+	r.mu.RUnlock()
+	if ok {
+		return Match{Topic: topic, Capability: capability, Source: MatchSourceOverride, Rule: topic}
+	}
+	if capability, ok := r.overrides[topic]; ok {
+		return Match{Topic: topic, Capability: capability, Source: MatchSourceOverride, Rule: topic}
+	}
+	for _, exclusion := range r.exclusions {
+		if strings.Contains(topic, exclusion) {
+			return Match{Topic: topic, Capability: r.defaultCapability, Source: MatchSourceExclusion, Rule: exclusion}
+		}
+	}
+	for _, rule := range r.rules {
+		submatches := rule.pattern.FindStringSubmatch(topic)
+		if len(submatches) > rule.group && submatches[rule.group] != "" {
+			return Match{Topic: topic, Capability: submatches[rule.group], Source: MatchSourceRule, Rule: rule.name}
+		}
+	}
+	return Match{Topic: topic, Capability: r.defaultCapability, Source: MatchSourceDefault}
+}
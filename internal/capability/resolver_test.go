@@ -0,0 +1,145 @@
+package capability
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.dfds.cloud/ccc-exporter/config"
+)
+
+// testConfig has the default rule and exclusion, and a rule for topics named after their team
+func testConfig() config.Capabilities {
+	return config.Capabilities{
+		Rules: []config.CapabilityRule{
+			{Name: "capability-root-id", Pattern: `(pub.)?(?P<capability>.*-.{5})\.`},
+			{Name: "team", Pattern: `^team\.(?P<capability>[a-z]+)\.`},
+		},
+		Overrides:  []config.TopicCapability{{Topic: "legacy-events", Capability: "legacy-abcde"}},
+		Exclusions: []string{"_confluent-ksql"},
+		Default:    "UNKNOWN",
+	}
+}
+
+func newTestResolver(t *testing.T, capabilitiesConfig config.Capabilities) *Resolver {
+	t.Helper()
+	resolver, err := NewResolver(capabilitiesConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resolver
+}
+
+func TestResolve(t *testing.T) {
+	resolver := newTestResolver(t, testConfig())
+	tests := []struct {
+		topic string
+		want  Match
+	}{
+		{topic: "pub.dataplatform-ajamn.events", want: Match{Capability: "dataplatform-ajamn", Source: MatchSourceRule, Rule: "capability-root-id"}},
+		{topic: "cloudengineering-xyzab.stuff", want: Match{Capability: "cloudengineering-xyzab", Source: MatchSourceRule, Rule: "capability-root-id"}},
+		{topic: "team.billing.invoices", want: Match{Capability: "billing", Source: MatchSourceRule, Rule: "team"}},
+		{topic: "legacy-events", want: Match{Capability: "legacy-abcde", Source: MatchSourceOverride, Rule: "legacy-events"}},
+		{topic: "_confluent-ksql-pksqlc-abcde.query_1-changelog", want: Match{Capability: "UNKNOWN", Source: MatchSourceExclusion, Rule: "_confluent-ksql"}},
+		{topic: "pub.x._confluent-ksql-pksqlc-abcde.query_1-changelog", want: Match{Capability: "UNKNOWN", Source: MatchSourceExclusion, Rule: "_confluent-ksql"}},
+		{topic: "nothing", want: Match{Capability: "UNKNOWN", Source: MatchSourceDefault}},
+	}
+	for _, test := range tests {
+		t.Run(test.topic, func(t *testing.T) {
+			test.want.Topic = test.topic
+			if got := resolver.Resolve(test.topic); got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveTriesRulesInOrder(t *testing.T) {
+	capabilitiesConfig := testConfig()
+	capabilitiesConfig.Rules[0], capabilitiesConfig.Rules[1] = capabilitiesConfig.Rules[1], capabilitiesConfig.Rules[0]
+	resolver := newTestResolver(t, capabilitiesConfig)
+
+	// both rules match, the first one wins
+	if got := resolver.Resolve("team.billing.x-abcde.invoices"); got.Rule != "team" || got.Capability != "billing" {
+		t.Errorf("got %+v, want the team rule to win", got)
+	}
+}
+
+func TestOverridesWinOverExclusions(t *testing.T) {
+	capabilitiesConfig := testConfig()
+	capabilitiesConfig.Overrides = append(capabilitiesConfig.Overrides, config.TopicCapability{Topic: "_confluent-ksql-owned", Capability: "ksql-abcde"})
+	resolver := newTestResolver(t, capabilitiesConfig)
+
+	if got := resolver.Resolve("_confluent-ksql-owned"); got.Source != MatchSourceOverride || got.Capability != "ksql-abcde" {
+		t.Errorf("got %+v, want the override", got)
+	}
+}
+
+func TestNewResolverRejectsInvalidRules(t *testing.T) {
+	tests := map[string]string{
+		"invalid pattern":     `(?P<capability>`,
+		"no capability group": `^(pub\.)?(.*)\.`,
+	}
+	for name, pattern := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewResolver(config.Capabilities{Rules: []config.CapabilityRule{{Pattern: pattern}}})
+			if err == nil || !strings.Contains(err.Error(), "rule-1") {
+				t.Errorf("got error %v, want one naming rule-1", err)
+			}
+		})
+	}
+}
+
+func writeOverrides(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverridesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.json")
+	writeOverrides(t, path, `[{"topic": "legacy-events", "capability": "file-abcde"}, {"topic": "pub.dataplatform-ajamn.events", "capability": "moved-abcde"}]`)
+	capabilitiesConfig := testConfig()
+	capabilitiesConfig.OverridesFile = path
+	resolver := newTestResolver(t, capabilitiesConfig)
+
+	// the file wins over the overrides in config and over the rules
+	if got := resolver.Resolve("legacy-events"); got.Capability != "file-abcde" {
+		t.Errorf("got %+v, want the override from the file", got)
+	}
+	if got := resolver.Resolve("pub.dataplatform-ajamn.events"); got.Capability != "moved-abcde" || got.Source != MatchSourceOverride {
+		t.Errorf("got %+v, want the override from the file", got)
+	}
+
+	writeOverrides(t, path, `[{"topic": "legacy-events", "capability": "changed-abcde"}]`)
+	// make sure the modification time differs on file systems with a coarse clock
+	resolver.fileModTime = resolver.fileModTime.Add(-1)
+	if err := resolver.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolver.Resolve("legacy-events"); got.Capability != "changed-abcde" {
+		t.Errorf("got %+v, want the changed override", got)
+	}
+	if got := resolver.Resolve("pub.dataplatform-ajamn.events"); got.Source != MatchSourceRule {
+		t.Errorf("got %+v, want the rule once the override is removed", got)
+	}
+
+	writeOverrides(t, path, `[{"topic": "legacy-events"}]`)
+	resolver.fileModTime = resolver.fileModTime.Add(-1)
+	if err := resolver.Refresh(); err == nil {
+		t.Error("got no error for an override without a capability")
+	}
+	if got := resolver.Resolve("legacy-events"); got.Capability != "changed-abcde" {
+		t.Errorf("got %+v, want the last valid overrides to be kept", got)
+	}
+}
+
+func TestNewResolverFailsWithoutOverridesFile(t *testing.T) {
+	capabilitiesConfig := testConfig()
+	capabilitiesConfig.OverridesFile = filepath.Join(t.TempDir(), "missing.json")
+	if _, err := NewResolver(capabilitiesConfig); err == nil {
+		t.Error("got no error for a missing overrides file")
+	}
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"net/http"
+	"os"
+	"time"
+)
+
+// CapabilityCatalogueClient reads capability metadata as a JSON array, either from an HTTP endpoint or from a local file
+type CapabilityCatalogueClient struct {
+	http        *http.Client
+	config      config.Catalogue
+	retryPolicy RetryPolicy
+}
+
+func NewCapabilityCatalogueClient(catalogueConfig config.Catalogue) *CapabilityCatalogueClient {
+	return &CapabilityCatalogueClient{
+		http:   http.DefaultClient,
+		config: catalogueConfig,
+		retryPolicy: RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: 500 * time.Millisecond,
+			MaxBackoff:     5 * time.Second,
+			RequestTimeout: time.Duration(catalogueConfig.RequestTimeoutSeconds) * time.Second,
+		},
+	}
+}
+
+func (c *CapabilityCatalogueClient) GetCapabilities(ctx context.Context) ([]model.CapabilityMetadata, error) {
+	var data []byte
+	var err error
+	switch {
+	case c.config.File != "":
+		data, err = os.ReadFile(c.config.File)
+	case c.config.Endpoint != "":
+		data, err = doWithRetry(ctx, c.http, c.retryPolicy, func(ctx context.Context) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, "GET", c.config.Endpoint, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Accept", "application/json")
+			if c.config.Token != "" {
+				req.Header.Set("Authorization", "Bearer "+c.config.Token)
+			}
+			return req, nil
+		})
+	default:
+		return nil, errors.New("no capability catalogue endpoint or file configured")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read capability catalogue: %w", err)
+	}
+
+	var capabilities []model.CapabilityMetadata
+	if err := json.Unmarshal(data, &capabilities); err != nil {
+		return nil, fmt.Errorf("unable to parse capability catalogue: %w", err)
+	}
+	return capabilities, nil
+}
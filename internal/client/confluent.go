@@ -1,60 +1,224 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"go.dfds.cloud/ccc-exporter/config"
 	"go.dfds.cloud/ccc-exporter/internal/model"
-	"io"
+	"go.dfds.cloud/ccc-exporter/internal/telemetry"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
+// maxPages guards against a misbehaving API handing out cursors forever
+const maxPages = 1000
+
 type ConfluentCloudClient struct {
-	http   *http.Client
-	config config.Confluent
+	http        *http.Client
+	config      config.Confluent
+	retryPolicy RetryPolicy
 }
 
 func NewConfluentCloudClient(confluentConfig config.Confluent) *ConfluentCloudClient {
 	return &ConfluentCloudClient{
 		http:   http.DefaultClient,
 		config: confluentConfig,
+		retryPolicy: RetryPolicy{
+			MaxAttempts:    confluentConfig.Retry.MaxAttempts,
+			InitialBackoff: time.Duration(confluentConfig.Retry.InitialBackoffMillis) * time.Millisecond,
+			MaxBackoff:     time.Duration(confluentConfig.Retry.MaxBackoffMillis) * time.Millisecond,
+			RequestTimeout: time.Duration(confluentConfig.RequestTimeoutSeconds) * time.Second,
+		},
 	}
 }
 
-func (c *ConfluentCloudClient) GetCosts(from time.Time, to time.Time) (*model.ConfluentCostResponse, error) {
+// GetCosts fetches all billing lines between from and to, following the metadata.next cursor until every page has been read.
+// Pages are merged into a single response in the order they were returned.
+func (c *ConfluentCloudClient) GetCosts(ctx context.Context, from time.Time, to time.Time) (*model.ConfluentCostResponse, error) {
 
 	if from.After(to) {
 		return nil, fmt.Errorf("from date is after to date")
 	}
 
-	req, err := http.NewRequest("GET", "https://api.confluent.cloud/billing/v1/costs", nil)
-	if err != nil {
-		return nil, err
-	}
-
-	queryValues := req.URL.Query()
+	queryValues := url.Values{}
 	queryValues.Add("start_date", from.Format("2006-01-02"))
 	queryValues.Add("end_date", to.Format("2006-01-02"))
-	req.URL.RawQuery = queryValues.Encode()
-	req.SetBasicAuth(c.config.ApiKeyId, c.config.ApiKeySecret)
-	resp, err := c.http.Do(req)
+	if c.config.BillingPageSize > 0 {
+		queryValues.Add("page_size", strconv.Itoa(c.config.BillingPageSize))
+	}
+
+	payload := &model.ConfluentCostResponse{}
+	err := c.followPages(c.url("/billing/v1/costs", queryValues), func(pageUrl string) (string, error) {
+		var page model.ConfluentCostResponse
+		if err := c.getJson(ctx, "costs", pageUrl, &page); err != nil {
+			return "", err
+		}
+		payload.ApiVersion = page.ApiVersion
+		payload.Kind = page.Kind
+		payload.Data = append(payload.Data, page.Data...)
+		return page.Metadata.Next, nil
+	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to get confluent costs: %w", err)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("got response %s when attempting to get confluent costs", resp.Status)
+
+	return payload, nil
+}
+
+func (c *ConfluentCloudClient) GetEnvironments(ctx context.Context) (*model.ConfluentEnvironmentsResponse, error) {
+	queryValues := url.Values{}
+	queryValues.Add("page_size", "100")
+
+	payload := &model.ConfluentEnvironmentsResponse{}
+	err := c.followPages(c.url("/org/v2/environments", queryValues), func(pageUrl string) (string, error) {
+		var page model.ConfluentEnvironmentsResponse
+		if err := c.getJson(ctx, "environments", pageUrl, &page); err != nil {
+			return "", err
+		}
+		payload.ApiVersion = page.ApiVersion
+		payload.Kind = page.Kind
+		payload.Data = append(payload.Data, page.Data...)
+		return page.Metadata.Next, nil
+	})
+
+	return payload, err
+}
+
+func (c *ConfluentCloudClient) GetClusters(ctx context.Context, environmentId string) (*model.ConfluentClustersResponse, error) {
+	queryValues := url.Values{}
+	queryValues.Add("environment", environmentId)
+	queryValues.Add("page_size", "100")
+
+	payload := &model.ConfluentClustersResponse{}
+	err := c.followPages(c.url("/cmk/v2/clusters", queryValues), func(pageUrl string) (string, error) {
+		var page model.ConfluentClustersResponse
+		if err := c.getJson(ctx, "clusters", pageUrl, &page); err != nil {
+			return "", err
+		}
+		payload.ApiVersion = page.ApiVersion
+		payload.Kind = page.Kind
+		payload.Data = append(payload.Data, page.Data...)
+		return page.Metadata.Next, nil
+	})
+
+	return payload, err
+}
+
+func (c *ConfluentCloudClient) GetServiceAccounts(ctx context.Context) (*model.ConfluentServiceAccountsResponse, error) {
+	queryValues := url.Values{}
+	queryValues.Add("page_size", "100")
+
+	payload := &model.ConfluentServiceAccountsResponse{}
+	err := c.followPages(c.url("/iam/v2/service-accounts", queryValues), func(pageUrl string) (string, error) {
+		var page model.ConfluentServiceAccountsResponse
+		if err := c.getJson(ctx, "service_accounts", pageUrl, &page); err != nil {
+			return "", err
+		}
+		payload.ApiVersion = page.ApiVersion
+		payload.Kind = page.Kind
+		payload.Data = append(payload.Data, page.Data...)
+		return page.Metadata.Next, nil
+	})
+
+	return payload, err
+}
+
+func (c *ConfluentCloudClient) GetApiKeys(ctx context.Context) (*model.ConfluentApiKeysResponse, error) {
+	queryValues := url.Values{}
+	queryValues.Add("page_size", "100")
+
+	payload := &model.ConfluentApiKeysResponse{}
+	err := c.followPages(c.url("/iam/v2/api-keys", queryValues), func(pageUrl string) (string, error) {
+		var page model.ConfluentApiKeysResponse
+		if err := c.getJson(ctx, "api_keys", pageUrl, &page); err != nil {
+			return "", err
+		}
+		payload.ApiVersion = page.ApiVersion
+		payload.Kind = page.Kind
+		payload.Data = append(payload.Data, page.Data...)
+		return page.Metadata.Next, nil
+	})
+
+	return payload, err
+}
+
+// GetTopics lists the topics of a cluster through its Kafka REST v3 API, which takes a cluster API key rather than a cloud API key
+func (c *ConfluentCloudClient) GetTopics(ctx context.Context, restEndpoint string, clusterId string, apiKeyId string, apiKeySecret string) (*model.KafkaTopicsResponse, error) {
+	payload := &model.KafkaTopicsResponse{}
+	err := c.followPages(fmt.Sprintf("%s/kafka/v3/clusters/%s/topics", restEndpoint, clusterId), func(pageUrl string) (string, error) {
+		var page model.KafkaTopicsResponse
+		if err := c.getJsonAs(ctx, "topics", pageUrl, apiKeyId, apiKeySecret, &page); err != nil {
+			return "", err
+		}
+		payload.Kind = page.Kind
+		payload.Data = append(payload.Data, page.Data...)
+		return page.Metadata.Next, nil
+	})
+
+	return payload, err
+}
+
+func (c *ConfluentCloudClient) url(path string, queryValues url.Values) string {
+	return fmt.Sprintf("%s%s?%s", c.config.Endpoint, path, queryValues.Encode())
+}
+
+// followPages calls getPage with firstUrl and then with every next cursor getPage returns, until no cursor is returned.
+// Relative cursors are resolved against the page they were returned from.
+func (c *ConfluentCloudClient) followPages(firstUrl string, getPage func(pageUrl string) (string, error)) error {
+	seen := make(map[string]bool)
+	pageUrl := firstUrl
+	for pages := 0; pageUrl != ""; pages++ {
+		if pages >= maxPages {
+			return fmt.Errorf("gave up after reading %d pages", maxPages)
+		}
+		if seen[pageUrl] {
+			return fmt.Errorf("pagination cursor loop detected, %s was already read", pageUrl)
+		}
+		seen[pageUrl] = true
+
+		next, err := getPage(pageUrl)
+		if err != nil {
+			return err
+		}
+		if next == "" {
+			return nil
+		}
+
+		current, err := url.Parse(pageUrl)
+		if err != nil {
+			return err
+		}
+		nextUrl, err := current.Parse(next)
+		if err != nil {
+			return fmt.Errorf("invalid pagination cursor %s: %w", next, err)
+		}
+		pageUrl = nextUrl.String()
 	}
+	return nil
+}
 
-	defer resp.Body.Close()
+func (c *ConfluentCloudClient) getJson(ctx context.Context, operation string, requestUrl string, payload any) error {
+	return c.getJsonAs(ctx, operation, requestUrl, c.config.ApiKeyId, c.config.ApiKeySecret, payload)
+}
 
-	data, err := io.ReadAll(resp.Body)
+// getJsonAs reads a page into payload, operation names the call in the request metrics
+func (c *ConfluentCloudClient) getJsonAs(ctx context.Context, operation string, requestUrl string, apiKeyId string, apiKeySecret string, payload any) error {
+	start := time.Now()
+	data, err := doWithRetry(ctx, c.http, c.retryPolicy, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", requestUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(apiKeyId, apiKeySecret)
+		return req, nil
+	})
+	telemetry.ObserveRequest(telemetry.UpstreamConfluent, operation, start, err)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var payload *model.ConfluentCostResponse
-	err = json.Unmarshal(data, &payload)
-
-	return payload, err
+	return json.Unmarshal(data, payload)
 }
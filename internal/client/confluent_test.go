@@ -0,0 +1,65 @@
+package client_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/fake"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+)
+
+func newCostServer(clusterIds ...string) *fake.ConfluentCloudServer {
+	server := fake.NewConfluentCloudServer()
+	server.PageSize = 2
+	for _, clusterId := range clusterIds {
+		line := model.ConfluentCostLine{LineType: "KAFKA_STORAGE", Product: "KAFKA", StartDate: "2024-03-01", Amount: 1}
+		line.Resource.Id = clusterId
+		server.AddCostLines(line)
+	}
+	return server
+}
+
+func getCosts(server *fake.ConfluentCloudServer) (*model.ConfluentCostResponse, error) {
+	confluentClient := client.NewConfluentCloudClient(config.Confluent{Endpoint: server.URL})
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	return confluentClient.GetCosts(context.Background(), from, from.AddDate(0, 0, 1))
+}
+
+func TestGetCostsFollowsEveryPage(t *testing.T) {
+	server := newCostServer("lkc-1", "lkc-2", "lkc-3", "lkc-4", "lkc-5")
+	defer server.Close()
+
+	costs, err := getCosts(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, line := range costs.Data {
+		ids = append(ids, line.Resource.Id)
+	}
+	if got, want := strings.Join(ids, ","), "lkc-1,lkc-2,lkc-3,lkc-4,lkc-5"; got != want {
+		t.Errorf("got cost lines of %s, want %s", got, want)
+	}
+	if got := len(server.Requests()); got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+}
+
+func TestGetCostsStopsOnLoopingCursor(t *testing.T) {
+	server := newCostServer("lkc-1", "lkc-2", "lkc-3")
+	defer server.Close()
+	server.LoopCursor = true
+
+	_, err := getCosts(server)
+	if err == nil || !strings.Contains(err.Error(), "cursor loop") {
+		t.Fatalf("got error %v, want a cursor loop error", err)
+	}
+	if got := len(server.Requests()); got > 4 {
+		t.Errorf("got %d requests, want the loop to be caught after at most 4", got)
+	}
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/telemetry"
+)
+
+// JwksClient reads the signing keys of an OIDC provider
+type JwksClient struct {
+	http        *http.Client
+	url         string
+	retryPolicy RetryPolicy
+}
+
+func NewJwksClient(oidcConfig config.Oidc) *JwksClient {
+	return &JwksClient{
+		http: http.DefaultClient,
+		url:  oidcConfig.JwksUrl,
+		retryPolicy: RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: 500 * time.Millisecond,
+			MaxBackoff:     5 * time.Second,
+			RequestTimeout: time.Duration(oidcConfig.RequestTimeoutSeconds) * time.Second,
+		},
+	}
+}
+
+func (c *JwksClient) GetKeySet(ctx context.Context) (model.JsonWebKeySet, error) {
+	var keySet model.JsonWebKeySet
+	start := time.Now()
+	data, err := doWithRetry(ctx, c.http, c.retryPolicy, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", c.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		return req, nil
+	})
+	telemetry.ObserveRequest(telemetry.UpstreamOidc, "jwks", start, err)
+	if err != nil {
+		return keySet, fmt.Errorf("unable to read JWKS: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &keySet); err != nil {
+		return keySet, fmt.Errorf("unable to parse JWKS: %w", err)
+	}
+	return keySet, nil
+}
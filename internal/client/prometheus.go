@@ -1,93 +1,274 @@
 package client
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/rs/zerolog/log"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/telemetry"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// defaultPrometheusRequestTimeout applies when a source has no request timeout, a day of usage can take a while to evaluate
+const defaultPrometheusRequestTimeout = 2 * time.Minute
+
 type PrometheusClient struct {
 	endpoint string
 	http     *http.Client
+	config   config.PrometheusEndpoint
 }
 
-func NewPrometheusClient(endpoint string) *PrometheusClient {
+func NewPrometheusClient(prometheusConfig config.PrometheusEndpoint) (*PrometheusClient, error) {
+	var err error
+	if prometheusConfig.BearerToken, err = fromEnv(prometheusConfig.BearerToken, prometheusConfig.BearerTokenEnv); err != nil {
+		return nil, err
+	}
+	if prometheusConfig.Password, err = fromEnv(prometheusConfig.Password, prometheusConfig.PasswordEnv); err != nil {
+		return nil, err
+	}
+	if prometheusConfig.BearerToken != "" || prometheusConfig.BearerTokenFile != "" {
+		if prometheusConfig.Username != "" {
+			return nil, errors.New("prometheus bearer token and basic auth are mutually exclusive")
+		}
+	}
+	if (prometheusConfig.CertFile == "") != (prometheusConfig.KeyFile == "") {
+		return nil, errors.New("prometheus mTLS needs both a certificate and a key file")
+	}
+
+	// a hung source must not stall the export loop, so every source gets a client with a timeout
+	timeout := time.Duration(prometheusConfig.RequestTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultPrometheusRequestTimeout
+	}
+	httpClient := &http.Client{Timeout: timeout}
+	if prometheusConfig.CaFile != "" || prometheusConfig.CertFile != "" || prometheusConfig.InsecureSkipVerify {
+		tlsConfig, err := newTlsConfig(prometheusConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prometheus tls configuration: %w", err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		httpClient.Transport = transport
+	}
+
 	return &PrometheusClient{
-		endpoint: endpoint,
-		http:     http.DefaultClient,
+		endpoint: prometheusConfig.Endpoint,
+		http:     httpClient,
+		config:   prometheusConfig,
+	}, nil
+}
+
+func newTlsConfig(prometheusConfig config.PrometheusEndpoint) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: prometheusConfig.InsecureSkipVerify}
+
+	if prometheusConfig.CaFile != "" {
+		caBundle, err := os.ReadFile(prometheusConfig.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in %s", prometheusConfig.CaFile)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if prometheusConfig.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(prometheusConfig.CertFile, prometheusConfig.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
 	}
+	return tlsConfig, nil
 }
 
-func (c *PrometheusClient) Query(query string, time float64) (*QueryResponse, error) {
-	//req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/query_range", c.endpoint), nil)
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/query", c.endpoint), nil)
+// authorize adds the configured credentials, tenant and extra headers to req
+func (c *PrometheusClient) authorize(req *http.Request) error {
+	for _, header := range c.config.Headers {
+		req.Header.Set(header.Name, header.Value)
+	}
+	if c.config.TenantId != "" {
+		req.Header.Set("X-Scope-OrgID", c.config.TenantId)
+	}
+
+	switch {
+	case c.config.BearerTokenFile != "":
+		token, err := readSecretFile(c.config.BearerTokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case c.config.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.config.BearerToken)
+	case c.config.Username != "":
+		password := c.config.Password
+		if c.config.PasswordFile != "" {
+			var err error
+			if password, err = readSecretFile(c.config.PasswordFile); err != nil {
+				return err
+			}
+		}
+		req.SetBasicAuth(c.config.Username, password)
+	}
+	return nil
+}
+
+// fromEnv returns value, or else the value of the environment variable named by env when one is named
+func fromEnv(value string, env string) (string, error) {
+	if value != "" || env == "" {
+		return value, nil
+	}
+	value, ok := os.LookupEnv(env)
+	if !ok || value == "" {
+		return "", fmt.Errorf("environment variable %s with prometheus credentials is not set", env)
+	}
+	return value, nil
+}
+
+// readSecretFile reads a mounted secret, trailing newlines are not part of the secret
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("unable to read secret file: %w", err)
 	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
 
-	queryValues := req.URL.Query()
+// Name identifies the source in logs and metrics
+func (c *PrometheusClient) Name() string {
+	if c.config.Name != "" {
+		return c.config.Name
+	}
+	return c.endpoint
+}
+
+func (c *PrometheusClient) Query(query string, time float64) (*QueryResponse, error) {
+	queryValues := url.Values{}
 	queryValues.Set("query", query)
 	queryValues.Set("time", fmt.Sprintf("%f", time))
+	return c.get("/api/v1/query", queryValues)
+}
+
+// QueryRange evaluates query at every step between start and end, the result is a matrix
+func (c *PrometheusClient) QueryRange(query string, start time.Time, end time.Time, step time.Duration) (*QueryResponse, error) {
+	queryValues := url.Values{}
+	queryValues.Set("query", query)
+	queryValues.Set("start", strconv.FormatInt(start.Unix(), 10))
+	queryValues.Set("end", strconv.FormatInt(end.Unix(), 10))
+	queryValues.Set("step", fmt.Sprintf("%ds", int(step.Seconds())))
+	return c.get("/api/v1/query_range", queryValues)
+}
+
+// get decodes the response while it is read, so large results are never held twice in memory.
+// Failures reported by Prometheus are returned as *PrometheusError, other unsuccessful responses as *ApiError.
+func (c *PrometheusClient) get(path string, queryValues url.Values) (payload *QueryResponse, err error) {
+	defer func(start time.Time) {
+		telemetry.ObserveRequest(telemetry.UpstreamPrometheus, strings.TrimPrefix(path, "/api/v1/"), start, err)
+	}(time.Now())
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s", c.endpoint, path), nil)
+	if err != nil {
+		return nil, err
+	}
 	req.URL.RawQuery = queryValues.Encode()
-	//fmt.Println(req.URL.String())
+	if err := c.authorize(req); err != nil {
+		return nil, err
+	}
 
 	resp, err := c.http.Do(req)
 	if err != nil {
 		return nil, err
 	}
-
 	defer resp.Body.Close()
 
-	data, err := io.ReadAll(resp.Body)
+	payload, err = decodeQueryResponse(resp.Body)
 	if err != nil {
-		return nil, err
+		if resp.StatusCode != http.StatusOK {
+			return nil, &ApiError{StatusCode: resp.StatusCode, Status: resp.Status, Path: req.URL.Path}
+		}
+		return nil, fmt.Errorf("unable to decode prometheus response: %w", err)
+	}
+	if payload.Status != "success" {
+		return payload, &PrometheusError{StatusCode: resp.StatusCode, ErrorType: payload.ErrorType, Message: payload.Error, Warnings: payload.Warnings}
 	}
+	if resp.StatusCode != http.StatusOK {
+		return payload, &ApiError{StatusCode: resp.StatusCode, Status: resp.Status, Path: req.URL.Path}
+	}
+	return payload, nil
+}
 
-	var payload *QueryResponse
+// PrometheusError is returned when Prometheus answers a query with status error
+type PrometheusError struct {
+	StatusCode int
+	// ErrorType is one of the Prometheus API error types, e.g. bad_data, timeout or execution
+	ErrorType string
+	Message   string
+	Warnings  []string
+}
 
-	err = json.Unmarshal(data, &payload)
+func (e *PrometheusError) Error() string {
+	return fmt.Sprintf("prometheus query failed with %s (status %d): %s", e.ErrorType, e.StatusCode, e.Message)
+}
 
-	return payload, err
+// Retryable reports whether the query could succeed if sent again later
+func (e *PrometheusError) Retryable() bool {
+	return e.ErrorType == "timeout" || e.ErrorType == "unavailable" || e.StatusCode == http.StatusServiceUnavailable
 }
 
-// TODO: Revisit to figure out why this looks like it does
-func ResultToVector(data []interface{}) ([]Vector, error) {
-	var casted []vectorMidParse
-	for _, d := range data {
-		var deserialised vectorMidParse
-		serialised, err := json.Marshal(d)
-		if err != nil {
-			log.Fatal().Err(err).Msg("error serialising prometheus response")
-		}
-		err = json.Unmarshal(serialised, &deserialised)
-		if err != nil {
-			log.Fatal().Err(err).Msgf("error deserialising prometheus response: %s", string(serialised))
-		}
+type ResultType string
 
-		casted = append(casted, deserialised)
-	}
-	var payload []Vector
-
-	for _, vec := range casted {
-		newVec := Vector{
-			Metric: VectorMetricLabel{
-				Instance:    vec.Metric.Instance,
-				Job:         vec.Metric.Job,
-				KafkaID:     vec.Metric.KafkaID,
-				Topic:       vec.Metric.Topic,
-				PrincipalId: vec.Metric.PrincipalId,
-				Type:        vec.Metric.Type,
-			},
-			Value: VectorValue{},
-		}
-		newVec.Value.Time = vec.Value[0].(float64)
-		newVec.Value.Value = vec.Value[1].(string)
-		payload = append(payload, newVec)
+const (
+	ResultTypeVector ResultType = "vector"
+	ResultTypeMatrix ResultType = "matrix"
+	ResultTypeScalar ResultType = "scalar"
+	ResultTypeString ResultType = "string"
+)
+
+type QueryResponse struct {
+	Status    string
+	ErrorType string
+	Error     string
+	Warnings  []string
+	Infos     []string
+	Data      QueryData
+}
+
+// QueryData holds the result, only the field matching ResultType is set
+type QueryData struct {
+	ResultType ResultType
+	Vector     []Vector
+	Matrix     []Matrix
+	Scalar     *VectorValue
+	String     *VectorValue
+}
+
+// ToVector returns the result of an instant query
+func (r *QueryResponse) ToVector() ([]Vector, error) {
+	if r.Data.ResultType != ResultTypeVector {
+		return nil, fmt.Errorf("expected a %s result, got %s", ResultTypeVector, r.Data.ResultType)
 	}
+	return r.Data.Vector, nil
+}
 
-	return payload, nil
+// ToMatrix returns the result of a range query
+func (r *QueryResponse) ToMatrix() ([]Matrix, error) {
+	if r.Data.ResultType != ResultTypeMatrix {
+		return nil, fmt.Errorf("expected a %s result, got %s", ResultTypeMatrix, r.Data.ResultType)
+	}
+	return r.Data.Matrix, nil
 }
 
 type Vector struct {
@@ -95,36 +276,207 @@ type Vector struct {
 	Value  VectorValue       `json:"value"`
 }
 
+// Matrix is a series of a range query result
+type Matrix struct {
+	Metric VectorMetricLabel `json:"metric"`
+	Values []VectorValue     `json:"values"`
+}
+
+// VectorMetricLabel has the labels the exporter works with as fields, Labels holds every label of the series
 type VectorMetricLabel struct {
-	Instance    string `json:"instance"`
-	Job         string `json:"job"`
-	KafkaID     string `json:"kafka_id"`
-	Topic       string `json:"topic"`
-	PrincipalId string `json:"principal_id"`
-	Type        string `json:"type"`
+	Instance    string
+	Job         string
+	KafkaID     string
+	Topic       string
+	PrincipalId string
+	Type        string
+	Labels      map[string]string
 }
 
+func (l *VectorMetricLabel) UnmarshalJSON(data []byte) error {
+	var labels map[string]string
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return err
+	}
+	*l = VectorMetricLabel{
+		Instance:    labels["instance"],
+		Job:         labels["job"],
+		KafkaID:     labels["kafka_id"],
+		Topic:       labels["topic"],
+		PrincipalId: labels["principal_id"],
+		Type:        labels["type"],
+		Labels:      labels,
+	}
+	return nil
+}
+
+// VectorValue is a sample, Prometheus sends it as [time, "value"]
 type VectorValue struct {
 	Time  float64
 	Value string
 }
 
-type vectorMidParse struct {
-	Metric struct {
-		Instance    string `json:"instance"`
-		Job         string `json:"job"`
-		KafkaID     string `json:"kafka_id"`
-		Topic       string `json:"topic"`
-		PrincipalId string `json:"principal_id"`
-		Type        string `json:"type"`
-	} `json:"metric"`
-	Value []interface{} `json:"value"`
+func (v *VectorValue) UnmarshalJSON(data []byte) error {
+	var sample []json.RawMessage
+	if err := json.Unmarshal(data, &sample); err != nil {
+		return fmt.Errorf("unexpected sample %s: %w", data, err)
+	}
+	if len(sample) != 2 {
+		return fmt.Errorf("unexpected sample %s, expected [time, value]", data)
+	}
+	if err := json.Unmarshal(sample[0], &v.Time); err != nil {
+		return fmt.Errorf("unexpected sample time %s: %w", sample[0], err)
+	}
+	if err := json.Unmarshal(sample[1], &v.Value); err != nil {
+		return fmt.Errorf("unexpected sample value %s: %w", sample[1], err)
+	}
+	return nil
 }
 
-type QueryResponse struct {
-	Status string `json:"status"`
-	Data   struct {
-		ResultType string        `json:"resultType"`
-		Result     []interface{} `json:"result"`
-	} `json:"data"`
+func (v VectorValue) Float() (float64, error) {
+	return strconv.ParseFloat(v.Value, 64)
+}
+
+// decodeQueryResponse walks the response token by token, decoding result elements one at a time
+func decodeQueryResponse(r io.Reader) (*QueryResponse, error) {
+	decoder := json.NewDecoder(r)
+	payload := &QueryResponse{}
+
+	err := decodeObject(decoder, func(key string) error {
+		switch key {
+		case "status":
+			return decoder.Decode(&payload.Status)
+		case "errorType":
+			return decoder.Decode(&payload.ErrorType)
+		case "error":
+			return decoder.Decode(&payload.Error)
+		case "warnings":
+			return decoder.Decode(&payload.Warnings)
+		case "infos":
+			return decoder.Decode(&payload.Infos)
+		case "data":
+			return decodeQueryData(decoder, &payload.Data)
+		}
+		return skipValue(decoder)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func decodeQueryData(decoder *json.Decoder, data *QueryData) error {
+	// the result can only be streamed once its type is known, Prometheus sends resultType first
+	var bufferedResult json.RawMessage
+	err := decodeObject(decoder, func(key string) error {
+		switch key {
+		case "resultType":
+			return decoder.Decode(&data.ResultType)
+		case "result":
+			if data.ResultType == "" {
+				return decoder.Decode(&bufferedResult)
+			}
+			return decodeResult(decoder, data)
+		}
+		return skipValue(decoder)
+	})
+	if err != nil || bufferedResult == nil {
+		return err
+	}
+	return decodeResult(json.NewDecoder(bytes.NewReader(bufferedResult)), data)
+}
+
+func decodeResult(decoder *json.Decoder, data *QueryData) error {
+	switch data.ResultType {
+	case ResultTypeVector:
+		return decodeArray(decoder, func() error {
+			var vector Vector
+			if err := decoder.Decode(&vector); err != nil {
+				return err
+			}
+			data.Vector = append(data.Vector, vector)
+			return nil
+		})
+	case ResultTypeMatrix:
+		return decodeArray(decoder, func() error {
+			var matrix Matrix
+			if err := decoder.Decode(&matrix); err != nil {
+				return err
+			}
+			data.Matrix = append(data.Matrix, matrix)
+			return nil
+		})
+	case ResultTypeScalar:
+		data.Scalar = &VectorValue{}
+		return decoder.Decode(data.Scalar)
+	case ResultTypeString:
+		data.String = &VectorValue{}
+		return decoder.Decode(data.String)
+	}
+	return fmt.Errorf("unknown result type %s", data.ResultType)
+}
+
+// decodeObject calls decodeValue for every key of the next object, decodeValue has to consume the value.
+// A null object has no keys.
+func decodeObject(decoder *json.Decoder, decodeValue func(key string) error) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("expected an object, got %v", token)
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("expected an object key, got %v", token)
+		}
+		if err := decodeValue(key); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return expectDelim(decoder, '}')
+}
+
+// decodeArray calls decodeElement for every element of the next array, a null array has no elements
+func decodeArray(decoder *json.Decoder, decodeElement func() error) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected an array, got %v", token)
+	}
+	for decoder.More() {
+		if err := decodeElement(); err != nil {
+			return err
+		}
+	}
+	return expectDelim(decoder, ']')
+}
+
+func expectDelim(decoder *json.Decoder, expected json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != expected {
+		return fmt.Errorf("expected %s, got %v", expected, token)
+	}
+	return nil
+}
+
+func skipValue(decoder *json.Decoder) error {
+	var skipped json.RawMessage
+	return decoder.Decode(&skipped)
 }
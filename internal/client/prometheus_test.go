@@ -0,0 +1,37 @@
+package client_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+)
+
+func TestPrometheusQueryTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a hung Prometheus never answers
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	prometheusClient, err := client.NewPrometheusClient(config.PrometheusEndpoint{Endpoint: server.URL, RequestTimeoutSeconds: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := prometheusClient.Query("up", float64(start.Unix())); err == nil {
+		t.Fatal("got no error from a source that never answers")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("query gave up after %s, want it to give up after the 1s timeout", elapsed)
+	}
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrUnauthorized is wrapped by ApiError when the upstream rejected the configured credentials
+var ErrUnauthorized = errors.New("credentials were rejected")
+
+// ApiError is returned when an upstream API answers with a non successful status code
+type ApiError struct {
+	StatusCode int
+	Status     string
+	Path       string
+	RetryAfter time.Duration
+}
+
+func (e *ApiError) Error() string {
+	if e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden {
+		return fmt.Sprintf("got response %s when attempting to call %s: %s", e.Status, e.Path, ErrUnauthorized)
+	}
+	return fmt.Sprintf("got response %s when attempting to call %s", e.Status, e.Path)
+}
+
+func (e *ApiError) Unwrap() error {
+	if e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// Retryable reports whether the same request could succeed if sent again later
+func (e *ApiError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+// IsRetryable classifies errors returned while calling an upstream API.
+// Throttling, server errors and network failures are retryable, everything else is not.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var retryable interface{ Retryable() bool }
+	if errors.As(err, &retryable) {
+		return retryable.Retryable()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	RequestTimeout time.Duration
+}
+
+// backoff returns a jittered exponential delay for the given zero-based attempt, capped at MaxBackoff
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff << attempt
+	if delay <= 0 || delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// doWithRetry sends the request built by newRequest until it succeeds, fails with a non retryable error,
+// MaxAttempts is reached or ctx is done. The body of the successful response is returned.
+func doWithRetry(ctx context.Context, httpClient *http.Client, policy RetryPolicy, newRequest func(ctx context.Context) (*http.Request, error)) ([]byte, error) {
+	attempts := policy.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := policy.backoff(attempt - 1)
+			var apiErr *ApiError
+			if errors.As(lastErr, &apiErr) && apiErr.RetryAfter > delay {
+				delay = apiErr.RetryAfter
+				// a far away Retry-After must not hold up the caller longer than any other backoff
+				if policy.MaxBackoff > 0 && delay > policy.MaxBackoff {
+					delay = policy.MaxBackoff
+				}
+			}
+			log.Warn().Err(lastErr).Msgf("retrying request in %s (attempt %d of %d)", delay, attempt+1, attempts)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		data, err := doOnce(ctx, httpClient, policy.RequestTimeout, newRequest)
+		if err == nil {
+			return data, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil || !IsRetryable(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", attempts, lastErr)
+}
+
+func doOnce(ctx context.Context, httpClient *http.Client, timeout time.Duration, newRequest func(ctx context.Context) (*http.Request, error)) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := newRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, &ApiError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Path:       req.URL.Path,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// parseRetryAfter understands both the delay-seconds and the HTTP-date form of the Retry-After header
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
@@ -3,21 +3,36 @@ package client
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/telemetry"
+	"io"
+	"time"
 )
 
+// ErrObjectNotFound is returned by GetObject when there is no object under the key
+var ErrObjectNotFound = errors.New("object not found")
+
 type S3Client struct {
 	client *s3.Client
 }
 
-func NewS3Client(cfg aws.Config) (*S3Client, error) {
-	s3Client := s3.NewFromConfig(cfg)
+func NewS3Client(cfg aws.Config, s3Config config.S3) (*S3Client, error) {
+	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if s3Config.Endpoint != "" {
+			o.BaseEndpoint = aws.String(s3Config.Endpoint)
+		}
+		o.UsePathStyle = s3Config.UsePathStyle
+	})
 	return &S3Client{client: s3Client}, nil
 }
 
 func (c *S3Client) PutObject(bucket, key string, data []byte) error {
+	start := time.Now()
 	_, err := c.client.PutObject(context.Background(),
 		&s3.PutObjectInput{
 			Bucket: aws.String(bucket),
@@ -25,9 +40,76 @@ func (c *S3Client) PutObject(bucket, key string, data []byte) error {
 			Body:   bytes.NewReader(data),
 		},
 	)
+	telemetry.ObserveRequest(telemetry.UpstreamS3, "put_object", start, err)
 	if err != nil {
 		return fmt.Errorf("error putting object: %w", err)
 	}
 
 	return nil
 }
+
+func (c *S3Client) GetObject(bucket, key string) ([]byte, error) {
+	start := time.Now()
+	resp, err := c.client.GetObject(context.Background(),
+		&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		},
+	)
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		telemetry.ObserveRequest(telemetry.UpstreamS3, "get_object", start, nil)
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	telemetry.ObserveRequest(telemetry.UpstreamS3, "get_object", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("error getting object: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// HeadObject reports whether an object exists under key
+func (c *S3Client) HeadObject(bucket, key string) (bool, error) {
+	start := time.Now()
+	_, err := c.client.HeadObject(context.Background(),
+		&s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		},
+	)
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		telemetry.ObserveRequest(telemetry.UpstreamS3, "head_object", start, nil)
+		return false, nil
+	}
+	telemetry.ObserveRequest(telemetry.UpstreamS3, "head_object", start, err)
+	if err != nil {
+		return false, fmt.Errorf("error getting object metadata: %w", err)
+	}
+
+	return true, nil
+}
+
+// ListObjects returns the keys of all objects starting with prefix
+func (c *S3Client) ListObjects(bucket, prefix string) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(c.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		start := time.Now()
+		page, err := paginator.NextPage(context.Background())
+		telemetry.ObserveRequest(telemetry.UpstreamS3, "list_objects", start, err)
+		if err != nil {
+			return nil, fmt.Errorf("error listing objects: %w", err)
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,252 @@
+// Package fake provides httptest servers standing in for the upstream APIs used by the exporter,
+// so the exporter can be run without network access to Confluent Cloud, Prometheus or AWS.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ConfluentCloudServer serves the billing, environment, cluster and IAM endpoints of the Confluent Cloud API,
+// and doubles as the Kafka REST v3 endpoint of every cluster added.
+// Responses are paginated with PageSize entries per page and a next cursor like the real API.
+type ConfluentCloudServer struct {
+	*httptest.Server
+	PageSize int
+	// LoopCursor makes the last page point back at the first one, like a misbehaving API
+	LoopCursor bool
+
+	mu        sync.Mutex
+	costLines []model.ConfluentCostLine
+	clusters  map[string][]clusterEntry
+	requests  []string
+
+	topics          map[string][]model.KafkaTopic
+	serviceAccounts []model.ConfluentServiceAccount
+	apiKeys         []model.ConfluentApiKey
+}
+
+type clusterEntry struct {
+	id          string
+	displayName string
+	kind        string
+}
+
+func NewConfluentCloudServer() *ConfluentCloudServer {
+	s := &ConfluentCloudServer{
+		PageSize: 100,
+		clusters: make(map[string][]clusterEntry),
+		topics:   make(map[string][]model.KafkaTopic),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/billing/v1/costs", s.handleCosts)
+	mux.HandleFunc("/org/v2/environments", s.handleEnvironments)
+	mux.HandleFunc("/cmk/v2/clusters", s.handleClusters)
+	mux.HandleFunc("/iam/v2/service-accounts", s.handleServiceAccounts)
+	mux.HandleFunc("/iam/v2/api-keys", s.handleApiKeys)
+	mux.HandleFunc("/kafka/v3/clusters/", s.handleTopics)
+	s.Server = httptest.NewServer(s.recordRequests(mux))
+	return s
+}
+
+// AddCostLines adds billing lines, they are returned for requests whose date range covers their start_date
+func (s *ConfluentCloudServer) AddCostLines(lines ...model.ConfluentCostLine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.costLines = append(s.costLines, lines...)
+}
+
+// AddCluster adds a cluster of kind, e.g. Dedicated or Standard, to the environment
+func (s *ConfluentCloudServer) AddCluster(environmentId string, clusterId string, displayName string, kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clusters[environmentId] = append(s.clusters[environmentId], clusterEntry{id: clusterId, displayName: displayName, kind: kind})
+}
+
+// AddTopic adds a topic to the Kafka REST v3 topic listing of the cluster
+func (s *ConfluentCloudServer) AddTopic(clusterId string, topic string, partitions int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.topics[clusterId] = append(s.topics[clusterId], model.KafkaTopic{TopicName: topic, PartitionsCount: partitions})
+}
+
+func (s *ConfluentCloudServer) AddServiceAccount(id string, displayName string, description string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serviceAccounts = append(s.serviceAccounts, model.ConfluentServiceAccount{Id: id, DisplayName: displayName, Description: description})
+}
+
+// AddApiKey adds an API key owned by the service account ownerId
+func (s *ConfluentCloudServer) AddApiKey(id string, ownerId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	apiKey := model.ConfluentApiKey{Id: id}
+	apiKey.Spec.DisplayName = id
+	apiKey.Spec.Owner.Id = ownerId
+	apiKey.Spec.Owner.Kind = "ServiceAccount"
+	s.apiKeys = append(s.apiKeys, apiKey)
+}
+
+// Requests returns the request URIs received so far, in the order they arrived
+func (s *ConfluentCloudServer) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *ConfluentCloudServer) recordRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.URL.RequestURI())
+		s.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *ConfluentCloudServer) handleCosts(w http.ResponseWriter, r *http.Request) {
+	startDate := r.URL.Query().Get("start_date")
+	endDate := r.URL.Query().Get("end_date")
+
+	s.mu.Lock()
+	var lines []model.ConfluentCostLine
+	for _, line := range s.costLines {
+		if line.StartDate >= startDate && line.StartDate < endDate {
+			lines = append(lines, line)
+		}
+	}
+	s.mu.Unlock()
+
+	page, next := s.paginate(r, len(lines))
+	payload := model.ConfluentCostResponse{
+		ApiVersion: "billing/v1",
+		Kind:       "CostList",
+		Data:       lines[page.from:page.to],
+	}
+	payload.Metadata.Next = next
+	writeJson(w, payload)
+}
+
+func (s *ConfluentCloudServer) handleEnvironments(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	payload := model.ConfluentEnvironmentsResponse{ApiVersion: "org/v2", Kind: "EnvironmentList"}
+	environmentIds := make([]string, 0, len(s.clusters))
+	for environmentId := range s.clusters {
+		environmentIds = append(environmentIds, environmentId)
+	}
+	sort.Strings(environmentIds)
+	for _, environmentId := range environmentIds {
+		payload.Data = append(payload.Data, model.ConfluentEnvironment{Id: environmentId, DisplayName: environmentId})
+	}
+	s.mu.Unlock()
+
+	page, next := s.paginate(r, len(payload.Data))
+	payload.Data = payload.Data[page.from:page.to]
+	payload.Metadata.Next = next
+	writeJson(w, payload)
+}
+
+func (s *ConfluentCloudServer) handleClusters(w http.ResponseWriter, r *http.Request) {
+	environmentId := r.URL.Query().Get("environment")
+
+	s.mu.Lock()
+	payload := model.ConfluentClustersResponse{ApiVersion: "cmk/v2", Kind: "ClusterList"}
+	for _, cluster := range s.clusters[environmentId] {
+		entry := model.ConfluentClusterResource{Id: cluster.id}
+		entry.Spec.DisplayName = cluster.displayName
+		entry.Spec.Environment.Id = environmentId
+		entry.Spec.HttpEndpoint = s.URL
+		entry.Spec.Config.Kind = cluster.kind
+		payload.Data = append(payload.Data, entry)
+	}
+	s.mu.Unlock()
+
+	page, next := s.paginate(r, len(payload.Data))
+	payload.Data = payload.Data[page.from:page.to]
+	payload.Metadata.Next = next
+	writeJson(w, payload)
+}
+
+func (s *ConfluentCloudServer) handleServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	payload := model.ConfluentServiceAccountsResponse{ApiVersion: "iam/v2", Kind: "ServiceAccountList"}
+	payload.Data = append(payload.Data, s.serviceAccounts...)
+	s.mu.Unlock()
+
+	page, next := s.paginate(r, len(payload.Data))
+	payload.Data = payload.Data[page.from:page.to]
+	payload.Metadata.Next = next
+	writeJson(w, payload)
+}
+
+func (s *ConfluentCloudServer) handleApiKeys(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	payload := model.ConfluentApiKeysResponse{ApiVersion: "iam/v2", Kind: "ApiKeyList"}
+	payload.Data = append(payload.Data, s.apiKeys...)
+	s.mu.Unlock()
+
+	page, next := s.paginate(r, len(payload.Data))
+	payload.Data = payload.Data[page.from:page.to]
+	payload.Metadata.Next = next
+	writeJson(w, payload)
+}
+
+func (s *ConfluentCloudServer) handleTopics(w http.ResponseWriter, r *http.Request) {
+	clusterId, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/kafka/v3/clusters/"), "/topics")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	payload := model.KafkaTopicsResponse{Kind: "KafkaTopicList"}
+	payload.Data = append(payload.Data, s.topics[clusterId]...)
+	s.mu.Unlock()
+
+	page, next := s.paginate(r, len(payload.Data))
+	payload.Data = payload.Data[page.from:page.to]
+	payload.Metadata.Next = next
+	writeJson(w, payload)
+}
+
+type pageBounds struct {
+	from int
+	to   int
+}
+
+// paginate works out which slice of total entries the request asked for, using the offset carried in page_token.
+// The returned cursor is empty on the last page.
+func (s *ConfluentCloudServer) paginate(r *http.Request, total int) (pageBounds, string) {
+	pageSize := s.PageSize
+	if requested, err := strconv.Atoi(r.URL.Query().Get("page_size")); err == nil && requested > 0 && requested < pageSize {
+		pageSize = requested
+	}
+	from, _ := strconv.Atoi(r.URL.Query().Get("page_token"))
+	if from > total {
+		from = total
+	}
+	bounds := pageBounds{from: from, to: from + pageSize}
+	if bounds.to >= total {
+		bounds.to = total
+		if !s.LoopCursor || total == 0 {
+			return bounds, ""
+		}
+	}
+
+	nextQuery := r.URL.Query()
+	nextQuery.Set("page_token", strconv.Itoa(bounds.to%total))
+	return bounds, fmt.Sprintf("%s%s?%s", s.URL, r.URL.Path, nextQuery.Encode())
+}
+
+func writeJson(w http.ResponseWriter, payload any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,121 @@
+package fake
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrometheusServer serves /api/v1/query and /api/v1/query_range. Any query mentioning a metric name is answered with every series added
+// for that metric, which keeps it independent of the functions the exporter wraps around the metric.
+// Range queries get the same value at every step.
+type PrometheusServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	series map[string][]fakeSeries
+}
+
+type fakeSeries struct {
+	labels map[string]string
+	value  float64
+}
+
+func NewPrometheusServer() *PrometheusServer {
+	s := &PrometheusServer{
+		series: make(map[string][]fakeSeries),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/query", s.handleQuery)
+	mux.HandleFunc("/api/v1/query_range", s.handleQueryRange)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *PrometheusServer) AddSeries(metricName string, labels map[string]string, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.series[metricName] = append(s.series[metricName], fakeSeries{labels: labels, value: value})
+}
+
+// AddTopicSeries adds a series with the kafka_id and topic labels exported by the Confluent metrics endpoint
+func (s *PrometheusServer) AddTopicSeries(metricName string, clusterId string, topic string, value float64) {
+	s.AddSeries(metricName, map[string]string{"kafka_id": clusterId, "topic": topic}, value)
+}
+
+func (s *PrometheusServer) handleQuery(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+	evaluationTime := float64(time.Now().Unix())
+	if requested := r.FormValue("time"); requested != "" {
+		_, _ = fmt.Sscanf(requested, "%f", &evaluationTime)
+	}
+
+	s.mu.Lock()
+	result := []map[string]any{}
+	for metricName, series := range s.series {
+		if !strings.Contains(query, metricName) {
+			continue
+		}
+		for _, entry := range series {
+			result = append(result, map[string]any{
+				"metric": entry.labels,
+				"value":  []any{evaluationTime, fmt.Sprintf("%f", entry.value)},
+			})
+		}
+	}
+	s.mu.Unlock()
+
+	writeJson(w, map[string]any{
+		"status": "success",
+		"data": map[string]any{
+			"resultType": "vector",
+			"result":     result,
+		},
+	})
+}
+
+func (s *PrometheusServer) handleQueryRange(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+	var start, end, step float64
+	_, _ = fmt.Sscanf(r.FormValue("start"), "%f", &start)
+	_, _ = fmt.Sscanf(r.FormValue("end"), "%f", &end)
+	if duration, err := time.ParseDuration(r.FormValue("step")); err == nil {
+		step = duration.Seconds()
+	} else {
+		_, _ = fmt.Sscanf(r.FormValue("step"), "%f", &step)
+	}
+	if step <= 0 || end < start {
+		http.Error(w, "invalid range", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	result := []map[string]any{}
+	for metricName, series := range s.series {
+		if !strings.Contains(query, metricName) {
+			continue
+		}
+		for _, entry := range series {
+			values := [][]any{}
+			for timestamp := start; timestamp <= end; timestamp += step {
+				values = append(values, []any{timestamp, fmt.Sprintf("%f", entry.value)})
+			}
+			result = append(result, map[string]any{
+				"metric": entry.labels,
+				"values": values,
+			})
+		}
+	}
+	s.mu.Unlock()
+
+	writeJson(w, map[string]any{
+		"status": "success",
+		"data": map[string]any{
+			"resultType": "matrix",
+			"result":     result,
+		},
+	})
+}
@@ -0,0 +1,143 @@
+package fake
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// S3Server is a minimal path-style S3 compatible server keeping objects in memory.
+// It understands PUT, HEAD and GET on /{bucket}/{key} and ListObjectsV2 on /{bucket}.
+type S3Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]map[string][]byte
+	// requests holds the method and URI of every request received
+	requests []string
+}
+
+func NewS3Server() *S3Server {
+	s := &S3Server{
+		objects: make(map[string]map[string][]byte),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Requests returns the method and URI of the requests received so far, in the order they arrived
+func (s *S3Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// Object returns the content stored under bucket and key
+func (s *S3Server) Object(bucket string, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[bucket][key]
+	return data, ok
+}
+
+func (s *S3Server) PutObject(bucket string, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[bucket]; !ok {
+		s.objects[bucket] = make(map[string][]byte)
+	}
+	s.objects[bucket][key] = data
+}
+
+func (s *S3Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.RequestURI())
+	s.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		http.Error(w, "missing bucket", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && r.URL.Query().Get("list-type") == "2":
+		s.listObjects(w, bucket, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.PutObject(bucket, key, data)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		data, ok := s.Object(bucket, key)
+		if !ok && r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(xml.Header + "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>"))
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name         `xml:"ListBucketResult"`
+	Xmlns       string           `xml:"xmlns,attr"`
+	Name        string           `xml:"Name"`
+	Prefix      string           `xml:"Prefix"`
+	KeyCount    int              `xml:"KeyCount"`
+	MaxKeys     int              `xml:"MaxKeys"`
+	IsTruncated bool             `xml:"IsTruncated"`
+	Contents    []listBucketItem `xml:"Contents"`
+}
+
+type listBucketItem struct {
+	Key  string `xml:"Key"`
+	Size int    `xml:"Size"`
+}
+
+func (s *S3Server) listObjects(w http.ResponseWriter, bucket string, prefix string) {
+	result := listBucketResult{
+		Xmlns:   "http://s3.amazonaws.com/doc/2006-03-01/",
+		Name:    bucket,
+		Prefix:  prefix,
+		MaxKeys: 1000,
+	}
+
+	s.mu.Lock()
+	for key, data := range s.objects[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, listBucketItem{Key: key, Size: len(data)})
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(result.Contents, func(i, j int) bool {
+		return result.Contents[i].Key < result.Contents[j].Key
+	})
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -2,10 +2,9 @@ package metrics
 
 import (
 	"fmt"
+	"go.dfds.cloud/ccc-exporter/internal/capability"
 	"go.dfds.cloud/ccc-exporter/internal/model"
 	"go.dfds.cloud/ccc-exporter/internal/service"
-	"log"
-	"regexp"
 	"strconv"
 )
 
@@ -14,12 +13,7 @@ type ByCapabilityResponse struct {
 	DaysTopicTotal map[model.CapabilityId]map[model.ClusterId]map[model.TopicName]map[model.MetricKey]float64
 }
 
-func ByCapability(allMetrics *service.AllMetricsResponse) ByCapabilityResponse {
-	pattern, err := regexp.Compile("(pub.)?(.*-.{5})\\.")
-	if err != nil {
-		log.Fatal(err)
-	}
-
+func ByCapability(allMetrics *service.AllMetricsResponse, resolver *capability.Resolver) ByCapabilityResponse {
 	payload := ByCapabilityResponse{}
 
 	daysTotal := make(map[model.CapabilityId]map[model.ClusterId]map[model.MetricKey]float64)
@@ -28,36 +22,37 @@ func ByCapability(allMetrics *service.AllMetricsResponse) ByCapabilityResponse {
 	for metricKey, v := range allMetrics.Days30 {
 		for clusterId, vv := range v {
 			for topic, value := range vv {
-				capabilityRootId := pattern.FindStringSubmatch(topic)
+				match := resolver.Resolve(topic)
 
-				if len(capabilityRootId) > 2 { // matching pattern of Capability rootid
+				if match.Matched() { // matching a capability rule or override
+					capabilityId := model.CapabilityId(match.Capability)
 					// Check that map exists
-					if _, ok := daysTotal[model.CapabilityId(capabilityRootId[2])]; !ok {
-						daysTotal[model.CapabilityId(capabilityRootId[2])] = make(map[model.ClusterId]map[model.MetricKey]float64)
+					if _, ok := daysTotal[capabilityId]; !ok {
+						daysTotal[capabilityId] = make(map[model.ClusterId]map[model.MetricKey]float64)
 					}
-					if _, ok := daysTotal[model.CapabilityId(capabilityRootId[2])][clusterId]; !ok {
-						daysTotal[model.CapabilityId(capabilityRootId[2])][clusterId] = make(map[model.MetricKey]float64)
+					if _, ok := daysTotal[capabilityId][clusterId]; !ok {
+						daysTotal[capabilityId][clusterId] = make(map[model.MetricKey]float64)
 					}
-					if _, ok := daysTopicTotal[model.CapabilityId(capabilityRootId[2])]; !ok {
-						daysTopicTotal[model.CapabilityId(capabilityRootId[2])] = make(map[model.ClusterId]map[model.TopicName]map[model.MetricKey]float64)
+					if _, ok := daysTopicTotal[capabilityId]; !ok {
+						daysTopicTotal[capabilityId] = make(map[model.ClusterId]map[model.TopicName]map[model.MetricKey]float64)
 					}
-					if _, ok := daysTopicTotal[model.CapabilityId(capabilityRootId[2])][clusterId]; !ok {
-						daysTopicTotal[model.CapabilityId(capabilityRootId[2])][clusterId] = make(map[model.TopicName]map[model.MetricKey]float64)
+					if _, ok := daysTopicTotal[capabilityId][clusterId]; !ok {
+						daysTopicTotal[capabilityId][clusterId] = make(map[model.TopicName]map[model.MetricKey]float64)
 					}
-					if _, ok := daysTopicTotal[model.CapabilityId(capabilityRootId[2])][clusterId][model.TopicName(topic)]; !ok {
-						daysTopicTotal[model.CapabilityId(capabilityRootId[2])][clusterId][model.TopicName(topic)] = make(map[model.MetricKey]float64)
+					if _, ok := daysTopicTotal[capabilityId][clusterId][model.TopicName(topic)]; !ok {
+						daysTopicTotal[capabilityId][clusterId][model.TopicName(topic)] = make(map[model.MetricKey]float64)
 					}
 
 					// check if key exists
-					if _, ok := daysTotal[model.CapabilityId(capabilityRootId[2])][clusterId][metricKey]; ok {
-						daysTotal[model.CapabilityId(capabilityRootId[2])][clusterId][metricKey] = daysTotal[model.CapabilityId(capabilityRootId[2])][clusterId][metricKey] + value
+					if _, ok := daysTotal[capabilityId][clusterId][metricKey]; ok {
+						daysTotal[capabilityId][clusterId][metricKey] = daysTotal[capabilityId][clusterId][metricKey] + value
 					} else {
-						daysTotal[model.CapabilityId(capabilityRootId[2])][clusterId][metricKey] = value
+						daysTotal[capabilityId][clusterId][metricKey] = value
 					}
-					if _, ok := daysTopicTotal[model.CapabilityId(capabilityRootId[2])][clusterId][model.TopicName(topic)][metricKey]; ok {
-						daysTopicTotal[model.CapabilityId(capabilityRootId[2])][clusterId][model.TopicName(topic)][metricKey] = daysTopicTotal[model.CapabilityId(capabilityRootId[2])][clusterId][model.TopicName(topic)][metricKey] + value
+					if _, ok := daysTopicTotal[capabilityId][clusterId][model.TopicName(topic)][metricKey]; ok {
+						daysTopicTotal[capabilityId][clusterId][model.TopicName(topic)][metricKey] = daysTopicTotal[capabilityId][clusterId][model.TopicName(topic)][metricKey] + value
 					} else {
-						daysTopicTotal[model.CapabilityId(capabilityRootId[2])][clusterId][model.TopicName(topic)][metricKey] = value
+						daysTopicTotal[capabilityId][clusterId][model.TopicName(topic)][metricKey] = value
 					}
 
 				} else { // everything else
@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+// OtherLabel replaces the capability or topic of the series that did not fit within the cardinality limits
+const OtherLabel = "_OTHER"
+
+var (
+	capabilityCostDesc = prometheus.NewDesc("ccc_capability_cost",
+		"Cost allocated to a capability on the latest exported day, in the currency of the Confluent invoice.",
+		[]string{"capability", "cluster_id", "action"}, nil)
+	topicUsageDesc = prometheus.NewDesc("ccc_topic_usage_bytes",
+		"Usage of a topic on the latest exported day.",
+		[]string{"topic", "cluster_id", "metric"}, nil)
+	costDayDesc = prometheus.NewDesc("ccc_cost_day_timestamp_seconds",
+		"Start of the day the ccc_capability_cost and ccc_topic_usage_bytes series are for.",
+		nil, nil)
+	foldedSeriesDesc = prometheus.NewDesc("ccc_cost_folded_series",
+		"Series over the cardinality limit that were added up under _OTHER.",
+		[]string{"metric"}, nil)
+)
+
+type costSeries struct {
+	labels [3]string
+	value  float64
+}
+
+// CostCollector publishes the allocated costs and topic usage of the latest exported day.
+// Nothing is published until the first Update.
+type CostCollector struct {
+	mu sync.RWMutex
+
+	maxCapabilitySeries int
+	maxTopicSeries      int
+
+	day             util.YearMonthDayDate
+	capabilityCosts []costSeries
+	topicUsage      []costSeries
+	folded          map[string]int
+}
+
+func NewCostCollector(costMetricsConfig config.CostMetrics) *CostCollector {
+	return &CostCollector{
+		maxCapabilitySeries: costMetricsConfig.MaxCapabilitySeries,
+		maxTopicSeries:      costMetricsConfig.MaxTopicSeries,
+	}
+}
+
+// Update replaces the published day with the rows and usage of a day, days older than the published one are ignored
+func (c *CostCollector) Update(rows []model.ExportRow, usage model.MetricsDataForDay) {
+	capabilityCosts := make(map[[3]string]float64)
+	for _, row := range rows {
+		capabilityCosts[[3]string{row.Capability, row.ClusterId, row.Action}] += row.Cost
+	}
+	topicUsage := make(map[[3]string]float64)
+	for metricKey, clusters := range usage.Topics {
+		for clusterId, topics := range clusters {
+			for topic, data := range topics {
+				topicUsage[[3]string{string(topic), string(clusterId), metricKey.ToCsvFormatString()}] += data.Value
+			}
+		}
+	}
+
+	capabilitySeries, foldedCapabilities := limitSeries(capabilityCosts, c.maxCapabilitySeries)
+	topicSeries, foldedTopics := limitSeries(topicUsage, c.maxTopicSeries)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.folded != nil && usage.DayDate.ToTimeUTC().Before(c.day.ToTimeUTC()) {
+		return
+	}
+	c.day = usage.DayDate
+	c.capabilityCosts = capabilitySeries
+	c.topicUsage = topicSeries
+	c.folded = map[string]int{
+		"ccc_capability_cost":   foldedCapabilities,
+		"ccc_topic_usage_bytes": foldedTopics,
+	}
+}
+
+// Day returns the day currently published, ok is false before the first Update
+func (c *CostCollector) Day() (util.YearMonthDayDate, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.day, c.folded != nil
+}
+
+func (c *CostCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- capabilityCostDesc
+	ch <- topicUsageDesc
+	ch <- costDayDesc
+	ch <- foldedSeriesDesc
+}
+
+func (c *CostCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.folded == nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(costDayDesc, prometheus.GaugeValue, float64(c.day.ToTimeUTC().Unix()))
+	for _, series := range c.capabilityCosts {
+		ch <- prometheus.MustNewConstMetric(capabilityCostDesc, prometheus.GaugeValue, series.value, series.labels[:]...)
+	}
+	for _, series := range c.topicUsage {
+		ch <- prometheus.MustNewConstMetric(topicUsageDesc, prometheus.GaugeValue, series.value, series.labels[:]...)
+	}
+	for metric, folded := range c.folded {
+		ch <- prometheus.MustNewConstMetric(foldedSeriesDesc, prometheus.GaugeValue, float64(folded), metric)
+	}
+}
+
+// limitSeries keeps the limit largest series. The others are added up per cluster and second label
+// under OtherLabel, so totals stay the same. The number of series added up is returned as well.
+func limitSeries(values map[[3]string]float64, limit int) ([]costSeries, int) {
+	series := make([]costSeries, 0, len(values))
+	for labels, value := range values {
+		series = append(series, costSeries{labels: labels, value: value})
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].value != series[j].value {
+			return series[i].value > series[j].value
+		}
+		return strings.Join(series[i].labels[:], "\x00") < strings.Join(series[j].labels[:], "\x00")
+	})
+	if limit <= 0 || len(series) <= limit {
+		return series, 0
+	}
+
+	kept := series[:limit]
+	other := make(map[[3]string]float64)
+	for _, s := range series[limit:] {
+		other[[3]string{OtherLabel, s.labels[1], s.labels[2]}] += s.value
+	}
+	for labels, value := range other {
+		kept = append(kept, costSeries{labels: labels, value: value})
+	}
+	return kept, len(series) - limit
+}
@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+func total(series []costSeries) float64 {
+	sum := 0.0
+	for _, s := range series {
+		sum += s.value
+	}
+	return sum
+}
+
+func TestLimitSeries(t *testing.T) {
+	clusters := []string{"lkc-1", "lkc-2"}
+	actions := []string{"KAFKA_NETWORK_READ", "KAFKA_NETWORK_WRITE"}
+	values := make(map[[3]string]float64)
+	want := 0.0
+	for i := 0; i < 1000; i++ {
+		value := float64(i) + 0.1
+		values[[3]string{fmt.Sprintf("capability-%d", i), clusters[i%2], actions[i/2%2]}] = value
+		want += value
+	}
+
+	tests := []struct {
+		limit      int
+		wantFolded int
+	}{
+		{limit: 0, wantFolded: 0},
+		{limit: 1000, wantFolded: 0},
+		{limit: 10, wantFolded: 990},
+		{limit: 1, wantFolded: 999},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.limit), func(t *testing.T) {
+			series, folded := limitSeries(values, test.limit)
+
+			if folded != test.wantFolded {
+				t.Errorf("got %d series folded, want %d", folded, test.wantFolded)
+			}
+			if got := total(series); math.Abs(got-want) > 1e-6 {
+				t.Errorf("got a total of %f, want %f", got, want)
+			}
+			// at most one _OTHER series per cluster and action is added to the kept series
+			if test.limit > 0 && len(series) > test.limit+len(clusters)*len(actions) {
+				t.Errorf("got %d series, want at most %d", len(series), test.limit+len(clusters)*len(actions))
+			}
+			if test.limit > 0 && test.wantFolded > 0 {
+				for i, s := range series[:test.limit] {
+					if s.labels[0] != fmt.Sprintf("capability-%d", 999-i) {
+						t.Fatalf("got %v kept at %d, want the largest series kept in order", s.labels, i)
+					}
+				}
+				for _, s := range series[test.limit:] {
+					if s.labels[0] != OtherLabel {
+						t.Errorf("got %v past the limit, want only %s series", s.labels, OtherLabel)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLimitSeriesIsBoundedByTheOtherLabels(t *testing.T) {
+	// every series has its own cluster, so the folded ones can not share an _OTHER series
+	values := make(map[[3]string]float64)
+	for i := 0; i < 5; i++ {
+		values[[3]string{fmt.Sprintf("capability-%d", i), fmt.Sprintf("lkc-%d", i), "KAFKA_NETWORK_READ"}] = float64(i)
+	}
+	series, folded := limitSeries(values, 2)
+	if folded != 3 || len(series) != 5 {
+		t.Errorf("got %d series with %d folded, want the 2 largest and an _OTHER series per cluster of the 3 others", len(series), folded)
+	}
+}
+
+func collect(collector *CostCollector) []prometheus.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+	var collected []prometheus.Metric
+	for metric := range ch {
+		collected = append(collected, metric)
+	}
+	return collected
+}
+
+func TestCostCollectorKeepsTheLatestDay(t *testing.T) {
+	collector := NewCostCollector(config.CostMetrics{MaxCapabilitySeries: 1, MaxTopicSeries: 1})
+	if metrics := collect(collector); len(metrics) != 0 {
+		t.Fatalf("got %d metrics before the first update, want none", len(metrics))
+	}
+
+	day := util.ToYearMonthDayDate(time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC))
+	rows := []model.ExportRow{
+		{Cost: 3, ClusterId: "lkc-1", Action: "KAFKA_NETWORK_READ", Capability: "a-abcde"},
+		{Cost: 2, ClusterId: "lkc-1", Action: "KAFKA_NETWORK_READ", Capability: "b-abcde"},
+		{Cost: 1, ClusterId: "lkc-1", Action: "KAFKA_NETWORK_READ", Capability: "c-abcde"},
+	}
+	collector.Update(rows, model.MetricsDataForDay{DayDate: day})
+	if total(collector.capabilityCosts) != 6 || len(collector.capabilityCosts) != 2 || collector.folded["ccc_capability_cost"] != 2 {
+		t.Errorf("got series %v, want a-abcde and the 2 others under %s", collector.capabilityCosts, OtherLabel)
+	}
+	// the day, 2 capability series and a folded count per metric
+	if metrics := collect(collector); len(metrics) != 5 {
+		t.Errorf("got %d metrics, want 5", len(metrics))
+	}
+
+	collector.Update(rows[:1], model.MetricsDataForDay{DayDate: util.ToYearMonthDayDate(day.ToTimeUTC().AddDate(0, 0, -1))})
+	if published, _ := collector.Day(); published != day || total(collector.capabilityCosts) != 6 {
+		t.Errorf("got day %s with a total of %f, want an older day to be ignored", published, total(collector.capabilityCosts))
+	}
+}
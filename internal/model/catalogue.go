@@ -0,0 +1,10 @@
+package model
+
+// CapabilityMetadata is a capability as described by the capability catalogue
+type CapabilityMetadata struct {
+	Id           CapabilityId `json:"id"`
+	DisplayName  string       `json:"displayName"`
+	Team         string       `json:"team"`
+	CostCentre   string       `json:"costCentre"`
+	BusinessUnit string       `json:"businessUnit"`
+}
@@ -1,32 +1,73 @@
 package model
 
-import "fmt"
-
 type ClusterId string
 
-const (
-	ClusterIdProd                       ClusterId = "lkc-4npj6"
-	ClusterIdDev                        ClusterId = "lkc-3wqzw"
-	ClusterIdDevelopmentCluster4        ClusterId = "lkc-3m912"
-	ClusterIdConfluentControlCenterTest ClusterId = "lkc-qykkd"
-	ClusterIdSSUDevEnvironment          ClusterId = "lkc-pj37pk"
-	ClusterIdSSUDevEnvironment2         ClusterId = "lkc-j9gknw"
-)
-
-var ConfluentClusters = []ClusterId{
-	ClusterIdProd,
-	ClusterIdDev,
-	ClusterIdDevelopmentCluster4,
-	ClusterIdConfluentControlCenterTest,
-	ClusterIdSSUDevEnvironment,
-	ClusterIdSSUDevEnvironment2,
-}
-
-func TryParseClusterId(s string) (ClusterId, error) {
-	for _, cluster := range ConfluentClusters {
-		if s == string(cluster) {
-			return cluster, nil
-		}
-	}
-	return "", fmt.Errorf("invalid cluster id: %s", s)
+// ClusterKindDedicated is the kind of clusters whose capacity is billed per CKU
+const ClusterKindDedicated = "Dedicated"
+
+type ConfluentCluster struct {
+	Id            ClusterId
+	DisplayName   string
+	EnvironmentId string
+	RestEndpoint  string
+	// Kind is Basic, Standard, Enterprise, Dedicated or Freight
+	Kind string
+}
+
+func (c ConfluentCluster) IsDedicated() bool {
+	return c.Kind == ClusterKindDedicated
+}
+
+type ConfluentEnvironmentsResponse struct {
+	ApiVersion string                 `json:"api_version"`
+	Kind       string                 `json:"kind"`
+	Data       []ConfluentEnvironment `json:"data"`
+	Metadata   struct {
+		Next string `json:"next"`
+	} `json:"metadata"`
+}
+
+type ConfluentEnvironment struct {
+	Id          string `json:"id"`
+	DisplayName string `json:"display_name"`
+}
+
+type ConfluentClustersResponse struct {
+	ApiVersion string                     `json:"api_version"`
+	Kind       string                     `json:"kind"`
+	Data       []ConfluentClusterResource `json:"data"`
+	Metadata   struct {
+		Next string `json:"next"`
+	} `json:"metadata"`
+}
+
+type ConfluentClusterResource struct {
+	Id   string `json:"id"`
+	Spec struct {
+		DisplayName  string `json:"display_name"`
+		Availability string `json:"availability"`
+		Cloud        string `json:"cloud"`
+		Region       string `json:"region"`
+		HttpEndpoint string `json:"http_endpoint"`
+		Config       struct {
+			Kind string `json:"kind"`
+		} `json:"config"`
+		Environment struct {
+			Id string `json:"id"`
+		} `json:"environment"`
+	} `json:"spec"`
+}
+
+type KafkaTopicsResponse struct {
+	Kind     string       `json:"kind"`
+	Data     []KafkaTopic `json:"data"`
+	Metadata struct {
+		Next string `json:"next"`
+	} `json:"metadata"`
+}
+
+type KafkaTopic struct {
+	TopicName       string `json:"topic_name"`
+	PartitionsCount int    `json:"partitions_count"`
+	IsInternal      bool   `json:"is_internal"`
 }
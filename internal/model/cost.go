@@ -1,6 +1,9 @@
 package model
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 const ConfluentCostKafkaStorageReplicationFactor = 3
 
@@ -32,6 +35,11 @@ var CostTypes = []CostType{
 	CostTypeSupport,
 }
 
+// ToCsvFormatString returns the action written to the export for cost types that are exported as is
+func (c CostType) ToCsvFormatString() string {
+	return strings.ReplaceAll(strings.ToLower(string(c)), "_", "-")
+}
+
 func TryParseCostType(s string) (CostType, error) {
 	for _, costType := range CostTypes {
 		if s == string(costType) {
@@ -92,31 +100,52 @@ type KafkaConfluentCost struct {
 	TotalCost   float64
 }
 
+type SupportConfluentCost struct {
+	CostType    CostType
+	ProductType ProductType
+	TotalCost   float64
+}
+
+type ConnectorId string
+
+type ConnectConfluentCost struct {
+	CostType      CostType
+	ProductType   ProductType
+	ConnectorId   ConnectorId
+	ConnectorName string
+	EnvironmentId string
+	CostPerUnit   float64
+	CostUnit      CostUnit
+	TotalCost     float64
+}
+
 type ConfluentCostResponse struct {
-	ApiVersion string `json:"api_version"`
-	Data       []struct {
-		Amount            float64 `json:"amount"`
-		EndDate           string  `json:"end_date"`
-		Granularity       string  `json:"granularity"`
-		LineType          string  `json:"line_type"`
-		OriginalAmount    float64 `json:"original_amount"`
-		Product           string  `json:"product"`
-		StartDate         string  `json:"start_date"`
-		DiscountAmount    float64 `json:"discount_amount,omitempty"`
-		NetworkAccessType string  `json:"network_access_type,omitempty"`
-		Price             float64 `json:"price,omitempty"`
-		Quantity          float64 `json:"quantity,omitempty"`
-		Resource          struct {
-			DisplayName string `json:"display_name"`
-			Environment struct {
-				Id string `json:"id"`
-			} `json:"environment"`
-			Id string `json:"id"`
-		} `json:"resource,omitempty"`
-		Unit string `json:"unit,omitempty"`
-	} `json:"data"`
-	Kind     string `json:"kind"`
-	Metadata struct {
+	ApiVersion string              `json:"api_version"`
+	Data       []ConfluentCostLine `json:"data"`
+	Kind       string              `json:"kind"`
+	Metadata   struct {
 		Next string `json:"next"`
 	} `json:"metadata"`
 }
+
+type ConfluentCostLine struct {
+	Amount            float64 `json:"amount"`
+	EndDate           string  `json:"end_date"`
+	Granularity       string  `json:"granularity"`
+	LineType          string  `json:"line_type"`
+	OriginalAmount    float64 `json:"original_amount"`
+	Product           string  `json:"product"`
+	StartDate         string  `json:"start_date"`
+	DiscountAmount    float64 `json:"discount_amount,omitempty"`
+	NetworkAccessType string  `json:"network_access_type,omitempty"`
+	Price             float64 `json:"price,omitempty"`
+	Quantity          float64 `json:"quantity,omitempty"`
+	Resource          struct {
+		DisplayName string `json:"display_name"`
+		Environment struct {
+			Id string `json:"id"`
+		} `json:"environment"`
+		Id string `json:"id"`
+	} `json:"resource,omitempty"`
+	Unit string `json:"unit,omitempty"`
+}
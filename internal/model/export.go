@@ -0,0 +1,149 @@
+package model
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+	"io"
+	"strconv"
+)
+
+// ExportRow is a single line of the daily cost export
+type ExportRow struct {
+	Date util.YearMonthDayDate
+	Cost float64
+	Name string
+	// ClusterId holds the id of the billed resource, the Kafka cluster or the connector
+	ClusterId  string
+	Action     string
+	Capability string
+
+	// PrincipalId is the consuming principal read bytes were attributed to, only set with principal attribution
+	PrincipalId PrincipalId
+	// PrincipalName is the display name of PrincipalId when it could be looked up
+	PrincipalName string
+	// ProducerCapability owns the topic, ConsumerCapability is the capability of PrincipalId
+	ProducerCapability string
+	ConsumerCapability string
+
+	// CapabilityName, Team, CostCentre and BusinessUnit describe Capability, they are looked up in the capability catalogue
+	CapabilityName string
+	Team           string
+	CostCentre     string
+	BusinessUnit   string
+
+	// CostType is the Confluent cost type the row was allocated from, it is only exported when ExportFormat.CostType is set
+	CostType CostType
+}
+
+// ExportFormat decides which columns are part of the export
+type ExportFormat struct {
+	// PrincipalAttribution adds the principal, producer and consumer columns
+	PrincipalAttribution bool
+	// CapabilityMetadata adds the columns looked up in the capability catalogue
+	CapabilityMetadata bool
+	// CostType adds the cost type column, it tells apart the rows of cost types that share an action like those allocated by load
+	CostType bool
+}
+
+func (f ExportFormat) Headers() []string {
+	headers := []string{"Date", "Cost", "Name", "ClusterId", "Action", "Capability"}
+	if f.PrincipalAttribution {
+		headers = append(headers, "PrincipalId", "PrincipalName", "ProducerCapability", "ConsumerCapability")
+	}
+	if f.CapabilityMetadata {
+		headers = append(headers, "CapabilityName", "Team", "CostCentre", "BusinessUnit")
+	}
+	if f.CostType {
+		headers = append(headers, "CostType")
+	}
+	return headers
+}
+
+func (f ExportFormat) Record(r ExportRow) []string {
+	record := []string{
+		r.Date.ToCSVString(),
+		fmt.Sprintf("%f", r.Cost),
+		r.Name,
+		r.ClusterId,
+		r.Action,
+		r.Capability,
+	}
+	if f.PrincipalAttribution {
+		record = append(record, string(r.PrincipalId), r.PrincipalName, r.ProducerCapability, r.ConsumerCapability)
+	}
+	if f.CapabilityMetadata {
+		record = append(record, r.CapabilityName, r.Team, r.CostCentre, r.BusinessUnit)
+	}
+	if f.CostType {
+		record = append(record, string(r.CostType))
+	}
+	return record
+}
+
+// ParseExportRows reads an export written with any ExportFormat, the columns are found by their header
+func ParseExportRows(r io.Reader) ([]ExportRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	headers, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int, len(headers))
+	for i, header := range headers {
+		columns[header] = i
+	}
+	for _, required := range []string{"Date", "Cost"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("export has no %s column", required)
+		}
+	}
+
+	var rows []ExportRow
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(header string) string {
+			if i, ok := columns[header]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+
+		date, err := util.ParseYearMonthDayDate(field("Date"))
+		if err != nil {
+			return nil, err
+		}
+		cost, err := strconv.ParseFloat(field("Cost"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cost %s: %w", field("Cost"), err)
+		}
+		rows = append(rows, ExportRow{
+			Date:               date,
+			Cost:               cost,
+			Name:               field("Name"),
+			ClusterId:          field("ClusterId"),
+			Action:             field("Action"),
+			Capability:         field("Capability"),
+			PrincipalId:        PrincipalId(field("PrincipalId")),
+			PrincipalName:      field("PrincipalName"),
+			ProducerCapability: field("ProducerCapability"),
+			ConsumerCapability: field("ConsumerCapability"),
+			CapabilityName:     field("CapabilityName"),
+			Team:               field("Team"),
+			CostCentre:         field("CostCentre"),
+			BusinessUnit:       field("BusinessUnit"),
+			CostType:           CostType(field("CostType")),
+		})
+	}
+}
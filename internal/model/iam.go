@@ -0,0 +1,47 @@
+package model
+
+type ConfluentServiceAccountsResponse struct {
+	ApiVersion string                    `json:"api_version"`
+	Kind       string                    `json:"kind"`
+	Data       []ConfluentServiceAccount `json:"data"`
+	Metadata   struct {
+		Next string `json:"next"`
+	} `json:"metadata"`
+}
+
+type ConfluentServiceAccount struct {
+	Id          string `json:"id"`
+	DisplayName string `json:"display_name"`
+	Description string `json:"description"`
+}
+
+type ConfluentApiKeysResponse struct {
+	ApiVersion string            `json:"api_version"`
+	Kind       string            `json:"kind"`
+	Data       []ConfluentApiKey `json:"data"`
+	Metadata   struct {
+		Next string `json:"next"`
+	} `json:"metadata"`
+}
+
+type ConfluentApiKey struct {
+	Id   string `json:"id"`
+	Spec struct {
+		DisplayName string `json:"display_name"`
+		Description string `json:"description"`
+		Owner       struct {
+			Id   string `json:"id"`
+			Kind string `json:"kind"`
+		} `json:"owner"`
+	} `json:"spec"`
+}
+
+// PrincipalOwner describes who is behind a principal, API keys are resolved to the service account owning them
+type PrincipalOwner struct {
+	Id          PrincipalId
+	DisplayName string
+	Description string
+	// OwnerId is the service account or user owning an API key, it is the principal itself for service accounts
+	OwnerId    PrincipalId
+	Capability string
+}
@@ -16,10 +16,14 @@ var ConfluentMetrics = []MetricKey{
 	ConfluentKafkaServerReceivedBytes,
 	ConfluentKafkaServerSentBytes,
 	ConfluentKafkaServerRetainedBytes,
+	ConfluentKafkaServerResponseBytes,
+	ConfluentKafkaServerRequestBytes,
+}
 
-	// TODO: Re enable when whole flow works
-	//ConfluentKafkaServerResponseBytes,
-	//ConfluentKafkaServerRequestBytes
+// ConfluentLoadMetrics drive the load based allocation of cluster capacity costs
+var ConfluentLoadMetrics = []MetricKey{
+	ConfluentKafkaServerRequestBytes,
+	ConfluentKafkaServerResponseBytes,
 }
 
 func (m MetricKey) IsValid() bool {
@@ -53,12 +57,22 @@ func (m MetricKey) ToConfluentCostType() CostType {
 	case ConfluentKafkaServerRetainedBytes:
 		return CostTypeKafkaStorage
 	}
+	// request and response bytes are not billed by volume, they only drive the load based allocation
 	return "INVALID"
 }
 
+// IsLoad reports whether the metric is one of ConfluentLoadMetrics
+func (m MetricKey) IsLoad() bool {
+	return m == ConfluentKafkaServerRequestBytes || m == ConfluentKafkaServerResponseBytes
+}
+
 type MetricsDataForDay struct {
 	DayDate util.YearMonthDayDate
 	Topics  map[MetricKey]map[ClusterId]map[TopicName]MetricData
+	// SentBytesByPrincipal breaks ConfluentKafkaServerSentBytes down by consuming principal, only gathered for principal attribution
+	SentBytesByPrincipal map[ClusterId]map[TopicName]map[PrincipalId]MetricData
+	// Partitions holds the average partition count of each topic over the day
+	Partitions map[ClusterId]map[TopicName]float64
 
 	TotalCostPerClusterWrittenBytes map[ClusterId]float64
 	TotalCostPerClusterReadBytes    map[ClusterId]float64
@@ -2,3 +2,4 @@ package model
 
 type CapabilityId string
 type TopicName string
+type PrincipalId string
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"sync"
+	"time"
+)
+
+// CapabilityCatalogue caches the capability catalogue for ttl. When the catalogue can not be read
+// the last known capabilities are kept and reading is attempted again once ttl has passed.
+type CapabilityCatalogue struct {
+	catalogueClient *client.CapabilityCatalogueClient
+	ttl             time.Duration
+
+	mu            sync.Mutex
+	capabilities  map[model.CapabilityId]model.CapabilityMetadata
+	lastAttemptAt time.Time
+}
+
+func NewCapabilityCatalogue(catalogueClient *client.CapabilityCatalogueClient, ttl time.Duration) *CapabilityCatalogue {
+	return &CapabilityCatalogue{
+		catalogueClient: catalogueClient,
+		ttl:             ttl,
+		capabilities:    make(map[model.CapabilityId]model.CapabilityMetadata),
+	}
+}
+
+// Capabilities returns the cached capabilities, reading the catalogue first when the cache has expired
+func (c *CapabilityCatalogue) Capabilities(ctx context.Context) map[model.CapabilityId]model.CapabilityMetadata {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.lastAttemptAt) >= c.ttl {
+		c.lastAttemptAt = time.Now()
+		capabilities, err := c.catalogueClient.GetCapabilities(ctx)
+		if err != nil {
+			log.Err(err).Msgf("failed to refresh capability catalogue, keeping %d last known capabilities", len(c.capabilities))
+		} else {
+			c.capabilities = make(map[model.CapabilityId]model.CapabilityMetadata, len(capabilities))
+			for _, capability := range capabilities {
+				c.capabilities[capability.Id] = capability
+			}
+			log.Info().Msgf("capability catalogue refreshed, %d capabilities known", len(c.capabilities))
+		}
+	}
+
+	return c.capabilities
+}
@@ -0,0 +1,77 @@
+package service_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/service"
+)
+
+const catalogueJson = `[
+	{"id": "dataplatform-ajamn", "displayName": "Data Platform", "team": "Data", "costCentre": "CC-1", "businessUnit": "Technology"},
+	{"id": "cloudengineering-xyzab", "displayName": "Cloud Engineering", "team": "Cloud", "costCentre": "CC-2", "businessUnit": "Technology"}
+]`
+
+func newFileCatalogue(t *testing.T, content string, ttl time.Duration) (*service.CapabilityCatalogue, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "catalogue.json")
+	writeFile(t, path, content)
+	return service.NewCapabilityCatalogue(client.NewCapabilityCatalogueClient(config.Catalogue{File: path}), ttl), path
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCapabilityCatalogueReadsFile(t *testing.T) {
+	catalogue, _ := newFileCatalogue(t, catalogueJson, time.Hour)
+
+	capabilities := catalogue.Capabilities(context.Background())
+	if len(capabilities) != 2 {
+		t.Fatalf("got %d capabilities, want 2", len(capabilities))
+	}
+	metadata := capabilities["dataplatform-ajamn"]
+	if metadata.DisplayName != "Data Platform" || metadata.Team != "Data" || metadata.CostCentre != "CC-1" || metadata.BusinessUnit != "Technology" {
+		t.Errorf("got metadata %+v", metadata)
+	}
+}
+
+func TestCapabilityCatalogueIsCachedForTtl(t *testing.T) {
+	catalogue, path := newFileCatalogue(t, catalogueJson, time.Hour)
+	catalogue.Capabilities(context.Background())
+
+	writeFile(t, path, `[]`)
+	if got := len(catalogue.Capabilities(context.Background())); got != 2 {
+		t.Errorf("got %d capabilities, want the 2 cached ones until the ttl has passed", got)
+	}
+}
+
+func TestCapabilityCatalogueKeepsLastKnownCapabilitiesOnFailure(t *testing.T) {
+	catalogue, path := newFileCatalogue(t, catalogueJson, 0)
+	catalogue.Capabilities(context.Background())
+
+	writeFile(t, path, `not json`)
+	if got := len(catalogue.Capabilities(context.Background())); got != 2 {
+		t.Errorf("got %d capabilities after a parse error, want the 2 last known ones", got)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(catalogue.Capabilities(context.Background())); got != 2 {
+		t.Errorf("got %d capabilities with the file gone, want the 2 last known ones", got)
+	}
+
+	writeFile(t, path, `[{"id": "dataplatform-ajamn"}]`)
+	if got := len(catalogue.Capabilities(context.Background())); got != 1 {
+		t.Errorf("got %d capabilities, want the 1 capability read once the file is fixed", got)
+	}
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClusterRegistry keeps track of the Kafka clusters in the Confluent Cloud organisation.
+// Clusters are discovered through the Confluent Cloud API unless a static list is configured.
+type ClusterRegistry struct {
+	confluentCloudClient *client.ConfluentCloudClient
+	staticClusters       []model.ConfluentCluster
+
+	mu       sync.RWMutex
+	clusters map[model.ClusterId]model.ConfluentCluster
+}
+
+func NewClusterRegistry(confluentCloudClient *client.ConfluentCloudClient, confluentConfig config.Confluent) *ClusterRegistry {
+	registry := &ClusterRegistry{
+		confluentCloudClient: confluentCloudClient,
+		clusters:             make(map[model.ClusterId]model.ConfluentCluster),
+	}
+	for _, cluster := range confluentConfig.Clusters {
+		registry.staticClusters = append(registry.staticClusters, model.ConfluentCluster{
+			Id:            model.ClusterId(cluster.Id),
+			DisplayName:   cluster.DisplayName,
+			EnvironmentId: cluster.EnvironmentId,
+			RestEndpoint:  cluster.RestEndpoint,
+			Kind:          cluster.Kind,
+		})
+	}
+	return registry
+}
+
+func (r *ClusterRegistry) IsStatic() bool {
+	return len(r.staticClusters) > 0
+}
+
+// Refresh replaces the known clusters with the static list from config, or with the clusters currently
+// found across all environments. On failure the previously known clusters are kept.
+func (r *ClusterRegistry) Refresh(ctx context.Context) error {
+	clusters := make(map[model.ClusterId]model.ConfluentCluster)
+
+	if r.IsStatic() {
+		for _, cluster := range r.staticClusters {
+			clusters[cluster.Id] = cluster
+		}
+	} else {
+		environments, err := r.confluentCloudClient.GetEnvironments(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to list confluent environments: %w", err)
+		}
+		for _, environment := range environments.Data {
+			environmentClusters, err := r.confluentCloudClient.GetClusters(ctx, environment.Id)
+			if err != nil {
+				return fmt.Errorf("unable to list clusters in environment %s: %w", environment.Id, err)
+			}
+			for _, cluster := range environmentClusters.Data {
+				clusters[model.ClusterId(cluster.Id)] = model.ConfluentCluster{
+					Id:            model.ClusterId(cluster.Id),
+					DisplayName:   cluster.Spec.DisplayName,
+					EnvironmentId: environment.Id,
+					RestEndpoint:  cluster.Spec.HttpEndpoint,
+					Kind:          cluster.Spec.Config.Kind,
+				}
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.clusters = clusters
+	r.mu.Unlock()
+
+	log.Info().Msgf("cluster registry refreshed, %d clusters known", len(clusters))
+	return nil
+}
+
+// Work refreshes the registry every intervalSeconds, it returns straight away when a static list is configured
+func (r *ClusterRegistry) Work(intervalSeconds int) {
+	if r.IsStatic() || intervalSeconds <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := r.Refresh(context.Background()); err != nil {
+			log.Err(err).Msg("failed to refresh cluster registry, keeping previously known clusters")
+		}
+	}
+}
+
+// Clusters returns the known clusters sorted by id
+func (r *ClusterRegistry) Clusters() []model.ConfluentCluster {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clusters := make([]model.ConfluentCluster, 0, len(r.clusters))
+	for _, cluster := range r.clusters {
+		clusters = append(clusters, cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Id < clusters[j].Id
+	})
+	return clusters
+}
+
+func (r *ClusterRegistry) ClusterIds() []model.ClusterId {
+	clusters := r.Clusters()
+	ids := make([]model.ClusterId, 0, len(clusters))
+	for _, cluster := range clusters {
+		ids = append(ids, cluster.Id)
+	}
+	return ids
+}
+
+func (r *ClusterRegistry) Get(clusterId model.ClusterId) (model.ConfluentCluster, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cluster, ok := r.clusters[clusterId]
+	return cluster, ok
+}
+
+func (r *ClusterRegistry) TryParseClusterId(s string) (model.ClusterId, error) {
+	if _, ok := r.Get(model.ClusterId(s)); ok {
+		return model.ClusterId(s), nil
+	}
+	return "", fmt.Errorf("invalid cluster id: %s", s)
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/rs/zerolog/log"
@@ -8,20 +9,27 @@ import (
 	"go.dfds.cloud/ccc-exporter/internal/model"
 	"go.dfds.cloud/ccc-exporter/internal/util"
 	"os"
+	"sort"
+	"sync"
 	"time"
 )
 
 type confluentCostForDay struct {
-	kafka map[model.ClusterId]map[model.CostType]model.KafkaConfluentCost
+	kafka   map[model.ClusterId]map[model.CostType]model.KafkaConfluentCost
+	connect map[model.ConnectorId]map[model.CostType]model.ConnectConfluentCost
+	support []model.SupportConfluentCost
+	// lines are the billed lines the costs were cached from
+	lines []model.ConfluentCostLine
 }
 
 func newConfluentCostForDay() *confluentCostForDay {
 	return &confluentCostForDay{
-		kafka: make(map[model.ClusterId]map[model.CostType]model.KafkaConfluentCost),
+		kafka:   make(map[model.ClusterId]map[model.CostType]model.KafkaConfluentCost),
+		connect: make(map[model.ConnectorId]map[model.CostType]model.ConnectConfluentCost),
 	}
 }
-func (c *confluentCostForDay) setupClusters() {
-	for _, cluster := range model.ConfluentClusters {
+func (c *confluentCostForDay) setupClusters(clusterIds []model.ClusterId) {
+	for _, cluster := range clusterIds {
 		c.kafka[cluster] = make(map[model.CostType]model.KafkaConfluentCost)
 	}
 }
@@ -29,8 +37,11 @@ func (c *confluentCostForDay) setupClusters() {
 type ConfluentCostService struct {
 	// Can change from day to day, start with just keeping the latest
 
+	// mu guards cachedCosts, which is read by the API while the worker fills it
+	mu                   sync.RWMutex
 	cachedCosts          map[util.YearMonthDayDate]confluentCostForDay
 	confluentCloudClient *client.ConfluentCloudClient
+	clusterRegistry      *ClusterRegistry
 }
 
 func (c *ConfluentCostService) SetupTestCostsFromFile() bool {
@@ -68,10 +79,11 @@ func (c *ConfluentCostService) SetupTestCostsFromFile() bool {
 
 	return true
 }
-func NewConfluentCostService(confluentCloudClient *client.ConfluentCloudClient, useTestCosts bool) *ConfluentCostService {
+func NewConfluentCostService(confluentCloudClient *client.ConfluentCloudClient, clusterRegistry *ClusterRegistry, useTestCosts bool) *ConfluentCostService {
 	manager := &ConfluentCostService{
 		cachedCosts:          make(map[util.YearMonthDayDate]confluentCostForDay),
 		confluentCloudClient: confluentCloudClient,
+		clusterRegistry:      clusterRegistry,
 	}
 
 	if useTestCosts {
@@ -88,12 +100,17 @@ func NewConfluentCostService(confluentCloudClient *client.ConfluentCloudClient,
 }
 
 func (c *ConfluentCostService) CacheCosts(date util.YearMonthDayDate, costs model.ConfluentCostResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
 	if _, ok := c.cachedCosts[date]; !ok {
 		newCosts := newConfluentCostForDay()
-		newCosts.setupClusters()
+		newCosts.setupClusters(c.clusterRegistry.ClusterIds())
 		c.cachedCosts[date] = *newCosts
 	}
+	costsForDay := c.cachedCosts[date]
+	costsForDay.lines = append(costsForDay.lines, costs.Data...)
+	c.cachedCosts[date] = costsForDay
 
 	for _, cost := range costs.Data {
 		costType, err := model.TryParseCostType(cost.LineType)
@@ -113,12 +130,33 @@ func (c *ConfluentCostService) CacheCosts(date util.YearMonthDayDate, costs mode
 		}
 		switch productType {
 		case model.ProductTypeConnect:
+			connectorId := model.ConnectorId(cost.Resource.Id)
+			if connectorId == "" {
+				log.Error().Msgf("connect cost of type %s has no connector id", costType)
+				continue
+			}
+			if _, ok := c.cachedCosts[date].connect[connectorId]; !ok {
+				c.cachedCosts[date].connect[connectorId] = make(map[model.CostType]model.ConnectConfluentCost)
+			}
+			c.cachedCosts[date].connect[connectorId][costType] = model.ConnectConfluentCost{
+				CostType:      costType,
+				ProductType:   productType,
+				ConnectorId:   connectorId,
+				ConnectorName: cost.Resource.DisplayName,
+				EnvironmentId: cost.Resource.Environment.Id,
+				CostPerUnit:   cost.Price,
+				CostUnit:      costUnit,
+				TotalCost:     cost.Amount,
+			}
 		case model.ProductTypeKafka:
-			clusterId, err := model.TryParseClusterId(cost.Resource.Id)
+			clusterId, err := c.clusterRegistry.TryParseClusterId(cost.Resource.Id)
 			if err != nil {
 				log.Error().Msgf("failed to parse cluster id: %s", err)
 				continue
 			}
+			if _, ok := c.cachedCosts[date].kafka[clusterId]; !ok {
+				c.cachedCosts[date].kafka[clusterId] = make(map[model.CostType]model.KafkaConfluentCost)
+			}
 			c.cachedCosts[date].kafka[clusterId][costType] = model.KafkaConfluentCost{
 				CostType:    costType,
 				ProductType: productType,
@@ -128,11 +166,20 @@ func (c *ConfluentCostService) CacheCosts(date util.YearMonthDayDate, costs mode
 				TotalCost:   cost.Amount,
 			}
 		case model.ProductTypeSupport:
+			costsForDay := c.cachedCosts[date]
+			costsForDay.support = append(costsForDay.support, model.SupportConfluentCost{
+				CostType:    costType,
+				ProductType: productType,
+				TotalCost:   cost.Amount,
+			})
+			c.cachedCosts[date] = costsForDay
 		}
 	}
 }
 
 func (c *ConfluentCostService) GetKafkaCosts(date util.YearMonthDayDate, clusterId model.ClusterId, costType model.CostType) (model.KafkaConfluentCost, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
 	costsForDay, ok := c.cachedCosts[date]
 	if !ok {
@@ -150,25 +197,76 @@ func (c *ConfluentCostService) GetKafkaCosts(date util.YearMonthDayDate, cluster
 	return costOfType, nil
 }
 
+func (c *ConfluentCostService) GetSupportCosts(date util.YearMonthDayDate) ([]model.SupportConfluentCost, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	costsForDay, ok := c.cachedCosts[date]
+	if !ok {
+		return nil, fmt.Errorf("no costs found for date %s", date)
+	}
+	return costsForDay.support, nil
+}
+
+// GetConnectCosts returns every connect cost for the date, ordered by connector id and cost type
+func (c *ConfluentCostService) GetConnectCosts(date util.YearMonthDayDate) ([]model.ConnectConfluentCost, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	costsForDay, ok := c.cachedCosts[date]
+	if !ok {
+		return nil, fmt.Errorf("no costs found for date %s", date)
+	}
+
+	var costs []model.ConnectConfluentCost
+	for _, connectorCosts := range costsForDay.connect {
+		for _, cost := range connectorCosts {
+			costs = append(costs, cost)
+		}
+	}
+	sort.Slice(costs, func(i, j int) bool {
+		if costs[i].ConnectorId != costs[j].ConnectorId {
+			return costs[i].ConnectorId < costs[j].ConnectorId
+		}
+		return costs[i].CostType < costs[j].CostType
+	})
+	return costs, nil
+}
+
+// Forget drops the cached costs of the date, they are fetched again on the next FetchAndCacheCosts
+func (c *ConfluentCostService) Forget(date util.YearMonthDayDate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.cachedCosts, date)
+}
+
+// CachedCostLines returns the billed lines the costs of the date were cached from, CacheCosts caches them again
+func (c *ConfluentCostService) CachedCostLines(date util.YearMonthDayDate) ([]model.ConfluentCostLine, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	costsForDay, ok := c.cachedCosts[date]
+	return append([]model.ConfluentCostLine(nil), costsForDay.lines...), ok
+}
+
 func (c *ConfluentCostService) HasCostsForDate(date util.YearMonthDayDate) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	_, ok := c.cachedCosts[date]
 	return ok
 }
 
-func (c *ConfluentCostService) FetchAndCacheCosts(dayTime util.YearMonthDayDate) {
-	costs, err := c.getCostsForDate(dayTime)
+func (c *ConfluentCostService) FetchAndCacheCosts(ctx context.Context, dayTime util.YearMonthDayDate) error {
+	costs, err := c.getCostsForDate(ctx, dayTime)
 	if err != nil {
-		log.Err(err).Msgf("failed to get costs for date %s", dayTime)
-		return
+		return fmt.Errorf("failed to get costs for date %s: %w", dayTime, err)
 	}
 	c.CacheCosts(dayTime, costs)
+	return nil
 }
 
-func (c *ConfluentCostService) getCostsForDate(date util.YearMonthDayDate) (model.ConfluentCostResponse, error) {
+func (c *ConfluentCostService) getCostsForDate(ctx context.Context, date util.YearMonthDayDate) (model.ConfluentCostResponse, error) {
 
 	toTime := date.ToTimeUTC()
 	fromTime := toTime.Add(-24 * time.Hour)
-	costs, err := c.confluentCloudClient.GetCosts(fromTime, toTime)
+	costs, err := c.confluentCloudClient.GetCosts(ctx, fromTime, toTime)
 	if err != nil {
 		return model.ConfluentCostResponse{}, err
 	}
@@ -1,23 +1,39 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"github.com/rs/zerolog/log"
-	"go.dfds.cloud/ccc-exporter/internal/client"
 	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/telemetry"
 	"go.dfds.cloud/ccc-exporter/internal/util"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type GathererService struct {
-	client      *client.PrometheusClient
+	sources         *PrometheusSources
+	clusterRegistry *ClusterRegistry
+	// mu guards cachedUsage, which is read by the API while the worker fills it
+	mu          sync.RWMutex
 	cachedUsage map[util.YearMonthDayDate]model.MetricsDataForDay
+
+	options GathererOptions
+}
+
+type GathererOptions struct {
+	// GatherPrincipals adds sent bytes per principal to the usage data
+	GatherPrincipals bool
+	// PartitionCounter adds partition counts to the usage data when set
+	PartitionCounter PartitionCounter
 }
 
-func NewGatherer(client *client.PrometheusClient) *GathererService {
-	return &GathererService{client: client,
-		cachedUsage: make(map[util.YearMonthDayDate]model.MetricsDataForDay)}
+func NewGatherer(sources *PrometheusSources, clusterRegistry *ClusterRegistry, options GathererOptions) *GathererService {
+	return &GathererService{sources: sources,
+		clusterRegistry: clusterRegistry,
+		cachedUsage:     make(map[util.YearMonthDayDate]model.MetricsDataForDay),
+		options:         options}
 }
 
 type AllMetricsResponse struct {
@@ -25,12 +41,23 @@ type AllMetricsResponse struct {
 	PerDay map[model.MetricKey]map[model.ClusterId]map[string][]model.MetricData
 }
 
-func getQueryForMetric(metricKey model.MetricKey, timeDiffInSeconds int) string {
-	if metricKey == model.ConfluentKafkaServerRetainedBytes {
-		return fmt.Sprintf("%s offset %ds", metricKey, timeDiffInSeconds)
-	}
-	innerQuery := fmt.Sprintf("%s[1d] offset %ds", metricKey, timeDiffInSeconds)
-	return fmt.Sprintf("sum_over_time(%s)", innerQuery)
+// dailyEvaluationTime is when the daily queries of day are evaluated. The costs of day are billed from the day before
+// up to its midnight, see ConfluentCostService.getCostsForDate, so the [1d] range of the queries ends at that midnight too.
+func dailyEvaluationTime(day util.YearMonthDayDate) time.Time {
+	return day.ToTimeUTC()
+}
+
+// getLoadQuery adds up the request and response bytes of a topic, Confluent splits them into a series per request type
+// and principal. The replica labels are kept so the series of each replica are merged rather than added up.
+func getLoadQuery(metricKey model.MetricKey, replicaLabels []string) string {
+	labels := append([]string{"kafka_id", "topic"}, replicaLabels...)
+	return fmt.Sprintf("sum by (%s) (%s)", strings.Join(labels, ", "), getDailyQueryForMetric(metricKey))
+}
+
+// getPrincipalQuery keeps the replica labels so the series of each replica are merged rather than added up
+func getPrincipalQuery(replicaLabels []string) string {
+	labels := append([]string{"kafka_id", "topic", "principal_id"}, replicaLabels...)
+	return fmt.Sprintf("sum by (%s) (%s)", strings.Join(labels, ", "), getDailyQueryForMetric(model.ConfluentKafkaServerSentBytes))
 }
 
 func getTotalPerCluster(metricKey model.MetricKey, costs model.MetricsDataForDay) map[model.ClusterId]float64 {
@@ -44,56 +71,57 @@ func getTotalPerCluster(metricKey model.MetricKey, costs model.MetricsDataForDay
 	return costsPerCluster
 }
 
+// GetMetricsForDay gets the usage billed on a day with an instant query per metric evaluated at its midnight (UTC)
 func (g *GathererService) GetMetricsForDay(targetTime util.YearMonthDayDate) (model.MetricsDataForDay, error) {
-
-	now := time.Now().UTC()
-
-	cached, ok := g.cachedUsage[targetTime]
-	if ok {
+	if cached, ok := g.CachedMetricsForDay(targetTime); ok {
 		return cached, nil
 	}
 
-	timeDiffInSeconds := int(now.Sub(targetTime.ToTimeUTC()).Seconds()) // loss of precision, but good enough for this use case
-	if timeDiffInSeconds <= 0 {
-		return model.MetricsDataForDay{}, fmt.Errorf("cannot get metrics for current/future day")
+	at := dailyEvaluationTime(targetTime)
+	if at.After(time.Now()) {
+		return model.MetricsDataForDay{}, fmt.Errorf("cannot get metrics for future day %s", targetTime)
 	}
 
+	clusterIds := g.clusterRegistry.ClusterIds()
 	metricsForDayAndTopic := make(map[model.MetricKey]map[model.ClusterId]map[model.TopicName]model.MetricData)
 	for _, metric := range model.ConfluentMetrics {
 		metricsForDayAndTopic[metric] = make(map[model.ClusterId]map[model.TopicName]model.MetricData)
-		for _, clusterId := range model.ConfluentClusters {
+		for _, clusterId := range clusterIds {
 			metricsForDayAndTopic[metric][clusterId] = make(map[model.TopicName]model.MetricData)
 		}
 	}
 
 	for _, metricKey := range model.ConfluentMetrics {
-		query := getQueryForMetric(metricKey, timeDiffInSeconds)
-		log.Info().Msgf("querying prometheus with: %s", query)
-		queryResp, err := g.client.Query(query, float64(now.Unix()))
-		if err != nil {
-			return model.MetricsDataForDay{}, err
+		query := getDailyQueryForMetric(metricKey)
+		if metricKey.IsLoad() {
+			query = getLoadQuery(metricKey, g.sources.ReplicaLabels())
 		}
-
-		data, err := client.ResultToVector(queryResp.Data.Result)
+		data, err := g.sources.QueryVector(string(metricKey), query, at)
 		if err != nil {
 			return model.MetricsDataForDay{}, err
 		}
 		for _, vector := range data {
-			clusterId, err := model.TryParseClusterId(vector.Metric.KafkaID)
+			clusterId, err := g.clusterRegistry.TryParseClusterId(vector.Metric.KafkaID)
 
 			if err != nil {
 				log.Err(err).Msgf("error when attempting to parse KafkaId returned from prometheus")
 				continue
 			}
+			if _, ok := metricsForDayAndTopic[metricKey][clusterId]; !ok {
+				metricsForDayAndTopic[metricKey][clusterId] = make(map[model.TopicName]model.MetricData)
+			}
 
-			valueAsFloat, err := strconv.ParseFloat(vector.Value.Value, 64)
+			valueAsFloat, err := vector.Value.Float()
 			if err != nil {
 				log.Err(err).Msgf("error when attempting to parse value returned from prometheus")
 				continue
 			}
 			topicName := model.TopicName(vector.Metric.Topic)
-			if _, ok := metricsForDayAndTopic[metricKey][clusterId][topicName]; ok {
-				log.Fatal().Msgf("duplicate metric found for topic: %s", vector.Metric.Topic)
+			if existing, ok := metricsForDayAndTopic[metricKey][clusterId][topicName]; ok {
+				// e.g. the same cluster scraped by jobs with different labels
+				log.Warn().Msgf("duplicate %s series found for topic %s on cluster %s, merging them", metricKey, topicName, clusterId)
+				telemetry.DuplicateSeries.WithLabelValues(string(metricKey)).Inc()
+				valueAsFloat = g.sources.Merge(existing.Value, valueAsFloat)
 			}
 			metricsForDayAndTopic[metricKey][clusterId][topicName] = model.MetricData{
 				Time:  vector.Value.Time,
@@ -107,88 +135,161 @@ func (g *GathererService) GetMetricsForDay(targetTime util.YearMonthDayDate) (mo
 		Topics:  metricsForDayAndTopic,
 	}
 
+	if g.options.GatherPrincipals {
+		sentBytesByPrincipal, err := g.getSentBytesByPrincipal(at)
+		if err != nil {
+			return model.MetricsDataForDay{}, err
+		}
+		metricsDataForDay.SentBytesByPrincipal = sentBytesByPrincipal
+	}
+
+	if g.options.PartitionCounter != nil {
+		// without partition counts the partition costs are left unallocated rather than failing the export
+		partitions, err := g.options.PartitionCounter.PartitionCounts(context.Background(), targetTime)
+		if err != nil {
+			log.Err(err).Msgf("unable to count partitions for %s, leaving partition costs unallocated", targetTime)
+		}
+		metricsDataForDay.Partitions = partitions
+	}
+
 	metricsDataForDay.TotalCostPerClusterReadBytes = getTotalPerCluster(model.ConfluentKafkaServerReceivedBytes, metricsDataForDay)
 	metricsDataForDay.TotalCostPerClusterWrittenBytes = getTotalPerCluster(model.ConfluentKafkaServerSentBytes, metricsDataForDay)
 
-	for _, clusterId := range model.ConfluentClusters {
+	for _, clusterId := range clusterIds {
 		metricsDataForDay.TotalCostReadBytes += metricsDataForDay.TotalCostPerClusterReadBytes[clusterId]
 		metricsDataForDay.TotalCostWrittenBytes += metricsDataForDay.TotalCostPerClusterWrittenBytes[clusterId]
 	}
 
+	g.mu.Lock()
 	g.cachedUsage[targetTime] = metricsDataForDay
+	g.mu.Unlock()
 
-	return g.cachedUsage[targetTime], nil
+	return metricsDataForDay, nil
 }
 
-func (g *GathererService) GetAllMetrics() *AllMetricsResponse {
-	dataStore30Days := make(map[model.MetricKey]map[model.ClusterId]map[string]float64)
-	dataStorePerDay := make(map[model.MetricKey]map[model.ClusterId]map[string][]model.MetricData)
-	now := time.Now()
+// CacheMetricsForDay caches usage gathered before, e.g. by a previous run, GetMetricsForDay then returns it
+func (g *GathererService) CacheMetricsForDay(metricsDataForDay model.MetricsDataForDay) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cachedUsage[metricsDataForDay.DayDate] = metricsDataForDay
+}
 
-	for _, metricKey := range model.ConfluentMetrics {
-		// check if metricKey exists in dataStore30Days and dataStorePerDay, if not, init
-		if _, ok := dataStore30Days[metricKey]; !ok {
-			dataStore30Days[metricKey] = make(map[model.ClusterId]map[string]float64)
+// Forget drops the cached usage of the day, it is queried again on the next GetMetricsForDay
+func (g *GathererService) Forget(targetTime util.YearMonthDayDate) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.cachedUsage, targetTime)
+}
+
+// CachedMetricsForDay returns the usage of a day when it was gathered before, without querying Prometheus
+func (g *GathererService) CachedMetricsForDay(targetTime util.YearMonthDayDate) (model.MetricsDataForDay, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	cached, ok := g.cachedUsage[targetTime]
+	return cached, ok
+}
+
+func (g *GathererService) getSentBytesByPrincipal(at time.Time) (map[model.ClusterId]map[model.TopicName]map[model.PrincipalId]model.MetricData, error) {
+	data, err := g.sources.QueryVector(string(model.ConfluentKafkaServerSentBytes), getPrincipalQuery(g.sources.ReplicaLabels()), at)
+	if err != nil {
+		return nil, err
+	}
+
+	sentBytesByPrincipal := make(map[model.ClusterId]map[model.TopicName]map[model.PrincipalId]model.MetricData)
+	for _, vector := range data {
+		clusterId, err := g.clusterRegistry.TryParseClusterId(vector.Metric.KafkaID)
+		if err != nil {
+			log.Err(err).Msgf("error when attempting to parse KafkaId returned from prometheus")
+			continue
 		}
-		if _, ok := dataStorePerDay[metricKey]; !ok {
-			dataStorePerDay[metricKey] = make(map[model.ClusterId]map[string][]model.MetricData)
+		valueAsFloat, err := vector.Value.Float()
+		if err != nil {
+			log.Err(err).Msgf("error when attempting to parse value returned from prometheus")
+			continue
 		}
 
-		baseQuery := fmt.Sprintf("sum_over_time(%s[1d]", metricKey)
-		for i := 0; i <= 30; i++ {
-			var query = baseQuery
-			timestamp := now
-			if i != 0 {
-				query = fmt.Sprintf("%s offset %dd)", baseQuery, i)
-				timestamp = now.Add(time.Duration(i*24) * -time.Hour)
-				if metricKey == model.ConfluentKafkaServerRetainedBytes {
-					query = fmt.Sprintf("%s offset %dd", model.ConfluentKafkaServerRetainedBytes, i)
-				}
-			} else {
-				query = fmt.Sprintf("%s)", query)
-				if metricKey == model.ConfluentKafkaServerRetainedBytes {
-					query = fmt.Sprintf("%s offset 1h", model.ConfluentKafkaServerRetainedBytes) // not perfect, WIP
-				}
-			}
+		topicName := model.TopicName(vector.Metric.Topic)
+		if _, ok := sentBytesByPrincipal[clusterId]; !ok {
+			sentBytesByPrincipal[clusterId] = make(map[model.TopicName]map[model.PrincipalId]model.MetricData)
+		}
+		if _, ok := sentBytesByPrincipal[clusterId][topicName]; !ok {
+			sentBytesByPrincipal[clusterId][topicName] = make(map[model.PrincipalId]model.MetricData)
+		}
+		principalId := model.PrincipalId(vector.Metric.PrincipalId)
+		metricData := sentBytesByPrincipal[clusterId][topicName][principalId]
+		metricData.Time = vector.Value.Time
+		metricData.Value += valueAsFloat
+		sentBytesByPrincipal[clusterId][topicName][principalId] = metricData
+	}
 
-			fmt.Println(query)
+	return sentBytesByPrincipal, nil
+}
 
-			queryResp, err := g.client.Query(query, float64(now.Unix()))
-			if err != nil {
-				log.Fatal().Err(err).Msg("error querying prometheus")
-			}
+// allMetricsDays is the number of whole days covered by GetAllMetrics
+const allMetricsDays = 30
 
-			data, err := client.ResultToVector(queryResp.Data.Result)
-			if err != nil {
-				log.Fatal().Err(err).Msg("error parsing prometheus response")
-			}
+// getDailyQueryForMetric sums counters over the day ending at the evaluation time, gauges are averaged over it
+func getDailyQueryForMetric(metricKey model.MetricKey) string {
+	if metricKey == model.ConfluentKafkaServerRetainedBytes {
+		return fmt.Sprintf("avg_over_time(%s[1d])", metricKey)
+	}
+	return fmt.Sprintf("sum_over_time(%s[1d])", metricKey)
+}
 
-			for _, vector := range data {
-				if _, ok := dataStorePerDay[metricKey][model.ClusterId(vector.Metric.KafkaID)]; !ok {
-					dataStorePerDay[metricKey][model.ClusterId(vector.Metric.KafkaID)] = map[string][]model.MetricData{}
-				}
-				if _, ok := dataStorePerDay[metricKey][model.ClusterId(vector.Metric.KafkaID)][vector.Metric.Topic]; !ok {
-					dataStorePerDay[metricKey][model.ClusterId(vector.Metric.KafkaID)][vector.Metric.Topic] = []model.MetricData{}
-				}
-				if _, ok := dataStore30Days[metricKey][model.ClusterId(vector.Metric.KafkaID)]; !ok {
-					dataStore30Days[metricKey][model.ClusterId(vector.Metric.KafkaID)] = map[string]float64{}
-				}
+// GetAllMetrics gets the usage of each of the last 30 whole days (UTC) with a single range query per metric.
+// Days30 holds the sum over the days, except for retained bytes which holds the most recent day.
+func (g *GathererService) GetAllMetrics() (*AllMetricsResponse, error) {
+	dataStore30Days := make(map[model.MetricKey]map[model.ClusterId]map[string]float64)
+	dataStorePerDay := make(map[model.MetricKey]map[model.ClusterId]map[string][]model.MetricData)
+
+	// every evaluation at midnight covers the day before it
+	year, month, day := time.Now().UTC().Date()
+	end := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	start := end.Add(-time.Duration(allMetricsDays-1) * 24 * time.Hour)
+
+	for _, metricKey := range model.ConfluentMetrics {
+		dataStore30Days[metricKey] = make(map[model.ClusterId]map[string]float64)
+		dataStorePerDay[metricKey] = make(map[model.ClusterId]map[string][]model.MetricData)
+
+		data, err := g.sources.QueryMatrix(string(metricKey), getDailyQueryForMetric(metricKey), start, end, 24*time.Hour)
+		if err != nil {
+			return nil, fmt.Errorf("error querying prometheus: %w", err)
+		}
 
-				f64, _ := strconv.ParseFloat(vector.Value.Value, 64)
+		for _, series := range data {
+			clusterId := model.ClusterId(series.Metric.KafkaID)
+			topic := series.Metric.Topic
+			if _, ok := dataStorePerDay[metricKey][clusterId]; !ok {
+				dataStorePerDay[metricKey][clusterId] = map[string][]model.MetricData{}
+			}
+			if _, ok := dataStore30Days[metricKey][clusterId]; !ok {
+				dataStore30Days[metricKey][clusterId] = map[string]float64{}
+			}
 
-				dataStorePerDay[metricKey][model.ClusterId(vector.Metric.KafkaID)][vector.Metric.Topic] = append(dataStorePerDay[metricKey][model.ClusterId(vector.Metric.KafkaID)][vector.Metric.Topic], model.MetricData{
-					Time:  float64(timestamp.Unix()),
+			var latest model.MetricData
+			for _, sample := range series.Values {
+				f64, err := sample.Float()
+				if err != nil {
+					log.Err(err).Msgf("error when attempting to parse value returned from prometheus")
+					continue
+				}
+				metricData := model.MetricData{
+					// the sample covers the day before its evaluation time
+					Time:  sample.Time - (24 * time.Hour).Seconds(),
 					Value: f64,
-				})
+				}
+				dataStorePerDay[metricKey][clusterId][topic] = append(dataStorePerDay[metricKey][clusterId][topic], metricData)
 
 				if metricKey == model.ConfluentKafkaServerRetainedBytes {
-					if i == 0 {
-						dataStore30Days[metricKey][model.ClusterId(vector.Metric.KafkaID)][vector.Metric.Topic] = f64
+					if metricData.Time >= latest.Time {
+						latest = metricData
 					}
 				} else {
-					dataStore30Days[metricKey][model.ClusterId(vector.Metric.KafkaID)][vector.Metric.Topic] = dataStore30Days[metricKey][model.ClusterId(vector.Metric.KafkaID)][vector.Metric.Topic] + f64
+					dataStore30Days[metricKey][clusterId][topic] += f64
 				}
-
+			}
+			if metricKey == model.ConfluentKafkaServerRetainedBytes {
+				dataStore30Days[metricKey][clusterId][topic] = latest.Value
 			}
 		}
 	}
@@ -196,5 +297,5 @@ func (g *GathererService) GetAllMetrics() *AllMetricsResponse {
 	return &AllMetricsResponse{
 		Days30: dataStore30Days,
 		PerDay: dataStorePerDay,
-	}
+	}, nil
 }
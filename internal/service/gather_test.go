@@ -0,0 +1,101 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/service"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+// recordedQuery is an instant query received by newRecordingPrometheus
+type recordedQuery struct {
+	query string
+	time  string
+}
+
+// newRecordingPrometheus answers every instant query with a single series of lkc-1 and records the queries
+func newRecordingPrometheus(t *testing.T) (*service.GathererService, func() []recordedQuery) {
+	t.Helper()
+	var mu sync.Mutex
+	var queries []recordedQuery
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, recordedQuery{query: r.FormValue("query"), time: r.FormValue("time")})
+		mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"status": "success",
+			"data": map[string]any{
+				"resultType": "vector",
+				"result": []map[string]any{{
+					"metric": map[string]string{"kafka_id": "lkc-1", "topic": "pub.a-abcde.x"},
+					"value":  []any{0, "42"},
+				}},
+			},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	sources, err := service.NewPrometheusSources(config.Prometheus{PrometheusEndpoint: config.PrometheusEndpoint{Endpoint: server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterRegistry := service.NewClusterRegistry(nil, config.Confluent{Clusters: []config.Cluster{{Id: "lkc-1"}}})
+	if err := clusterRegistry.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	gatherer := service.NewGatherer(sources, clusterRegistry, service.GathererOptions{GatherPrincipals: true})
+	return gatherer, func() []recordedQuery {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]recordedQuery(nil), queries...)
+	}
+}
+
+func TestGetMetricsForDayEvaluatesAtMidnight(t *testing.T) {
+	gatherer, queries := newRecordingPrometheus(t)
+	day := util.YearMonthDayDate{Year: 2024, Month: 3, Day: 2}
+
+	data, err := gatherer.GetMetricsForDay(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := data.Topics[model.ConfluentKafkaServerReceivedBytes]["lkc-1"]["pub.a-abcde.x"].Value; got != 42 {
+		t.Errorf("got received bytes %f, want 42", got)
+	}
+
+	// the [1d] range evaluated at midnight covers the same day as the costs billed for the day
+	wantTime := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC).Unix()
+	recorded := queries()
+	if len(recorded) != len(model.ConfluentMetrics)+1 {
+		t.Errorf("got %d queries, want one per metric and one for the principals", len(recorded))
+	}
+	for _, query := range recorded {
+		if strings.Contains(query.query, "offset") || !strings.Contains(query.query, "[1d]") {
+			t.Errorf("got query %s, want a [1d] range without offset", query.query)
+		}
+		var at float64
+		if err := json.Unmarshal([]byte(query.time), &at); err != nil || int64(at) != wantTime {
+			t.Errorf("got evaluation time %s for %s, want %d", query.time, query.query, wantTime)
+		}
+	}
+}
+
+func TestGetMetricsForDayRejectsFutureDays(t *testing.T) {
+	gatherer, queries := newRecordingPrometheus(t)
+
+	if _, err := gatherer.GetMetricsForDay(util.ToYearMonthDayDate(time.Now().UTC().AddDate(0, 0, 1))); err == nil {
+		t.Error("got no error for tomorrow")
+	}
+	if got := len(queries()); got != 0 {
+		t.Errorf("got %d queries, want none", got)
+	}
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/telemetry"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+	"time"
+)
+
+// PartitionCounter counts the partitions of every topic on a day
+type PartitionCounter interface {
+	PartitionCounts(ctx context.Context, day util.YearMonthDayDate) (map[model.ClusterId]map[model.TopicName]float64, error)
+}
+
+// NewPartitionCounter returns the counter for the configured source, or nil when partitions are not counted
+func NewPartitionCounter(partitionsConfig config.Partitions, prometheusSources *PrometheusSources, confluentCloudClient *client.ConfluentCloudClient, clusterRegistry *ClusterRegistry) (PartitionCounter, error) {
+	switch partitionsConfig.Source {
+	case "none", "":
+		return nil, nil
+	case "prometheus":
+		if partitionsConfig.Metric == "" {
+			return nil, fmt.Errorf("no partition count metric configured")
+		}
+		return &prometheusPartitionCounter{
+			sources:         prometheusSources,
+			clusterRegistry: clusterRegistry,
+			metric:          partitionsConfig.Metric,
+		}, nil
+	case "rest":
+		credentials := make(map[model.ClusterId]config.KafkaRestCredentials)
+		for _, clusterCredentials := range partitionsConfig.Credentials {
+			credentials[model.ClusterId(clusterCredentials.ClusterId)] = clusterCredentials
+		}
+		return &restPartitionCounter{
+			client:          confluentCloudClient,
+			clusterRegistry: clusterRegistry,
+			credentials:     credentials,
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid partitions source %s", partitionsConfig.Source)
+}
+
+// prometheusPartitionCounter averages a partition count gauge over the day
+type prometheusPartitionCounter struct {
+	sources         *PrometheusSources
+	clusterRegistry *ClusterRegistry
+	metric          string
+}
+
+func (c *prometheusPartitionCounter) PartitionCounts(_ context.Context, day util.YearMonthDayDate) (map[model.ClusterId]map[model.TopicName]float64, error) {
+	at := dailyEvaluationTime(day)
+	if at.After(time.Now()) {
+		return nil, fmt.Errorf("cannot get partition counts for future day %s", day)
+	}
+
+	query := fmt.Sprintf("max by (kafka_id, topic) (avg_over_time(%s[1d]))", c.metric)
+	data, err := c.sources.QueryVector(c.metric, query, at)
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := make(map[model.ClusterId]map[model.TopicName]float64)
+	withoutTopic := 0
+	for _, vector := range data {
+		// e.g. the partition_count of the Confluent metrics API, it only counts the partitions of a whole cluster
+		if vector.Metric.Topic == "" {
+			withoutTopic++
+			continue
+		}
+		clusterId, err := c.clusterRegistry.TryParseClusterId(vector.Metric.KafkaID)
+		if err != nil {
+			log.Err(err).Msgf("error when attempting to parse KafkaId returned from prometheus")
+			continue
+		}
+		valueAsFloat, err := vector.Value.Float()
+		if err != nil {
+			log.Err(err).Msgf("error when attempting to parse value returned from prometheus")
+			continue
+		}
+		if _, ok := partitions[clusterId]; !ok {
+			partitions[clusterId] = make(map[model.TopicName]float64)
+		}
+		partitions[clusterId][model.TopicName(vector.Metric.Topic)] = valueAsFloat
+	}
+	if withoutTopic > 0 {
+		log.Warn().Msgf("skipped %d %s series without a topic label, their partitions are left unallocated", withoutTopic, c.metric)
+		telemetry.SkippedRows.WithLabelValues("no_topic", string(model.CostTypeKafkaPartition)).Add(float64(withoutTopic))
+	}
+	return partitions, nil
+}
+
+// restPartitionCounter lists the current topics of every cluster with a REST endpoint and credentials
+type restPartitionCounter struct {
+	client          *client.ConfluentCloudClient
+	clusterRegistry *ClusterRegistry
+	credentials     map[model.ClusterId]config.KafkaRestCredentials
+}
+
+func (c *restPartitionCounter) PartitionCounts(ctx context.Context, _ util.YearMonthDayDate) (map[model.ClusterId]map[model.TopicName]float64, error) {
+	partitions := make(map[model.ClusterId]map[model.TopicName]float64)
+	for _, cluster := range c.clusterRegistry.Clusters() {
+		credentials, ok := c.credentials[cluster.Id]
+		if !ok || cluster.RestEndpoint == "" {
+			log.Warn().Msgf("no rest endpoint or credentials for cluster %s, not counting its partitions", cluster.Id)
+			continue
+		}
+		topics, err := c.client.GetTopics(ctx, cluster.RestEndpoint, string(cluster.Id), credentials.ApiKeyId, credentials.ApiKeySecret)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list topics of cluster %s: %w", cluster.Id, err)
+		}
+		partitions[cluster.Id] = make(map[model.TopicName]float64)
+		for _, topic := range topics.Data {
+			partitions[cluster.Id][model.TopicName(topic.TopicName)] = float64(topic.PartitionsCount)
+		}
+	}
+	return partitions, nil
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// PrincipalDirectory keeps track of the service accounts and API keys in the Confluent Cloud organisation,
+// so principal ids found in metrics can be shown with a human-readable owner and capability.
+type PrincipalDirectory struct {
+	confluentCloudClient *client.ConfluentCloudClient
+	iamConfig            config.Iam
+	capabilityPattern    *regexp.Regexp
+
+	mu     sync.RWMutex
+	owners map[model.PrincipalId]model.PrincipalOwner
+}
+
+func NewPrincipalDirectory(confluentCloudClient *client.ConfluentCloudClient, iamConfig config.Iam) (*PrincipalDirectory, error) {
+	directory := &PrincipalDirectory{
+		confluentCloudClient: confluentCloudClient,
+		iamConfig:            iamConfig,
+		owners:               make(map[model.PrincipalId]model.PrincipalOwner),
+	}
+	switch iamConfig.CapabilityField {
+	case "", "description", "displayName":
+	default:
+		return nil, fmt.Errorf("invalid iam capability field %s", iamConfig.CapabilityField)
+	}
+	if iamConfig.CapabilityPattern != "" {
+		pattern, err := regexp.Compile(iamConfig.CapabilityPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid iam capability pattern: %w", err)
+		}
+		directory.capabilityPattern = pattern
+	}
+	return directory, nil
+}
+
+func (d *PrincipalDirectory) IsEnabled() bool {
+	return d.iamConfig.Discover
+}
+
+// Refresh replaces the known principals with the service accounts and API keys currently in the organisation.
+// On failure the previously known principals are kept.
+func (d *PrincipalDirectory) Refresh(ctx context.Context) error {
+	if !d.IsEnabled() {
+		return nil
+	}
+
+	serviceAccounts, err := d.confluentCloudClient.GetServiceAccounts(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list confluent service accounts: %w", err)
+	}
+	apiKeys, err := d.confluentCloudClient.GetApiKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list confluent api keys: %w", err)
+	}
+
+	owners := make(map[model.PrincipalId]model.PrincipalOwner)
+	for _, serviceAccount := range serviceAccounts.Data {
+		principalId := model.PrincipalId(serviceAccount.Id)
+		owners[principalId] = model.PrincipalOwner{
+			Id:          principalId,
+			DisplayName: serviceAccount.DisplayName,
+			Description: serviceAccount.Description,
+			OwnerId:     principalId,
+			Capability:  d.extractCapability(serviceAccount),
+		}
+	}
+	// API keys inherit the capability of the service account owning them
+	for _, apiKey := range apiKeys.Data {
+		principalId := model.PrincipalId(apiKey.Id)
+		ownerId := model.PrincipalId(apiKey.Spec.Owner.Id)
+		owners[principalId] = model.PrincipalOwner{
+			Id:          principalId,
+			DisplayName: apiKey.Spec.DisplayName,
+			Description: apiKey.Spec.Description,
+			OwnerId:     ownerId,
+			Capability:  owners[ownerId].Capability,
+		}
+	}
+
+	d.mu.Lock()
+	d.owners = owners
+	d.mu.Unlock()
+
+	log.Info().Msgf("principal directory refreshed, %d service accounts and %d api keys known", len(serviceAccounts.Data), len(apiKeys.Data))
+	return nil
+}
+
+func (d *PrincipalDirectory) extractCapability(serviceAccount model.ConfluentServiceAccount) string {
+	if d.capabilityPattern == nil {
+		return ""
+	}
+	field := serviceAccount.Description
+	if d.iamConfig.CapabilityField == "displayName" {
+		field = serviceAccount.DisplayName
+	}
+	match := d.capabilityPattern.FindStringSubmatch(field)
+	if len(match) > 1 {
+		return match[1]
+	}
+	return ""
+}
+
+// Work refreshes the directory every intervalSeconds, it returns straight away when discovery is disabled
+func (d *PrincipalDirectory) Work(intervalSeconds int) {
+	if !d.IsEnabled() || intervalSeconds <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := d.Refresh(context.Background()); err != nil {
+			log.Err(err).Msg("failed to refresh principal directory, keeping previously known principals")
+		}
+	}
+}
+
+func (d *PrincipalDirectory) Get(principalId model.PrincipalId) (model.PrincipalOwner, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	owner, ok := d.owners[principalId]
+	return owner, ok
+}
+
+// Resolve returns the capability owning the principal, if one could be extracted
+func (d *PrincipalDirectory) Resolve(principalId model.PrincipalId) (string, bool) {
+	owner, ok := d.Get(principalId)
+	if !ok || owner.Capability == "" {
+		return "", false
+	}
+	return owner.Capability, true
+}
+
+// DisplayName returns the display name of the principal, or the principal id when it is unknown
+func (d *PrincipalDirectory) DisplayName(principalId model.PrincipalId) string {
+	if owner, ok := d.Get(principalId); ok && owner.DisplayName != "" {
+		return owner.DisplayName
+	}
+	return string(principalId)
+}
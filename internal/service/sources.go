@@ -0,0 +1,294 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/telemetry"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type MergeStrategy string
+
+const (
+	// MergeStrategyMax keeps the highest value, replicas that missed a scrape report less than the others
+	MergeStrategyMax MergeStrategy = "max"
+	// MergeStrategyFirst keeps the value of the first source in the configured order
+	MergeStrategyFirst MergeStrategy = "first"
+	// MergeStrategySum adds the values up, for sources that each see part of the traffic
+	MergeStrategySum MergeStrategy = "sum"
+)
+
+func parseMergeStrategy(strategy string) (MergeStrategy, error) {
+	switch MergeStrategy(strategy) {
+	case "", MergeStrategyMax:
+		return MergeStrategyMax, nil
+	case MergeStrategyFirst, MergeStrategySum:
+		return MergeStrategy(strategy), nil
+	}
+	return "", fmt.Errorf("invalid prometheus merge strategy %s", strategy)
+}
+
+// PrometheusSources queries every configured Prometheus and merges the results into one.
+// Series that only differ by a replica label are the same series. Within a source they come from replicas
+// and the highest value is kept, across sources the merge strategy decides their value.
+type PrometheusSources struct {
+	clients       []*client.PrometheusClient
+	strategy      MergeStrategy
+	replicaLabels map[string]struct{}
+}
+
+func NewPrometheusSources(prometheusConfig config.Prometheus) (*PrometheusSources, error) {
+	strategy, err := parseMergeStrategy(prometheusConfig.MergeStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := prometheusConfig.Sources
+	if len(endpoints) == 0 {
+		endpoints = []config.PrometheusEndpoint{prometheusConfig.PrometheusEndpoint}
+	}
+	sources := &PrometheusSources{
+		strategy:      strategy,
+		replicaLabels: make(map[string]struct{}),
+	}
+	for i, endpoint := range endpoints {
+		if endpoint.Endpoint == "" {
+			return nil, fmt.Errorf("prometheus source %d has no endpoint", i+1)
+		}
+		prometheusClient, err := client.NewPrometheusClient(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("prometheus source %s: %w", endpoint.Endpoint, err)
+		}
+		sources.clients = append(sources.clients, prometheusClient)
+	}
+	for _, label := range prometheusConfig.ReplicaLabels {
+		sources.replicaLabels[label] = struct{}{}
+	}
+	return sources, nil
+}
+
+// Clients returns a client per source in the configured order
+func (s *PrometheusSources) Clients() []*client.PrometheusClient {
+	return s.clients
+}
+
+// ReplicaLabels returns the labels telling replicas apart, sorted by name
+func (s *PrometheusSources) ReplicaLabels() []string {
+	labels := make([]string, 0, len(s.replicaLabels))
+	for label := range s.replicaLabels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// Merge combines two values of the same series, existing is the value seen first
+func (s *PrometheusSources) Merge(existing float64, value float64) float64 {
+	switch s.strategy {
+	case MergeStrategyFirst:
+		return existing
+	case MergeStrategySum:
+		return existing + value
+	}
+	return max(existing, value)
+}
+
+// QueryVector runs an instant query against every source, name identifies the query in logs and metrics
+func (s *PrometheusSources) QueryVector(name string, query string, at time.Time) ([]client.Vector, error) {
+	log.Info().Msgf("querying prometheus with: %s", query)
+	responses, err := s.queryAll(query, func(prometheusClient *client.PrometheusClient) (*client.QueryResponse, error) {
+		return prometheusClient.Query(query, float64(at.Unix()))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var merged []client.Vector
+	index := make(map[string]int)
+	for _, queryResp := range responses {
+		vectors, err := queryResp.ToVector()
+		if err != nil {
+			return nil, err
+		}
+		for _, vector := range s.dedupeReplicas(name, vectors) {
+			key := s.seriesKey(vector.Metric)
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(merged)
+				merged = append(merged, vector)
+				continue
+			}
+			telemetry.DuplicateSeries.WithLabelValues(name).Inc()
+			merged[i].Value = mergeSamples(merged[i].Value, vector.Value, s.Merge)
+		}
+	}
+	return merged, nil
+}
+
+// QueryMatrix runs a range query against every source, samples of the same series are merged by time
+func (s *PrometheusSources) QueryMatrix(name string, query string, start time.Time, end time.Time, step time.Duration) ([]client.Matrix, error) {
+	log.Info().Msgf("querying prometheus range %s to %s with: %s", start.Format(time.DateOnly), end.Format(time.DateOnly), query)
+	responses, err := s.queryAll(query, func(prometheusClient *client.PrometheusClient) (*client.QueryResponse, error) {
+		return prometheusClient.QueryRange(query, start, end, step)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var merged []client.Matrix
+	index := make(map[string]int)
+	for _, queryResp := range responses {
+		series, err := queryResp.ToMatrix()
+		if err != nil {
+			return nil, err
+		}
+		for _, matrix := range s.dedupeReplicaMatrices(name, series) {
+			key := s.seriesKey(matrix.Metric)
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(merged)
+				merged = append(merged, matrix)
+				continue
+			}
+			telemetry.DuplicateSeries.WithLabelValues(name).Inc()
+			merged[i].Values = mergeValues(merged[i].Values, matrix.Values, s.Merge)
+		}
+	}
+	return merged, nil
+}
+
+// dedupeReplicas merges the series of the replicas within a single source. They all saw the same traffic,
+// so the highest value is kept whatever the merge strategy, which only applies across sources.
+func (s *PrometheusSources) dedupeReplicas(name string, vectors []client.Vector) []client.Vector {
+	var deduped []client.Vector
+	index := make(map[string]int)
+	for _, vector := range vectors {
+		key := s.seriesKey(vector.Metric)
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(deduped)
+			deduped = append(deduped, vector)
+			continue
+		}
+		telemetry.DuplicateSeries.WithLabelValues(name).Inc()
+		deduped[i].Value = mergeSamples(deduped[i].Value, vector.Value, mergeReplicas)
+	}
+	return deduped
+}
+
+// dedupeReplicaMatrices is dedupeReplicas for the series of a range query
+func (s *PrometheusSources) dedupeReplicaMatrices(name string, series []client.Matrix) []client.Matrix {
+	var deduped []client.Matrix
+	index := make(map[string]int)
+	for _, matrix := range series {
+		key := s.seriesKey(matrix.Metric)
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(deduped)
+			deduped = append(deduped, matrix)
+			continue
+		}
+		telemetry.DuplicateSeries.WithLabelValues(name).Inc()
+		deduped[i].Values = mergeValues(deduped[i].Values, matrix.Values, mergeReplicas)
+	}
+	return deduped
+}
+
+// mergeReplicas keeps the highest value, replicas that missed a scrape report less than the others
+func mergeReplicas(existing float64, value float64) float64 {
+	return max(existing, value)
+}
+
+// queryAll runs the query against every source. A failing source is skipped as long as another one answered,
+// except when summing where every source holds part of the data.
+func (s *PrometheusSources) queryAll(query string, run func(*client.PrometheusClient) (*client.QueryResponse, error)) ([]*client.QueryResponse, error) {
+	var responses []*client.QueryResponse
+	var errs []error
+	for _, prometheusClient := range s.clients {
+		queryResp, err := run(prometheusClient)
+		if err != nil {
+			telemetry.SourceErrors.WithLabelValues(prometheusClient.Name()).Inc()
+			errs = append(errs, fmt.Errorf("prometheus source %s: %w", prometheusClient.Name(), err))
+			continue
+		}
+		for _, warning := range queryResp.Warnings {
+			log.Warn().Msgf("prometheus warning from %s for %s: %s", prometheusClient.Name(), query, warning)
+		}
+		responses = append(responses, queryResp)
+	}
+
+	if len(errs) > 0 {
+		if len(responses) == 0 || s.strategy == MergeStrategySum {
+			return nil, errors.Join(errs...)
+		}
+		for _, err := range errs {
+			log.Warn().Err(err).Msgf("skipping prometheus source for %s", query)
+		}
+	}
+	return responses, nil
+}
+
+// seriesKey identifies a series by its labels, leaving out the replica labels
+func (s *PrometheusSources) seriesKey(metric client.VectorMetricLabel) string {
+	names := make([]string, 0, len(metric.Labels))
+	for name := range metric.Labels {
+		if _, ok := s.replicaLabels[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name)
+		key.WriteByte('=')
+		key.WriteString(strconv.Quote(metric.Labels[name]))
+		key.WriteByte(',')
+	}
+	return key.String()
+}
+
+// mergeSamples combines two samples of the same series with merge, a sample that is not a number is left out
+func mergeSamples(existing client.VectorValue, sample client.VectorValue, merge func(existing float64, value float64) float64) client.VectorValue {
+	existingValue, err := existing.Float()
+	if err != nil {
+		return sample
+	}
+	value, err := sample.Float()
+	if err != nil {
+		return existing
+	}
+	return client.VectorValue{
+		Time:  max(existing.Time, sample.Time),
+		Value: strconv.FormatFloat(merge(existingValue, value), 'f', -1, 64),
+	}
+}
+
+// mergeValues combines the samples of two series by time with merge, the result is ordered by time
+func mergeValues(existing []client.VectorValue, values []client.VectorValue, merge func(existing float64, value float64) float64) []client.VectorValue {
+	byTime := make(map[float64]client.VectorValue, len(existing))
+	for _, sample := range existing {
+		byTime[sample.Time] = sample
+	}
+	for _, sample := range values {
+		if existingSample, ok := byTime[sample.Time]; ok {
+			sample = mergeSamples(existingSample, sample, merge)
+		}
+		byTime[sample.Time] = sample
+	}
+
+	merged := make([]client.VectorValue, 0, len(byTime))
+	for _, sample := range byTime {
+		merged = append(merged, sample)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Time < merged[j].Time
+	})
+	return merged
+}
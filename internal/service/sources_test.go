@@ -0,0 +1,189 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+)
+
+// testSeries is a series served by newTestSource, the same value is returned at every step of range queries
+type testSeries struct {
+	labels map[string]string
+	value  string
+}
+
+// newTestSource serves the series for instant and range queries, or fails every query with status 503 when series is nil
+func newTestSource(t *testing.T, series []testSeries) config.PrometheusEndpoint {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if series == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(map[string]any{"status": "error", "errorType": "unavailable", "error": "down"})
+			return
+		}
+		result := []map[string]any{}
+		resultType := client.ResultTypeVector
+		for _, s := range series {
+			if r.URL.Path == "/api/v1/query_range" {
+				resultType = client.ResultTypeMatrix
+				result = append(result, map[string]any{"metric": s.labels, "values": [][]any{{0, s.value}, {86400, s.value}}})
+			} else {
+				result = append(result, map[string]any{"metric": s.labels, "value": []any{0, s.value}})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": "success", "data": map[string]any{"resultType": resultType, "result": result}})
+	}))
+	t.Cleanup(server.Close)
+	return config.PrometheusEndpoint{Endpoint: server.URL}
+}
+
+func replica(name string, value string) testSeries {
+	return testSeries{labels: map[string]string{"kafka_id": "lkc-1", "topic": "x", "replica": name}, value: value}
+}
+
+func newTestSources(t *testing.T, strategy MergeStrategy, endpoints ...config.PrometheusEndpoint) *PrometheusSources {
+	t.Helper()
+	sources, err := NewPrometheusSources(config.Prometheus{Sources: endpoints, MergeStrategy: string(strategy), ReplicaLabels: []string{"replica"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sources
+}
+
+func TestSeriesKey(t *testing.T) {
+	sources := newTestSources(t, MergeStrategyMax, config.PrometheusEndpoint{Endpoint: "http://prometheus"})
+	key := func(labels map[string]string) string {
+		return sources.seriesKey(client.VectorMetricLabel{Labels: labels})
+	}
+
+	if key(map[string]string{"topic": "x", "replica": "a"}) != key(map[string]string{"topic": "x", "replica": "b"}) {
+		t.Error("series only differing by a replica label got different keys")
+	}
+	if key(map[string]string{"topic": "x", "kafka_id": "lkc-1"}) != key(map[string]string{"kafka_id": "lkc-1", "topic": "x"}) {
+		t.Error("key depends on the order of the labels")
+	}
+	if key(map[string]string{"topic": "x"}) == key(map[string]string{"topic": "y"}) {
+		t.Error("series with different labels got the same key")
+	}
+	if key(map[string]string{"a": `1",b="2`}) == key(map[string]string{"a": "1", "b": "2"}) {
+		t.Error("label values can forge the key of another series")
+	}
+}
+
+func TestMergeStrategies(t *testing.T) {
+	// the first source is an HA pair, the second a single Prometheus
+	pair := []testSeries{replica("a", "10"), replica("b", "8")}
+	single := []testSeries{replica("c", "5")}
+
+	tests := []struct {
+		strategy MergeStrategy
+		want     float64
+	}{
+		{strategy: MergeStrategyMax, want: 10},
+		{strategy: MergeStrategyFirst, want: 10},
+		// the replicas of the pair are one source, they are not added up
+		{strategy: MergeStrategySum, want: 15},
+	}
+	for _, test := range tests {
+		t.Run(string(test.strategy), func(t *testing.T) {
+			sources := newTestSources(t, test.strategy, newTestSource(t, pair), newTestSource(t, single))
+
+			vectors, err := sources.QueryVector("test", "up", time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(vectors) != 1 {
+				t.Fatalf("got %d series, want the replicas and sources merged into 1", len(vectors))
+			}
+			if got, _ := vectors[0].Value.Float(); got != test.want {
+				t.Errorf("got instant value %f, want %f", got, test.want)
+			}
+
+			matrices, err := sources.QueryMatrix("test", "up", time.Now(), time.Now(), 24*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(matrices) != 1 || len(matrices[0].Values) != 2 {
+				t.Fatalf("got series %+v, want 1 series with 2 samples", matrices)
+			}
+			for _, sample := range matrices[0].Values {
+				if got, _ := sample.Float(); got != test.want {
+					t.Errorf("got range value %f at %f, want %f", got, sample.Time, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeStrategyFirstKeepsTheFirstSource(t *testing.T) {
+	sources := newTestSources(t, MergeStrategyFirst, newTestSource(t, []testSeries{replica("a", "3")}), newTestSource(t, []testSeries{replica("b", "7")}))
+
+	vectors, err := sources.QueryVector("test", "up", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := vectors[0].Value.Float(); got != 3 {
+		t.Errorf("got %f, want the value of the first source", got)
+	}
+}
+
+func TestQueryAllWithFailingSources(t *testing.T) {
+	up := []testSeries{replica("a", "10")}
+	tests := []struct {
+		name      string
+		strategy  MergeStrategy
+		endpoints func(t *testing.T) []config.PrometheusEndpoint
+		wantErr   bool
+	}{
+		{
+			name:     "one of two down",
+			strategy: MergeStrategyMax,
+			endpoints: func(t *testing.T) []config.PrometheusEndpoint {
+				return []config.PrometheusEndpoint{newTestSource(t, nil), newTestSource(t, up)}
+			},
+		},
+		{
+			name:     "one of two down when summing",
+			strategy: MergeStrategySum,
+			endpoints: func(t *testing.T) []config.PrometheusEndpoint {
+				return []config.PrometheusEndpoint{newTestSource(t, up), newTestSource(t, nil)}
+			},
+			wantErr: true,
+		},
+		{
+			name:     "all down",
+			strategy: MergeStrategyMax,
+			endpoints: func(t *testing.T) []config.PrometheusEndpoint {
+				return []config.PrometheusEndpoint{newTestSource(t, nil), newTestSource(t, nil)}
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sources := newTestSources(t, test.strategy, test.endpoints(t)...)
+
+			vectors, err := sources.QueryVector("test", "up", time.Now())
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("got series %+v, want an error", vectors)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(vectors) != 1 {
+				t.Fatalf("got %d series, want the series of the source that is up", len(vectors))
+			}
+			if got, _ := vectors[0].Value.Float(); got != 10 {
+				t.Errorf("got %f, want 10", got)
+			}
+		})
+	}
+}
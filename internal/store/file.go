@@ -0,0 +1,67 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FileStore keeps the records in a single JSON file, written through a temporary file so a crash never leaves it half written
+type FileStore struct {
+	path string
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (f *FileStore) Load() ([]ExportProcessRecord, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read state file %s: %w", f.path, err)
+	}
+	return decodeRecords(data)
+}
+
+func (f *FileStore) Save(records []ExportProcessRecord) error {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(f.path), 0755)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write state file %s: %w", f.path, err)
+	}
+
+	return os.Rename(tmpFile.Name(), f.path)
+}
+
+func decodeRecords(data []byte) ([]ExportProcessRecord, error) {
+	var records []ExportProcessRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("unable to decode state: %w", err)
+	}
+	return records, nil
+}
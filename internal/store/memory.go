@@ -0,0 +1,26 @@
+package store
+
+import "sync"
+
+// MemoryStore does not persist anything beyond the lifetime of the process
+type MemoryStore struct {
+	mu      sync.Mutex
+	records []ExportProcessRecord
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (m *MemoryStore) Load() ([]ExportProcessRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]ExportProcessRecord{}, m.records...), nil
+}
+
+func (m *MemoryStore) Save(records []ExportProcessRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records = append([]ExportProcessRecord{}, records...)
+	return nil
+}
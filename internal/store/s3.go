@@ -0,0 +1,41 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+)
+
+// S3Store keeps the records as a single JSON object in S3, for deployments without persistent volumes
+type S3Store struct {
+	s3Client *client.S3Client
+	bucket   string
+	key      string
+}
+
+func NewS3Store(s3Client *client.S3Client, bucket string, key string) *S3Store {
+	return &S3Store{
+		s3Client: s3Client,
+		bucket:   bucket,
+		key:      key,
+	}
+}
+
+func (s *S3Store) Load() ([]ExportProcessRecord, error) {
+	data, err := s.s3Client.GetObject(s.bucket, s.key)
+	if errors.Is(err, client.ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecords(data)
+}
+
+func (s *S3Store) Save(records []ExportProcessRecord) error {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return s.s3Client.PutObject(s.bucket, s.key, data)
+}
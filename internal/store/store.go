@@ -0,0 +1,51 @@
+// Package store persists the state of export processes so the worker can resume after a restart
+package store
+
+import (
+	"fmt"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+	"time"
+)
+
+const (
+	StoreTypeFile = "file"
+	StoreTypeS3   = "s3"
+	StoreTypeNone = "none"
+)
+
+// ExportProcessRecord is the persisted form of an export process, finished processes included
+type ExportProcessRecord struct {
+	Date      util.YearMonthDayDate `json:"date"`
+	State     string                `json:"state"`
+	Attempts  int                   `json:"attempts"`
+	LastError string                `json:"lastError,omitempty"`
+	Force     bool                  `json:"force,omitempty"`
+	CreatedAt time.Time             `json:"createdAt"`
+	UpdatedAt time.Time             `json:"updatedAt"`
+	// Costs and Usage hold what the steps done so far fetched and the next steps still need,
+	// so a restarted worker resumes in the same state without fetching them again
+	Costs []model.ConfluentCostLine `json:"costs,omitempty"`
+	Usage *model.MetricsDataForDay  `json:"usage,omitempty"`
+}
+
+type StateStore interface {
+	// Load returns the records saved last, or no records when nothing has been saved yet
+	Load() ([]ExportProcessRecord, error)
+	// Save replaces all saved records
+	Save(records []ExportProcessRecord) error
+}
+
+func NewStateStore(stateConfig config.State, s3Config config.S3, s3Client *client.S3Client) (StateStore, error) {
+	switch stateConfig.Store {
+	case StoreTypeFile:
+		return NewFileStore(stateConfig.Path), nil
+	case StoreTypeS3:
+		return NewS3Store(s3Client, s3Config.BucketName, stateConfig.S3Key), nil
+	case StoreTypeNone:
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("invalid state store: %s", stateConfig.Store)
+}
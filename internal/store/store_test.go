@@ -0,0 +1,106 @@
+package store_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.dfds.cloud/ccc-exporter/config"
+	"go.dfds.cloud/ccc-exporter/internal/client"
+	"go.dfds.cloud/ccc-exporter/internal/fake"
+	"go.dfds.cloud/ccc-exporter/internal/model"
+	"go.dfds.cloud/ccc-exporter/internal/store"
+	"go.dfds.cloud/ccc-exporter/internal/util"
+)
+
+func testRecords() []store.ExportProcessRecord {
+	at := time.Date(2024, 3, 3, 10, 0, 0, 0, time.UTC)
+	day := util.YearMonthDayDate{Year: 2024, Month: 3, Day: 2}
+	line := model.ConfluentCostLine{LineType: "KAFKA_NETWORK_READ", Product: "KAFKA", Amount: 10, Unit: "GB", StartDate: "2024-03-01"}
+	line.Resource.Id = "lkc-1"
+	usage := model.MetricsDataForDay{
+		DayDate: day,
+		Topics: map[model.MetricKey]map[model.ClusterId]map[model.TopicName]model.MetricData{
+			model.ConfluentKafkaServerReceivedBytes: {"lkc-1": {"pub.a-abcde.x": {Time: 1709337600, Value: 42}}},
+		},
+		TotalCostPerClusterReadBytes: map[model.ClusterId]float64{"lkc-1": 42},
+		TotalCostReadBytes:           42,
+	}
+	return []store.ExportProcessRecord{
+		{Date: util.YearMonthDayDate{Year: 2024, Month: 3, Day: 1}, State: "FAILED", Attempts: 1, LastError: "unauthorized", CreatedAt: at, UpdatedAt: at},
+		{Date: day, State: "NEED_LOCAL_CSV_EXPORT", Force: true, CreatedAt: at, UpdatedAt: at.Add(time.Minute), Costs: []model.ConfluentCostLine{line}, Usage: &usage},
+	}
+}
+
+func assertRoundTrip(t *testing.T, stateStore store.StateStore) {
+	t.Helper()
+	records, err := stateStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("got records %+v before anything was saved", records)
+	}
+
+	if err := stateStore.Save(testRecords()); err != nil {
+		t.Fatal(err)
+	}
+	records, err = stateStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(records, testRecords()) {
+		t.Errorf("got records %+v, want %+v", records, testRecords())
+	}
+
+	if err := stateStore.Save(testRecords()[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if records, err = stateStore.Load(); err != nil || len(records) != 1 {
+		t.Errorf("got records %+v and error %v, want the saved records to be replaced", records, err)
+	}
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	assertRoundTrip(t, store.NewFileStore(filepath.Join(dir, "state", "export-state.json")))
+
+	entries, err := os.ReadDir(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files in the state dir, want no temporary files left", len(entries))
+	}
+}
+
+func TestFileStoreRejectsCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export-state.json")
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.NewFileStore(path).Load(); err == nil {
+		t.Error("got no error for a corrupt state file")
+	}
+}
+
+func TestS3StoreRoundTrip(t *testing.T) {
+	s3Server := fake.NewS3Server()
+	t.Cleanup(s3Server.Close)
+	s3Client, err := client.NewS3Client(aws.Config{Region: "eu-central-1", Credentials: aws.AnonymousCredentials{}}, config.S3{Endpoint: s3Server.URL, UsePathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertRoundTrip(t, store.NewS3Store(s3Client, "costs", "ccc-exporter/export-state.json"))
+	if _, ok := s3Server.Object("costs", "ccc-exporter/export-state.json"); !ok {
+		t.Error("state object was not put in the bucket")
+	}
+}
+
+func TestMemoryStoreRoundTrip(t *testing.T) {
+	assertRoundTrip(t, store.NewMemoryStore())
+}
@@ -0,0 +1,134 @@
+// Package telemetry holds the metrics the exporter reports about itself
+package telemetry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "ccc_exporter"
+
+// Upstreams the exporter calls, used as the upstream label
+const (
+	UpstreamConfluent  = "confluent"
+	UpstreamPrometheus = "prometheus"
+	UpstreamS3         = "s3"
+	UpstreamOidc       = "oidc"
+)
+
+// Sinks exports are written to, used as the sink label
+const (
+	SinkLocal = "local"
+	SinkS3    = "s3"
+)
+
+var (
+	// DuplicateSeries counts series that were found more than once and merged, e.g. because of HA Prometheus pairs
+	DuplicateSeries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "duplicate_series_total",
+		Help:      "Series found more than once in the Prometheus sources and merged by the merge strategy.",
+	}, []string{"metric"})
+
+	// SourceErrors counts failed queries per Prometheus source
+	SourceErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "prometheus_source_errors_total",
+		Help:      "Failed queries against a Prometheus source.",
+	}, []string{"source"})
+
+	// ExportProcesses is the number of ongoing export processes in each state
+	ExportProcesses = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "export_processes",
+		Help:      "Ongoing export processes by state.",
+	}, []string{"state"})
+
+	// ExportDayState is 1 for the current state of the export of each day in the lookback window
+	ExportDayState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "export_day_state",
+		Help:      "Current state of the export of a day, 1 for the state the export is in.",
+	}, []string{"date", "state"})
+
+	// ExportDayAttempts is the number of attempts made to export each day in the lookback window
+	ExportDayAttempts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "export_day_attempts",
+		Help:      "Failed attempts so far to export a day.",
+	}, []string{"date"})
+
+	// LastExportSuccess is the unix time a day in the lookback window was last exported successfully to a sink
+	LastExportSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_export_success_timestamp_seconds",
+		Help:      "Unix time the export of a day was last written successfully to a sink.",
+	}, []string{"date", "sink"})
+
+	// RequestDuration is the latency of calls to the upstream APIs, including failed calls
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of calls to Confluent Cloud, Prometheus, S3 and the OIDC provider.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"upstream", "operation"})
+
+	// RequestErrors counts failed calls to the upstream APIs
+	RequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_errors_total",
+		Help:      "Failed calls to Confluent Cloud, Prometheus, S3 and the OIDC provider.",
+	}, []string{"upstream", "operation"})
+
+	// SkippedRows counts usage that could not be turned into export rows
+	SkippedRows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "skipped_rows_total",
+		Help:      "Rows left out of exports, e.g. because no cost was found for the cluster and cost type.",
+	}, []string{"reason", "cost_type"})
+
+	// AuthDenied counts requests to the API and the admin listener that were turned away
+	AuthDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_denied_total",
+		Help:      "Requests rejected for a missing or invalid token, or a token without the required scope.",
+	}, []string{"reason", "scope"})
+)
+
+// ObserveRequest records the latency of a call to an upstream started at start, and counts it as failed when err is set
+func ObserveRequest(upstream string, operation string, start time.Time, err error) {
+	RequestDuration.WithLabelValues(upstream, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		RequestErrors.WithLabelValues(upstream, operation).Inc()
+	}
+}
+
+var (
+	exportedDatesMu sync.Mutex
+	// exportedDates are the dates with a LastExportSuccess series
+	exportedDates = make(map[string]bool)
+)
+
+// ExportSucceeded records that the export of date was written to sink just now
+func ExportSucceeded(date string, sink string) {
+	exportedDatesMu.Lock()
+	defer exportedDatesMu.Unlock()
+	exportedDates[date] = true
+	LastExportSuccess.WithLabelValues(date, sink).SetToCurrentTime()
+}
+
+// ForgetExportSuccessesBefore deletes the LastExportSuccess series of dates before oldest, dates are compared as
+// YYYY-MM-DD strings. It keeps the series from growing by a date every day.
+func ForgetExportSuccessesBefore(oldest string) {
+	exportedDatesMu.Lock()
+	defer exportedDatesMu.Unlock()
+	for date := range exportedDates {
+		if date < oldest {
+			LastExportSuccess.DeletePartialMatch(prometheus.Labels{"date": date})
+			delete(exportedDates, date)
+		}
+	}
+}
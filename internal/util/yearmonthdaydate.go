@@ -33,3 +33,24 @@ func ToYearMonthDayDate(t time.Time) YearMonthDayDate {
 		Day:   t.Day(),
 	}
 }
+
+func ParseYearMonthDayDate(s string) (YearMonthDayDate, error) {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return YearMonthDayDate{}, fmt.Errorf("invalid date %s, expected YYYY-MM-DD: %w", s, err)
+	}
+	return ToYearMonthDayDate(t), nil
+}
+
+func (d YearMonthDayDate) MarshalText() ([]byte, error) {
+	return []byte(d.ToCSVString()), nil
+}
+
+func (d *YearMonthDayDate) UnmarshalText(text []byte) error {
+	parsed, err := ParseYearMonthDayDate(string(text))
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}